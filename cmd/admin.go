@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rootCmd.PersistentFlags().String("admin-listen", "", "Address for the admin server exposing /metrics and /healthz (disabled when empty)")
+	viper.BindPFlag("admin-listen", rootCmd.PersistentFlags().Lookup("admin-listen"))
+}
+
+var (
+	healthMu     sync.Mutex
+	healthChecks = map[string]func() interface{}{}
+)
+
+// registerHealth adds a named component to the /healthz report. fn is
+// called on every request and its result is reported as JSON.
+func registerHealth(name string, fn func() interface{}) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	healthChecks[name] = fn
+}
+
+// healthHandler reports the state of every registered component.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	report := map[string]interface{}{"status": "ok"}
+	healthMu.Lock()
+	for name, fn := range healthChecks {
+		report[name] = fn()
+	}
+	healthMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// adminMux returns the handler served on the admin address.
+func adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", expvar.Handler())
+	mux.HandleFunc("/healthz", healthHandler)
+	return mux
+}
+
+// startAdminServer starts the admin server if --admin-listen is set. The
+// returned stop function shuts it down and is always safe to call.
+func startAdminServer() (stop func()) {
+	addr := viper.GetString("admin-listen")
+	if addr == "" {
+		return func() {}
+	}
+
+	s := &http.Server{
+		Addr:              addr,
+		Handler:           adminMux(),
+		ReadHeaderTimeout: 2 * time.Second,
+	}
+	go func() {
+		log.Printf("starting admin server on %s", s.Addr)
+		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("admin server error: %v", err)
+		}
+	}()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+	}
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	receiverCmd.Flags().Duration("allowlist-refresh", 0, "How often route allow-from-file lists are reloaded, in addition to on SIGHUP (0 disables)")
+	viper.BindPFlag("allowlist-refresh", receiverCmd.Flags().Lookup("allowlist-refresh"))
+}
+
+// checkAllowlist enforces the route's allowlist for the client at ip. If the
+// request is rejected it writes the response and returns false.
+func checkAllowlist(w http.ResponseWriter, r *http.Request, route *routeConfig, ip string) bool {
+	if route.allow == nil || route.allow.Contains(ip) {
+		return true
+	}
+	log.Printf("Rejected request from %s at %s: address not in the route's allowlist", ip, r.URL.Path)
+	rejected.Add("ip_allowlist", 1)
+	w.WriteHeader(http.StatusForbidden)
+	return false
+}
+
+// refreshAllowlists reloads the routes' allowlist files on SIGHUP and, if
+// interval is set, periodically, until ctx is done.
+func refreshAllowlists(ctx context.Context, routes routeTable, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+		}
+		for _, route := range routes {
+			if route.allow == nil || route.AllowFromFile == "" {
+				continue
+			}
+			if err := route.allow.Reload(); err != nil {
+				log.Printf("Failed to reload allowlist for route %s, keeping previous ranges: %v", route.Path, err)
+				continue
+			}
+			log.Printf("Reloaded allowlist for route %s: %d ranges", route.Path, route.allow.Len())
+		}
+	}
+}
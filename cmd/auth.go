@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/smarthall/webhook-relay/internal/auth"
+)
+
+// Authentication types for routes.
+const (
+	authBearer = "bearer"
+	authBasic  = "basic"
+	authQuery  = "query"
+	authPath   = "path"
+	authJWT    = "jwt"
+)
+
+// authConfig is a route's "auth" setting. Secrets may be given literally, as
+// "env:NAME" or as "file:PATH".
+type authConfig struct {
+	// Type is bearer, basic, query, path or jwt.
+	Type string `mapstructure:"type"`
+	// Tokens are the accepted tokens for bearer, query and path. Several
+	// may be listed to allow rotation.
+	Tokens []string `mapstructure:"tokens"`
+	// Users are the accepted "user:password" pairs for basic.
+	Users []string `mapstructure:"users"`
+	// Param is the query parameter holding the token for query.
+	Param string `mapstructure:"param"`
+
+	JWKSFile string        `mapstructure:"jwks-file"`
+	Issuer   string        `mapstructure:"issuer"`
+	Audience string        `mapstructure:"audience"`
+	Leeway   time.Duration `mapstructure:"leeway"`
+}
+
+func (ac *authConfig) validate() error {
+	switch ac.Type {
+	case authBearer, authPath:
+		if len(ac.Tokens) == 0 {
+			return fmt.Errorf("auth type %s requires tokens", ac.Type)
+		}
+	case authQuery:
+		if len(ac.Tokens) == 0 || ac.Param == "" {
+			return errors.New("auth type query requires param and tokens")
+		}
+	case authBasic:
+		if len(ac.Users) == 0 {
+			return errors.New("auth type basic requires users")
+		}
+		for _, u := range ac.Users {
+			if name, _, ok := strings.Cut(u, ":"); !ok || name == "" {
+				return fmt.Errorf("invalid basic auth user %q (want user:password)", u)
+			}
+		}
+	case authJWT:
+		if ac.JWKSFile == "" {
+			return errors.New("auth type jwt requires jwks-file")
+		}
+	default:
+		return fmt.Errorf("unsupported auth type %q (want bearer, basic, query, path or jwt)", ac.Type)
+	}
+	return nil
+}
+
+// authenticator builds the authenticator for the route at path, resolving
+// secrets and loading key files.
+func (ac *authConfig) authenticator(path string) (auth.Authenticator, error) {
+	switch ac.Type {
+	case authBasic:
+		users := make(map[string]string, len(ac.Users))
+		for _, u := range ac.Users {
+			name, secret, _ := strings.Cut(u, ":")
+			pass, err := auth.Secret(secret)
+			if err != nil {
+				return nil, err
+			}
+			users[name] = pass
+		}
+		return auth.Basic{Users: users}, nil
+	case authJWT:
+		jwks, err := auth.NewJWKS(ac.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		return auth.JWT{JWKS: jwks, Issuer: ac.Issuer, Audience: ac.Audience, Leeway: ac.Leeway}, nil
+	}
+
+	tokens, err := auth.Secrets(ac.Tokens)
+	if err != nil {
+		return nil, err
+	}
+	switch ac.Type {
+	case authQuery:
+		return auth.Query{Param: ac.Param, Tokens: tokens}, nil
+	case authPath:
+		return auth.PathToken{Prefix: path, Tokens: tokens}, nil
+	default:
+		return auth.Bearer{Tokens: tokens}, nil
+	}
+}
+
+// takeCredentials removes the route's credentials from r, so they are never
+// logged, published or forwarded, and returns a copy of r that still carries
+// them for checkAuth.
+func takeCredentials(r *http.Request, route *routeConfig) *http.Request {
+	if route.authenticator == nil {
+		return r
+	}
+	creds := r.Clone(r.Context())
+	route.authenticator.Strip(r)
+	return creds
+}
+
+// checkAuth authenticates creds, the copy of r from takeCredentials, if the
+// route requires it. If the request is rejected it writes the response and
+// returns false.
+func checkAuth(w http.ResponseWriter, r, creds *http.Request, route *routeConfig) bool {
+	if route.authenticator == nil {
+		return true
+	}
+	if err := route.authenticator.Authenticate(creds); err != nil {
+		log.Printf("Rejected unauthenticated request at %s: %v", r.URL.Path, err)
+		rejected.Add("auth", 1)
+		if challenge := route.authenticator.Challenge(); challenge != "" {
+			w.Header().Set("WWW-Authenticate", challenge)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/smarthall/webhook-relay/internal/blob"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rootCmd.PersistentFlags().String("blob-dir", "", "Directory, shared by receivers and transmitters, holding bodies too large to send through RabbitMQ (disabled when empty)")
+	viper.BindPFlag("blob-dir", rootCmd.PersistentFlags().Lookup("blob-dir"))
+}
+
+// openBlobStore returns the blob store configured by --blob-dir, or nil if
+// there is none.
+func openBlobStore() (*blob.FileStore, error) {
+	dir := viper.GetString("blob-dir")
+	if dir == "" {
+		return nil, nil
+	}
+	return blob.NewFileStore(dir)
+}
+
+// pruneBlobs removes blobs older than retention every interval until ctx is
+// done.
+func pruneBlobs(ctx context.Context, store *blob.FileStore, retention, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := store.Prune(time.Now().Add(-retention))
+			if err != nil {
+				log.Printf("Failed to prune blob store: %v", err)
+			} else if n > 0 {
+				log.Printf("Pruned %d blobs older than %s", n, retention)
+			}
+		}
+	}
+}
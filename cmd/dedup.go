@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/smarthall/webhook-relay/internal/messaging"
+)
+
+// dedupKey describes where a route finds the ID that identifies a delivery:
+// "header:<name>" for a request header such as X-GitHub-Delivery,
+// "body:<path>" for a JSON body field such as a Stripe event id, or "hash"
+// for a SHA-256 of the method, path and body.
+type dedupKey struct {
+	kind string
+	name string
+}
+
+func parseDedupKey(s string) (dedupKey, error) {
+	kind, name, _ := strings.Cut(s, ":")
+	switch {
+	case kind == "hash" && name == "":
+		return dedupKey{kind: kind}, nil
+	case (kind == "header" || kind == "body") && name != "":
+		return dedupKey{kind: kind, name: name}, nil
+	default:
+		return dedupKey{}, fmt.Errorf("invalid dedup key %q (want header:<name>, body:<path> or hash)", s)
+	}
+}
+
+// extract returns the delivery ID for msg, namespaced by route so providers
+// can't collide. It returns false when the ID is missing, in which case the
+// message is not deduplicated.
+func (k dedupKey) extract(route string, msg messaging.RequestMessage) (string, bool) {
+	var id string
+	switch k.kind {
+	case "header":
+		id = http.Header(msg.Headers).Get(k.name)
+	case "body":
+		id, _ = messaging.BodyField(msg.Body, k.name)
+	case "hash":
+		if msg.BodyRef != "" {
+			// The body isn't at hand, and hashing without it would make
+			// different deliveries collide.
+			return "", false
+		}
+		sum := sha256.Sum256([]byte(msg.Method + " " + msg.Path + "\n" + msg.Body))
+		id = hex.EncodeToString(sum[:])
+	}
+	if id == "" {
+		return "", false
+	}
+	return route + " " + id, true
+}
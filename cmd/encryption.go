@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/smarthall/webhook-relay/internal/envelope"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rootCmd.PersistentFlags().String("encryption-keys", "", "Key file for encrypting message bodies in RabbitMQ: the receiver encrypts with the first key, the transmitter decrypts with the key each message names (disabled when empty)")
+	viper.BindPFlag("encryption-keys", rootCmd.PersistentFlags().Lookup("encryption-keys"))
+
+	transmitterCmd.Flags().Bool("allow-plaintext", false, "Accept unencrypted messages although --encryption-keys is set, while receivers are moved to encryption")
+	viper.BindPFlag("allow-plaintext", transmitterCmd.Flags().Lookup("allow-plaintext"))
+
+	keygenCmd.Flags().String("type", envelope.TypeAES, "Key type: aes256, or x25519 for a private key for transmitters and a public key for receivers")
+	keygenCmd.Flags().String("id", "", "Key ID (defaults to today's date)")
+	rootCmd.AddCommand(keygenCmd)
+}
+
+// loadKeyring returns the keys configured by --encryption-keys, or nil if
+// there are none.
+func loadKeyring() (*envelope.Keyring, error) {
+	path := viper.GetString("encryption-keys")
+	if path == "" {
+		return nil, nil
+	}
+	return envelope.Load(path)
+}
+
+// checkPlaintextStorage returns an error if encryption is enabled together
+// with any of the given flags, which write message bodies to disk
+// unencrypted.
+func checkPlaintextStorage(keys *envelope.Keyring, flags ...string) error {
+	if keys == nil {
+		return nil
+	}
+	for _, flag := range flags {
+		if viper.GetString(flag) != "" {
+			return fmt.Errorf("--%s stores message bodies unencrypted and can't be used with --encryption-keys", flag)
+		}
+	}
+	return nil
+}
+
+var keygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generates a key for --encryption-keys",
+	Long: `Keygen prints a new key file line for --encryption-keys. For x25519 it prints
+the private key line, for the transmitters' key file, and the public key line,
+for the receivers' key file.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		typ, _ := cmd.Flags().GetString("type")
+		id, _ := cmd.Flags().GetString("id")
+		if id == "" {
+			id = time.Now().UTC().Format("20060102")
+		}
+		priv, pub, err := envelope.Generate(id, typ)
+		if err != nil {
+			log.Fatalf("Failed to generate key: %s", err)
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), priv)
+		if pub != "" {
+			fmt.Fprintln(cmd.OutOrStdout(), pub)
+		}
+	},
+}
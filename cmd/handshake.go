@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/smarthall/webhook-relay/internal/auth"
+	"github.com/smarthall/webhook-relay/internal/handshake"
+	"github.com/smarthall/webhook-relay/internal/messaging"
+)
+
+// handshakes counts verification requests answered by the receiver, keyed by
+// provider.
+var handshakes = expvar.NewMap("receiver_handshakes_total")
+
+// handshakeConfig is a route's "handshake" setting. Secrets may be given
+// literally, as "env:NAME" or as "file:PATH".
+type handshakeConfig struct {
+	// Provider is slack, meta, msgraph, zoom, twitch or websub.
+	Provider    string   `mapstructure:"provider"`
+	Secret      string   `mapstructure:"secret"`
+	VerifyToken string   `mapstructure:"verify-token"`
+	Topics      []string `mapstructure:"topics"`
+}
+
+func (hc *handshakeConfig) validate() error {
+	switch {
+	case hc.Provider == "meta" && hc.VerifyToken == "":
+		return fmt.Errorf("handshake provider meta requires verify-token")
+	case hc.Provider == "zoom" && hc.Secret == "":
+		return fmt.Errorf("handshake provider zoom requires secret")
+	}
+	for _, p := range handshake.Providers {
+		if p == hc.Provider {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported handshake provider %q (want %s)", hc.Provider, strings.Join(handshake.Providers, ", "))
+}
+
+// responder builds the handshake responder, resolving secrets.
+func (hc *handshakeConfig) responder() (handshake.Responder, error) {
+	cfg := handshake.Config{Topics: hc.Topics}
+	var err error
+	if hc.Secret != "" {
+		if cfg.Secret, err = auth.Secret(hc.Secret); err != nil {
+			return nil, err
+		}
+	}
+	if hc.VerifyToken != "" {
+		if cfg.VerifyToken, err = auth.Secret(hc.VerifyToken); err != nil {
+			return nil, err
+		}
+	}
+	return handshake.New(hc.Provider, cfg)
+}
+
+// answerHandshake responds to the request if it is a verification request
+// for the route's provider, returning true if it did.
+func answerHandshake(w http.ResponseWriter, r *http.Request, route *routeConfig, msg messaging.RequestMessage) bool {
+	if route.responder == nil || msg.BodyRef != "" {
+		return false
+	}
+	if !route.responder.Respond(w, r, []byte(msg.Body)) {
+		return false
+	}
+	log.Printf("Answered %s handshake at %s", route.Handshake.Provider, r.URL.Path)
+	handshakes.Add(route.Handshake.Provider, 1)
+	return true
+}
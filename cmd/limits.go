@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"expvar"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/smarthall/webhook-relay/internal/ratelimit"
+	"github.com/spf13/viper"
+)
+
+// rejected counts requests the receiver turned away before publishing, keyed
+// by reason.
+var rejected = expvar.NewMap("receiver_rejected_total")
+
+func init() {
+	receiverCmd.Flags().StringSlice("trusted-proxies", nil, "CIDR ranges of proxies whose X-Forwarded-For header is trusted (repeatable)")
+	viper.BindPFlag("trusted-proxies", receiverCmd.Flags().Lookup("trusted-proxies"))
+
+	receiverCmd.Flags().Float64("ip-rate-limit", 0, "Maximum requests per second from each client IP (0 disables)")
+	viper.BindPFlag("ip-rate-limit", receiverCmd.Flags().Lookup("ip-rate-limit"))
+
+	receiverCmd.Flags().Int("ip-rate-burst", 20, "Requests a client IP may send at once before --ip-rate-limit applies")
+	viper.BindPFlag("ip-rate-burst", receiverCmd.Flags().Lookup("ip-rate-burst"))
+
+	receiverCmd.Flags().Int("max-concurrent-requests", 0, "Maximum requests handled at once; further requests get 503 (0 disables)")
+	viper.BindPFlag("max-concurrent-requests", receiverCmd.Flags().Lookup("max-concurrent-requests"))
+}
+
+// inboundLimits protects the receiver, and the broker behind it, from senders
+// that send too much. The zero value admits everything.
+type inboundLimits struct {
+	// perIP limits each client address. Nil disables it.
+	perIP *ratelimit.Buckets
+	// perRoute limits routes with a receive-rate-limit, keyed by route path.
+	perRoute map[string]*ratelimit.Bucket
+	// slots caps the number of requests handled at once. Nil disables it.
+	slots chan struct{}
+}
+
+// loadInboundLimits builds the inbound limits from flags and the routes.
+func loadInboundLimits(routes routeTable) inboundLimits {
+	var l inboundLimits
+	if rate := viper.GetFloat64("ip-rate-limit"); rate > 0 {
+		l.perIP = ratelimit.NewBuckets(rate, viper.GetInt("ip-rate-burst"))
+	}
+	for _, route := range routes {
+		if route.ReceiveRateLimit > 0 {
+			if l.perRoute == nil {
+				l.perRoute = make(map[string]*ratelimit.Bucket)
+			}
+			l.perRoute[route.Path] = ratelimit.NewBucket(route.ReceiveRateLimit, route.ReceiveRateBurst)
+		}
+	}
+	if n := viper.GetInt("max-concurrent-requests"); n > 0 {
+		l.slots = make(chan struct{}, n)
+	}
+	return l
+}
+
+// admit applies the limits to a request for route from the client at ip. If
+// the request is rejected it writes the response and returns false; otherwise
+// release must be called once the request has been handled.
+func (l inboundLimits) admit(w http.ResponseWriter, r *http.Request, route *routeConfig, ip string) (release func(), ok bool) {
+	if l.perIP != nil {
+		if wait, ok := l.perIP.Take(ip); !ok {
+			log.Printf("Rate limited client %s at %s", ip, r.URL.Path)
+			rejectRequest(w, "ip_rate_limit", http.StatusTooManyRequests, wait)
+			return nil, false
+		}
+	}
+	if bucket := l.perRoute[route.Path]; bucket != nil {
+		if wait, ok := bucket.Take(); !ok {
+			log.Printf("Rate limited route %s", route.Path)
+			rejectRequest(w, "route_rate_limit", http.StatusTooManyRequests, wait)
+			return nil, false
+		}
+	}
+	if l.slots == nil {
+		return func() {}, true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, true
+	default:
+		rejectRequest(w, "concurrency", http.StatusServiceUnavailable, time.Second)
+		return nil, false
+	}
+}
+
+// rejectRequest answers with status and a Retry-After of at least a second,
+// and counts the rejection under reason.
+func rejectRequest(w http.ResponseWriter, reason string, status int, retryAfter time.Duration) {
+	rejected.Add(reason, 1)
+	secs := int(math.Ceil(retryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	w.WriteHeader(status)
+}
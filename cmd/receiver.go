@@ -2,21 +2,74 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"fmt"
 	"log"
 	"net/http"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/smarthall/webhook-relay/internal/blob"
+	"github.com/smarthall/webhook-relay/internal/clientip"
+	"github.com/smarthall/webhook-relay/internal/dedup"
+	"github.com/smarthall/webhook-relay/internal/ipallow"
 	"github.com/smarthall/webhook-relay/internal/messaging"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
+// duplicates counts webhooks suppressed as redeliveries.
+var duplicates = expvar.NewInt("receiver_duplicates_total")
+
 func init() {
 	receiverCmd.Flags().String("listen", ":8080", "Address to listen on")
 	viper.BindPFlag("listen", receiverCmd.Flags().Lookup("listen"))
 
+	receiverCmd.Flags().Int("publish-channels", 8, "Number of AMQP channels used to publish concurrently")
+	viper.BindPFlag("publish-channels", receiverCmd.Flags().Lookup("publish-channels"))
+
+	receiverCmd.Flags().String("spool-dir", "", "Spool webhooks to this directory while RabbitMQ blocks publishing, instead of returning 503")
+	viper.BindPFlag("spool-dir", receiverCmd.Flags().Lookup("spool-dir"))
+
+	receiverCmd.Flags().String("archive-dir", "", "Directory unroutable webhooks are archived to on routes with unroutable: archive")
+	viper.BindPFlag("archive-dir", receiverCmd.Flags().Lookup("archive-dir"))
+
+	receiverCmd.Flags().Duration("dedup-ttl", 24*time.Hour, "How long delivery IDs are remembered for duplicate suppression")
+	viper.BindPFlag("dedup-ttl", receiverCmd.Flags().Lookup("dedup-ttl"))
+
+	receiverCmd.Flags().Int("dedup-size", 100000, "Maximum number of delivery IDs remembered for duplicate suppression")
+	viper.BindPFlag("dedup-size", receiverCmd.Flags().Lookup("dedup-size"))
+
+	receiverCmd.Flags().String("dedup-file", "", "Journal file that persists seen delivery IDs across restarts (in-memory only when empty)")
+	viper.BindPFlag("dedup-file", receiverCmd.Flags().Lookup("dedup-file"))
+
+	receiverCmd.Flags().Int64("max-body-size", 10<<20, "Maximum request body size in bytes; larger requests get 413 (0 disables)")
+	viper.BindPFlag("max-body-size", receiverCmd.Flags().Lookup("max-body-size"))
+
+	receiverCmd.Flags().Duration("read-header-timeout", 5*time.Second, "How long a client may take to send the request headers")
+	viper.BindPFlag("read-header-timeout", receiverCmd.Flags().Lookup("read-header-timeout"))
+
+	receiverCmd.Flags().Duration("read-timeout", time.Minute, "How long a client may take to send the whole request, body included; raise it with --max-body-size for slow senders (0 disables)")
+	viper.BindPFlag("read-timeout", receiverCmd.Flags().Lookup("read-timeout"))
+
+	receiverCmd.Flags().Duration("write-timeout", time.Minute, "How long a request may take from the end of its headers until the response is written (0 disables)")
+	viper.BindPFlag("write-timeout", receiverCmd.Flags().Lookup("write-timeout"))
+
+	receiverCmd.Flags().Int64("offload-threshold", 1<<20, "Bodies larger than this many bytes are stored in --blob-dir and referenced from the message")
+	viper.BindPFlag("offload-threshold", receiverCmd.Flags().Lookup("offload-threshold"))
+
+	receiverCmd.Flags().Duration("blob-retention", 7*24*time.Hour, "How long offloaded bodies are kept in --blob-dir")
+	viper.BindPFlag("blob-retention", receiverCmd.Flags().Lookup("blob-retention"))
+
+	receiverCmd.Flags().StringSlice("route-header", nil, "Request header to copy into AMQP message headers for headers-exchange routing (repeatable)")
+	viper.BindPFlag("route-header", receiverCmd.Flags().Lookup("route-header"))
+
+	receiverCmd.Flags().StringSlice("route-body-field", nil, "Dot-separated JSON body field to copy into AMQP message headers (repeatable)")
+	viper.BindPFlag("route-body-field", receiverCmd.Flags().Lookup("route-body-field"))
+
 	rootCmd.AddCommand(receiverCmd)
 }
 
@@ -25,43 +78,89 @@ var receiverCmd = &cobra.Command{
 	Short: "Receives webhooks and forwards them to RabbitMQ",
 	Long:  `Receiver listens for incoming webhooks and forwards them to a RabbitMQ exchange.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		pub := messaging.NewPublisher(viper.GetString("amqp"))
+		exchange, err := exchangeConfig()
+		if err != nil {
+			log.Fatalf("Invalid exchange configuration: %s", err)
+		}
+		keys, err := loadKeyring()
+		if err != nil {
+			log.Fatalf("Failed to load encryption keys: %s", err)
+		}
+		if err := checkPlaintextStorage(keys, "blob-dir", "spool-dir", "archive-dir"); err != nil {
+			log.Fatalf("Invalid encryption configuration: %s", err)
+		}
+		opts, err := loadReceiverOptions()
+		if err != nil {
+			log.Fatalf("Invalid receiver configuration: %s", err)
+		}
+		tlsConfig, err := receiverTLSConfig(opts.routes)
+		if err != nil {
+			log.Fatalf("Invalid TLS configuration: %s", err)
+		}
+		connCfg := connectionConfig(cmd.Name())
+		if err := connCfg.Validate(); err != nil {
+			log.Fatalf("Invalid AMQP configuration: %s", err)
+		}
+		pub := messaging.NewPublisher(connCfg, messaging.PublisherConfig{
+			Exchange: exchange,
+			Routing: messaging.HeaderRouting{
+				Headers:    viper.GetStringSlice("route-header"),
+				BodyFields: viper.GetStringSlice("route-body-field"),
+			},
+			Channels:   viper.GetInt("publish-channels"),
+			Encryption: keys,
+		})
 
 		// Create and start a health checker. If the health checker signals
-		// failure the process will gracefully shut down.
-		hc := messaging.NewHealthChecker(viper.GetString("amqp"), 1*time.Second, 2*time.Second)
+		// failure the process will gracefully shut down and exit non-zero.
+		hc := messaging.NewHealthChecker(connCfg, 1*time.Second, 2*time.Second)
 		defer hc.Stop()
 
+		stopAdmin := startAdminServer()
+		defer stopAdmin()
+
 		// Create a context that is cancelled on SIGINT or SIGTERM
 		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 		defer stop()
 
-		s := &http.Server{
-			Addr:           viper.GetString("listen"),
-			Handler:        requestHandler(pub),
-			ReadTimeout:    2 * time.Second,
-			WriteTimeout:   2 * time.Second,
-			MaxHeaderBytes: 1 << 20,
+		if opts.offload != nil {
+			if store, ok := opts.offload.Store.(*blob.FileStore); ok {
+				go pruneBlobs(ctx, store, viper.GetDuration("blob-retention"), time.Hour)
+			}
 		}
 
+		go refreshAllowlists(ctx, opts.routes, viper.GetDuration("allowlist-refresh"))
+
+		var handlerPub publisher = pub
+		if dir := viper.GetString("spool-dir"); dir != "" {
+			spool, err := messaging.NewSpool(dir)
+			if err != nil {
+				log.Fatalf("Failed to open spool: %s", err)
+			}
+			sp := messaging.NewSpoolingPublisher(pub, spool)
+			go sp.Run(ctx, time.Second)
+			handlerPub = sp
+		}
+
+		s := newReceiverServer(requestHandler(handlerPub, opts), tlsConfig)
+
 		// Start server in a goroutine so we can listen for shutdown signals.
 		go func() {
-			log.Printf("starting server on %s", s.Addr)
-			if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			var err error
+			if s.TLSConfig != nil {
+				log.Printf("starting TLS server on %s", s.Addr)
+				err = s.ListenAndServeTLS("", "")
+			} else {
+				log.Printf("starting server on %s", s.Addr)
+				err = s.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
 				log.Fatalf("server error: %v", err)
 			}
 		}()
 
-		// Monitor healthcheck failures and trigger shutdown when they occur.
-		go func() {
-			select {
-			case <-ctx.Done():
-				return
-			case <-hc.Failure:
-				log.Printf("healthcheck failure detected, initiating shutdown")
-				stop()
-			}
-		}()
+		// Shut down, and exit non-zero, when the healthcheck fails.
+		stopOnFailure(ctx, hc, stop)
 
 		// Wait for signal
 		<-ctx.Done()
@@ -78,26 +177,295 @@ var receiverCmd = &cobra.Command{
 	},
 }
 
+// publisher is implemented by messaging.Publisher and
+// messaging.SpoolingPublisher.
+type publisher interface {
+	Publish(messaging.RequestMessage, messaging.PublishOptions) error
+}
+
+// receiverOptions holds the receiver's per-route configuration and the
+// resources routes refer to.
+type receiverOptions struct {
+	routes  routeTable
+	archive *messaging.Spool
+	seen    *dedup.Cache
+	// nonces holds the nonces of signed requests, to reject replays.
+	nonces *dedup.Cache
+	// clientIP resolves the sender's address, honouring trusted proxies.
+	clientIP *clientip.Resolver
+	limits   inboundLimits
+	// maxBodySize applies to routes without their own limit. Zero disables
+	// it.
+	maxBodySize int64
+	// offload moves large bodies to a blob store. Nil keeps all bodies
+	// inline.
+	offload *messaging.BodyOffload
+}
+
+// bodyLimit returns the maximum body size for route, or zero for no limit.
+func (o receiverOptions) bodyLimit(route *routeConfig) int64 {
+	if route.MaxBodySize > 0 {
+		return route.MaxBodySize
+	}
+	return o.maxBodySize
+}
+
+// newReceiverServer builds the receiver's HTTP server from flags and config.
+// The header timeout stops slow clients holding connections open, while the
+// read timeout has to allow for the largest body.
+func newReceiverServer(handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:              viper.GetString("listen"),
+		Handler:           handler,
+		ReadHeaderTimeout: viper.GetDuration("read-header-timeout"),
+		ReadTimeout:       viper.GetDuration("read-timeout"),
+		WriteTimeout:      viper.GetDuration("write-timeout"),
+		MaxHeaderBytes:    1 << 20,
+		TLSConfig:         tlsConfig,
+	}
+}
+
+// loadReceiverOptions builds the receiver options from flags and config.
+func loadReceiverOptions() (receiverOptions, error) {
+	var opts receiverOptions
+	var err error
+
+	for _, name := range []string{"read-header-timeout", "read-timeout", "write-timeout"} {
+		if viper.GetDuration(name) < 0 {
+			return opts, fmt.Errorf("--%s must not be negative", name)
+		}
+	}
+
+	if opts.routes, err = loadRoutes(); err != nil {
+		return opts, err
+	}
+
+	if dir := viper.GetString("archive-dir"); dir != "" {
+		if opts.archive, err = messaging.NewSpool(dir); err != nil {
+			return opts, fmt.Errorf("failed to open archive: %w", err)
+		}
+	}
+	for i, route := range opts.routes {
+		if route.Unroutable == unroutableArchive && opts.archive == nil {
+			return opts, fmt.Errorf("route %s archives unroutable webhooks but --archive-dir is not set", route.Path)
+		}
+		if route.Auth != nil {
+			if opts.routes[i].authenticator, err = route.Auth.authenticator(route.Path); err != nil {
+				return opts, fmt.Errorf("route %s: %w", route.Path, err)
+			}
+		}
+		if route.Handshake != nil {
+			if opts.routes[i].responder, err = route.Handshake.responder(); err != nil {
+				return opts, fmt.Errorf("route %s: %w", route.Path, err)
+			}
+		}
+		if route.Signature != nil {
+			if opts.routes[i].verifier, err = route.Signature.verifier(); err != nil {
+				return opts, fmt.Errorf("route %s: %w", route.Path, err)
+			}
+		}
+		if len(route.AllowFrom) > 0 || route.AllowFromFile != "" {
+			if opts.routes[i].allow, err = ipallow.New(route.AllowFrom, route.AllowFromFile); err != nil {
+				return opts, fmt.Errorf("route %s: failed to load allowlist: %w", route.Path, err)
+			}
+		}
+	}
+
+	if opts.seen, err = openSeenSet(); err != nil {
+		return opts, fmt.Errorf("failed to open dedup journal: %w", err)
+	}
+	opts.nonces = openNonceCache(opts.routes)
+
+	if opts.clientIP, err = clientip.NewResolver(viper.GetStringSlice("trusted-proxies")); err != nil {
+		return opts, err
+	}
+	opts.limits = loadInboundLimits(opts.routes)
+
+	opts.maxBodySize = viper.GetInt64("max-body-size")
+	store, err := openBlobStore()
+	if err != nil {
+		return opts, fmt.Errorf("failed to open blob store: %w", err)
+	}
+	if store != nil {
+		opts.offload = &messaging.BodyOffload{Store: store, Threshold: viper.GetInt64("offload-threshold")}
+	}
+
+	return opts, nil
+}
+
+// openSeenSet returns the delivery ID cache configured by the dedup flags.
+func openSeenSet() (*dedup.Cache, error) {
+	size, ttl := viper.GetInt("dedup-size"), viper.GetDuration("dedup-ttl")
+	if path := viper.GetString("dedup-file"); path != "" {
+		return dedup.Open(path, size, ttl)
+	}
+	return dedup.New(size, ttl), nil
+}
+
+// discardBody deletes the offloaded body of a webhook that was not published.
+func discardBody(offload *messaging.BodyOffload, msg messaging.RequestMessage) {
+	if err := offload.Store.Delete(context.Background(), msg.BodyRef); err != nil {
+		log.Printf("Failed to delete offloaded body %s: %v", msg.BodyRef, err)
+	}
+}
+
+// rejectTooLarge answers a request whose body is over the route's limit.
+func rejectTooLarge(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Rejected oversized request at %s", r.URL.Path)
+	rejected.Add("body_too_large", 1)
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+}
+
 // requestHandler returns an http.HandlerFunc that publishes incoming requests
-// using the provided publisher. The publisher is expected to implement
-// Publish(messaging.RequestMessage) error.
-func requestHandler(pub interface {
-	Publish(messaging.RequestMessage) error
-}) http.HandlerFunc {
+// using the provided publisher.
+func requestHandler(pub publisher, opts receiverOptions) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		route := opts.routes.match(r.URL.Path)
+		creds := takeCredentials(r, route)
 		log.Printf("Received request at: %s", r.URL.Path)
+		ip := opts.clientIP.ClientIP(r)
+
+		if !checkAllowlist(w, r, route, ip) {
+			return
+		}
+
+		release, ok := opts.limits.admit(w, r, route, ip)
+		if !ok {
+			return
+		}
+		defer release()
+
+		if !checkClientCert(w, r, route) || !checkAuth(w, r, creds, route) {
+			return
+		}
+
+		if limit := opts.bodyLimit(route); limit > 0 {
+			if r.ContentLength > limit {
+				rejectTooLarge(w, r)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
 
 		var msg messaging.RequestMessage
-		if err := msg.FromHTTPRequest(r); err != nil {
+		if err := msg.ReadHTTPRequest(r, opts.offload); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				rejectTooLarge(w, r)
+				return
+			}
+			log.Printf("Failed to read request: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		if err := pub.Publish(msg); err != nil {
+		// accepted is set once the webhook is published or archived. An
+		// offloaded body is only kept if it is; rejected and suppressed ones
+		// would never be cleaned up.
+		accepted := false
+		if msg.BodyRef != "" {
+			defer func() {
+				if !accepted {
+					discardBody(opts.offload, msg)
+				}
+			}()
+		}
+
+		// Providers sign POST verification requests like their events, so on
+		// signed routes those are only answered once the signature checks
+		// out. GET verifications (Meta, WebSub) carry no signature.
+		verifyFirst := route.verifier != nil && r.Method != http.MethodGet
+		if !verifyFirst && answerHandshake(w, r, route, msg) {
+			return
+		}
+
+		nonce, ok := checkSignature(w, r, route, msg, opts)
+		if !ok {
+			return
+		}
+
+		if verifyFirst && answerHandshake(w, r, route, msg) {
+			return
+		}
+
+		if route.dedup != nil && opts.seen != nil {
+			if id, ok := route.dedup.extract(route.Path, msg); ok {
+				// Claiming the ID before publishing means only one of
+				// several concurrent deliveries is published. The claim
+				// is released if the webhook isn't accepted, so the
+				// sender's retry goes through.
+				added, err := opts.seen.AddIfAbsent(id)
+				if err != nil {
+					log.Printf("Failed to record delivery ID: %v", err)
+				}
+				if !added {
+					log.Printf("Suppressed duplicate delivery at %s", r.URL.Path)
+					duplicates.Add(1)
+					if route.Response != nil {
+						// Providers expecting a particular answer
+						// expect it for retries too.
+						writeAccepted(w, route, msg)
+					} else {
+						w.WriteHeader(http.StatusOK)
+					}
+					return
+				}
+				defer func() {
+					if accepted {
+						return
+					}
+					if err := opts.seen.Remove(id); err != nil {
+						log.Printf("Failed to release delivery ID: %v", err)
+					}
+				}()
+			}
+		}
+
+		if !claimNonce(w, r, opts, nonce) {
+			return
+		}
+		defer func() {
+			if !accepted {
+				releaseNonce(opts, nonce)
+			}
+		}()
+
+		if err := pub.Publish(msg, route.publishOptions()); err != nil {
+			log.Printf("Failed to publish message: %v", err)
+			switch {
+			case errors.Is(err, messaging.ErrUnroutable) && route.Unroutable == unroutableReject:
+				w.WriteHeader(route.UnroutableStatus)
+				return
+			case errors.Is(err, messaging.ErrUnroutable) && route.Unroutable == unroutableArchive:
+				if err := opts.archive.Write(msg); err != nil {
+					log.Printf("Failed to archive unroutable message: %v", err)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				log.Printf("Archived unroutable message for %s", msg.Path)
+				accepted = true
+				writeAccepted(w, route, msg)
+				return
+			case errors.Is(err, messaging.ErrBlocked):
+				// Alarms usually take a while to clear, so ask for a
+				// longer back-off than when merely busy.
+				w.Header().Set("Retry-After", "30")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			case errors.Is(err, messaging.ErrDisconnected):
+				w.Header().Set("Retry-After", "5")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			case errors.Is(err, messaging.ErrPublisherBusy):
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		accepted = true
 
-		w.WriteHeader(http.StatusNoContent)
+		writeAccepted(w, route, msg)
 	}
 }
@@ -2,23 +2,43 @@ package cmd
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/smarthall/webhook-relay/internal/blob"
+	"github.com/smarthall/webhook-relay/internal/clientip"
+	"github.com/smarthall/webhook-relay/internal/dedup"
+	"github.com/smarthall/webhook-relay/internal/envelope"
 	"github.com/smarthall/webhook-relay/internal/messaging"
+	"github.com/smarthall/webhook-relay/internal/ratelimit"
 )
 
 // mockPub implements the small publisher interface expected by requestHandler.
 type mockPub struct {
-	called      bool
-	receivedMsg messaging.RequestMessage
-	errToReturn error
+	called       bool
+	receivedMsg  messaging.RequestMessage
+	receivedOpts messaging.PublishOptions
+	errToReturn  error
 }
 
-func (m *mockPub) Publish(msg messaging.RequestMessage) error {
+func (m *mockPub) Publish(msg messaging.RequestMessage, opts messaging.PublishOptions) error {
 	m.called = true
 	m.receivedMsg = msg
+	m.receivedOpts = opts
 	return m.errToReturn
 }
 
@@ -38,7 +58,7 @@ func TestRequestHandlerSuccess(t *testing.T) {
 	pub := &mockPub{}
 	rr := httptest.NewRecorder()
 
-	handler := requestHandler(pub)
+	handler := requestHandler(pub, receiverOptions{})
 	handler.ServeHTTP(rr, req)
 
 	if rr.Code != 204 {
@@ -47,6 +67,9 @@ func TestRequestHandlerSuccess(t *testing.T) {
 	if !pub.called {
 		t.Fatalf("expected publisher to be called")
 	}
+	if pub.receivedMsg.ID == "" {
+		t.Fatalf("expected message to be assigned an ID")
+	}
 	if pub.receivedMsg.Method != "POST" {
 		t.Fatalf("expected method POST, got %s", pub.receivedMsg.Method)
 	}
@@ -70,7 +93,7 @@ func TestRequestHandlerFromHTTPRequestError(t *testing.T) {
 	pub := &mockPub{}
 	rr := httptest.NewRecorder()
 
-	handler := requestHandler(pub)
+	handler := requestHandler(pub, receiverOptions{})
 	handler.ServeHTTP(rr, req)
 
 	if rr.Code != 500 {
@@ -91,7 +114,7 @@ func TestRequestHandlerPublishError(t *testing.T) {
 	pub := &mockPub{errToReturn: errors.New("publish failed")}
 	rr := httptest.NewRecorder()
 
-	handler := requestHandler(pub)
+	handler := requestHandler(pub, receiverOptions{})
 	handler.ServeHTTP(rr, req)
 
 	if rr.Code != 500 {
@@ -101,3 +124,899 @@ func TestRequestHandlerPublishError(t *testing.T) {
 		t.Fatalf("expected publisher to be called")
 	}
 }
+
+// TestRequestHandlerPublisherBusy verifies that a saturated publisher results
+// in HTTP 503 with a Retry-After header so senders back off and retry.
+func TestRequestHandlerPublisherBusy(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://example.com/busy", bytes.NewBufferString("payload"))
+
+	pub := &mockPub{errToReturn: messaging.ErrPublisherBusy}
+	rr := httptest.NewRecorder()
+
+	handler := requestHandler(pub, receiverOptions{})
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != 503 {
+		t.Fatalf("expected status 503, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected Retry-After header")
+	}
+}
+
+// TestRequestHandlerBrokerBlocked verifies that the handler returns 503 with
+// a Retry-After header while the broker blocks publishing.
+func TestRequestHandlerBrokerBlocked(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://example.com/blocked", bytes.NewBufferString("payload"))
+
+	pub := &mockPub{errToReturn: fmt.Errorf("%w: low on memory", messaging.ErrBlocked)}
+	rr := httptest.NewRecorder()
+
+	handler := requestHandler(pub, receiverOptions{})
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != 503 {
+		t.Fatalf("expected status 503, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "30" {
+		t.Fatalf("expected Retry-After 30, got %q", got)
+	}
+}
+
+// TestRequestHandlerReconnecting verifies that the handler returns 503 with a
+// short Retry-After while the RabbitMQ connections are being replaced.
+func TestRequestHandlerReconnecting(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://example.com/reconnecting", bytes.NewBufferString("payload"))
+
+	pub := &mockPub{errToReturn: messaging.ErrDisconnected}
+	rr := httptest.NewRecorder()
+
+	handler := requestHandler(pub, receiverOptions{})
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != 503 {
+		t.Fatalf("expected status 503, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "5" {
+		t.Fatalf("expected Retry-After 5, got %q", got)
+	}
+}
+
+// TestRequestHandlerUnroutable verifies the per-route handling of webhooks the
+// broker returned as unroutable.
+func TestRequestHandlerUnroutable(t *testing.T) {
+	archive, err := messaging.NewSpool(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewSpool: %v", err)
+	}
+	opts := receiverOptions{
+		routes: routeTable{
+			{Path: "/reject", Unroutable: unroutableReject, UnroutableStatus: 422},
+			{Path: "/archive", Unroutable: unroutableArchive},
+			{Path: "/alternate", Unroutable: unroutableAlternate, AlternateExchange: "unrouted"},
+		},
+		archive: archive,
+	}
+
+	tests := []struct {
+		path      string
+		pubErr    error
+		wantCode  int
+		wantOpts  messaging.PublishOptions
+		wantSpool int
+	}{
+		{path: "/reject/x", pubErr: messaging.ErrUnroutable, wantCode: 422, wantOpts: messaging.PublishOptions{Mandatory: true}},
+		{path: "/archive/x", pubErr: messaging.ErrUnroutable, wantCode: 204, wantOpts: messaging.PublishOptions{Mandatory: true}, wantSpool: 1},
+		{path: "/alternate", wantCode: 204, wantOpts: messaging.PublishOptions{Mandatory: true, AlternateExchange: "unrouted"}},
+		{path: "/other", wantCode: 204, wantOpts: messaging.PublishOptions{}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://example.com"+tc.path, bytes.NewBufferString("payload"))
+			pub := &mockPub{errToReturn: tc.pubErr}
+			rr := httptest.NewRecorder()
+
+			requestHandler(pub, opts).ServeHTTP(rr, req)
+
+			if rr.Code != tc.wantCode {
+				t.Fatalf("expected status %d, got %d", tc.wantCode, rr.Code)
+			}
+			if pub.receivedOpts != tc.wantOpts {
+				t.Fatalf("expected publish options %+v, got %+v", tc.wantOpts, pub.receivedOpts)
+			}
+		})
+	}
+
+	n, err := archive.Drain(func(messaging.RequestMessage) error { return nil })
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 archived message, got n=%d err=%v", n, err)
+	}
+}
+
+// TestRequestHandlerDedup verifies that a redelivered webhook is answered
+// with 200 and not published again, and that a failed publish is not
+// remembered so the sender's retry goes through.
+func TestRequestHandlerDedup(t *testing.T) {
+	route := routeConfig{Path: "/github", Dedup: "header:X-GitHub-Delivery"}
+	if err := route.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	opts := receiverOptions{routes: routeTable{route}, seen: dedup.New(10, time.Hour)}
+
+	send := func(pub *mockPub, delivery string) int {
+		req := httptest.NewRequest("POST", "http://example.com/github", bytes.NewBufferString("{}"))
+		req.Header.Set("X-GitHub-Delivery", delivery)
+		rr := httptest.NewRecorder()
+		requestHandler(pub, opts).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := send(&mockPub{errToReturn: errors.New("down")}, "abc"); code != 500 {
+		t.Fatalf("expected failed publish to return 500, got %d", code)
+	}
+
+	pub := &mockPub{}
+	if code := send(pub, "abc"); code != 204 || !pub.called {
+		t.Fatalf("expected retry to be published with 204, got %d", code)
+	}
+
+	pub = &mockPub{}
+	if code := send(pub, "abc"); code != 200 || pub.called {
+		t.Fatalf("expected duplicate to return 200 without publishing, got %d called=%v", code, pub.called)
+	}
+
+	pub = &mockPub{}
+	if code := send(pub, "def"); code != 204 || !pub.called {
+		t.Fatalf("expected new delivery to be published, got %d", code)
+	}
+}
+
+// blockingPub blocks in Publish until release is closed.
+type blockingPub struct {
+	publishing chan struct{}
+	release    chan struct{}
+}
+
+func (b *blockingPub) Publish(messaging.RequestMessage, messaging.PublishOptions) error {
+	close(b.publishing)
+	<-b.release
+	return nil
+}
+
+// TestRequestHandlerDedupConcurrent verifies that a duplicate arriving while
+// the first delivery is still being published is suppressed.
+func TestRequestHandlerDedupConcurrent(t *testing.T) {
+	route := routeConfig{Path: "/github", Dedup: "header:X-GitHub-Delivery"}
+	if err := route.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	opts := receiverOptions{routes: routeTable{route}, seen: dedup.New(10, time.Hour)}
+	newReq := func() *http.Request {
+		req := httptest.NewRequest("POST", "http://example.com/github", bytes.NewBufferString("{}"))
+		req.Header.Set("X-GitHub-Delivery", "abc")
+		return req
+	}
+
+	first := &blockingPub{publishing: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan int)
+	go func() {
+		rr := httptest.NewRecorder()
+		requestHandler(first, opts).ServeHTTP(rr, newReq())
+		done <- rr.Code
+	}()
+	<-first.publishing
+
+	pub := &mockPub{}
+	rr := httptest.NewRecorder()
+	requestHandler(pub, opts).ServeHTTP(rr, newReq())
+	if rr.Code != 200 || pub.called {
+		t.Fatalf("expected concurrent duplicate to be suppressed, got %d called=%v", rr.Code, pub.called)
+	}
+
+	close(first.release)
+	if code := <-done; code != 204 {
+		t.Fatalf("expected first delivery to be published, got %d", code)
+	}
+}
+
+// TestRequestHandlerInboundLimits verifies that per-IP and per-route rate
+// limits and the concurrency cap reject requests with a Retry-After header.
+func TestRequestHandlerInboundLimits(t *testing.T) {
+	resolver, err := clientip.NewResolver([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	opts := receiverOptions{
+		routes:   routeTable{{Path: "/busy"}},
+		clientIP: resolver,
+		limits: inboundLimits{
+			perIP:    ratelimit.NewBuckets(0.001, 1),
+			perRoute: map[string]*ratelimit.Bucket{"/busy": ratelimit.NewBucket(0.001, 1)},
+		},
+	}
+
+	send := func(path, remote, xff string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://example.com"+path, bytes.NewBufferString("payload"))
+		req.RemoteAddr = remote
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		rr := httptest.NewRecorder()
+		requestHandler(&mockPub{}, opts).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Clients behind the trusted proxy are limited by their own address.
+	if rr := send("/a", "10.0.0.1:1000", "198.51.100.1"); rr.Code != 204 {
+		t.Fatalf("expected first request to pass, got %d", rr.Code)
+	}
+	rr := send("/a", "10.0.0.1:1000", "198.51.100.1")
+	if rr.Code != 429 || rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 429 with Retry-After, got %d %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	if rr := send("/a", "10.0.0.1:1000", "198.51.100.2"); rr.Code != 204 {
+		t.Fatalf("expected another client to pass, got %d", rr.Code)
+	}
+
+	// The route limit applies across clients.
+	if rr := send("/busy", "203.0.113.1:1000", ""); rr.Code != 204 {
+		t.Fatalf("expected first route request to pass, got %d", rr.Code)
+	}
+	if rr := send("/busy", "203.0.113.2:1000", ""); rr.Code != 429 {
+		t.Fatalf("expected route limit to reject, got %d", rr.Code)
+	}
+
+	// With no free slot the request is turned away.
+	opts.limits = inboundLimits{slots: make(chan struct{}, 1)}
+	opts.limits.slots <- struct{}{}
+	if rr := send("/a", "203.0.113.3:1000", ""); rr.Code != 503 || rr.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected 503 with Retry-After 1, got %d", rr.Code)
+	}
+}
+
+// TestRequestHandlerBodyLimits verifies that bodies over the route's limit
+// are rejected with 413, whether or not a Content-Length was sent, and that
+// large bodies are offloaded to the blob store.
+func TestRequestHandlerBodyLimits(t *testing.T) {
+	store, err := blob.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	opts := receiverOptions{
+		routes:      routeTable{{Path: "/small", MaxBodySize: 4}},
+		maxBodySize: 64,
+		offload:     &messaging.BodyOffload{Store: store, Threshold: 8},
+	}
+
+	send := func(path, body string, chunked bool) (*mockPub, int) {
+		req := httptest.NewRequest("POST", "http://example.com"+path, bytes.NewBufferString(body))
+		if chunked {
+			req.ContentLength = -1
+		}
+		pub := &mockPub{}
+		rr := httptest.NewRecorder()
+		requestHandler(pub, opts).ServeHTTP(rr, req)
+		return pub, rr.Code
+	}
+
+	if _, code := send("/small", "12345", false); code != 413 {
+		t.Fatalf("expected 413 from Content-Length, got %d", code)
+	}
+	if pub, code := send("/small", "12345", true); code != 413 || pub.called {
+		t.Fatalf("expected 413 while reading, got %d called=%v", code, pub.called)
+	}
+	if _, code := send("/other", strings.Repeat("x", 65), true); code != 413 {
+		t.Fatalf("expected global limit to apply, got %d", code)
+	}
+
+	pub, code := send("/other", strings.Repeat("x", 20), false)
+	if code != 204 {
+		t.Fatalf("expected large body to be accepted, got %d", code)
+	}
+	if pub.receivedMsg.BodyRef == "" || pub.receivedMsg.Body != "" || pub.receivedMsg.BodySize != 20 {
+		t.Fatalf("expected body to be offloaded, got %+v", pub.receivedMsg)
+	}
+	if rc, err := store.Get(context.Background(), pub.receivedMsg.BodyRef); err != nil {
+		t.Fatalf("expected the published body to be kept: %v", err)
+	} else {
+		rc.Close()
+	}
+
+	// A body whose webhook isn't published is removed again.
+	failing := &mockPub{errToReturn: errors.New("boom")}
+	req := httptest.NewRequest("POST", "http://example.com/other", bytes.NewBufferString(strings.Repeat("x", 20)))
+	rr := httptest.NewRecorder()
+	requestHandler(failing, opts).ServeHTTP(rr, req)
+	if rr.Code != 500 || failing.receivedMsg.BodyRef == "" {
+		t.Fatalf("expected an offloaded body and a failed publish, got %d", rr.Code)
+	}
+	if _, err := store.Get(context.Background(), failing.receivedMsg.BodyRef); !errors.Is(err, blob.ErrNotFound) {
+		t.Fatalf("expected the unpublished body to be deleted, got %v", err)
+	}
+}
+
+// TestRequestHandlerClientCert verifies per-route client certificate
+// requirements and that the client identity is recorded in the message.
+func TestRequestHandlerClientCert(t *testing.T) {
+	route := routeConfig{Path: "/partner", ClientCertSANs: []string{"partner.example.com"}}
+	if err := route.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	opts := receiverOptions{routes: routeTable{route}}
+
+	send := func(path string, cert *x509.Certificate) (*mockPub, int) {
+		req := httptest.NewRequest("POST", "http://example.com"+path, bytes.NewBufferString("payload"))
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		}
+		pub := &mockPub{}
+		rr := httptest.NewRecorder()
+		requestHandler(pub, opts).ServeHTTP(rr, req)
+		return pub, rr.Code
+	}
+
+	partner := &x509.Certificate{Raw: []byte("partner"), Subject: pkix.Name{CommonName: "partner"}, DNSNames: []string{"partner.example.com"}}
+	other := &x509.Certificate{Raw: []byte("other"), Subject: pkix.Name{CommonName: "other"}, DNSNames: []string{"other.example.com"}}
+
+	if _, code := send("/partner", nil); code != 401 {
+		t.Fatalf("expected 401 without a certificate, got %d", code)
+	}
+	if _, code := send("/partner", other); code != 403 {
+		t.Fatalf("expected 403 for a certificate not on the list, got %d", code)
+	}
+	pub, code := send("/partner", partner)
+	if code != 204 {
+		t.Fatalf("expected allowed certificate to pass, got %d", code)
+	}
+	if id := pub.receivedMsg.Client; id == nil || id.CommonName != "partner" || id.Fingerprint == "" {
+		t.Fatalf("expected client identity in message, got %+v", id)
+	}
+
+	// Routes without client-cert accept anyone but still record the identity.
+	pub, code = send("/open", other)
+	if code != 204 || pub.receivedMsg.Client == nil {
+		t.Fatalf("expected open route to pass with identity, got %d %+v", code, pub.receivedMsg.Client)
+	}
+}
+
+// TestRequestHandlerAuth verifies that a route's authentication is enforced
+// before the message is published.
+func TestRequestHandlerAuth(t *testing.T) {
+	withConfig(t, `
+routes:
+  - path: /ci
+    auth:
+      type: bearer
+      tokens: [env:RELAY_TEST_TOKEN]
+  - path: /partner
+    auth:
+      type: basic
+      users: ["Partner:s3cret"]
+  - path: /hooks
+    auth:
+      type: path
+      tokens: [abc123]
+  - path: /legacy
+    auth:
+      type: query
+      param: token
+      tokens: [q7oken]
+`)
+	t.Setenv("RELAY_TEST_TOKEN", "t0ken")
+	opts, err := loadReceiverOptions()
+	if err != nil {
+		t.Fatalf("loadReceiverOptions: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		user   string
+		want   int
+	}{
+		{name: "bearer", path: "/ci", header: "Bearer t0ken", want: 204},
+		{name: "bearer-wrong", path: "/ci", header: "Bearer nope", want: 401},
+		{name: "bearer-missing", path: "/ci", want: 401},
+		{name: "basic", path: "/partner", user: "Partner:s3cret", want: 204},
+		{name: "basic-wrong", path: "/partner", user: "Partner:nope", want: 401},
+		{name: "path", path: "/hooks/abc123/push", want: 204},
+		{name: "path-wrong", path: "/hooks/abc124/push", want: 401},
+		{name: "query", path: "/legacy?token=q7oken", want: 204},
+		{name: "open", path: "/other", want: 204},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://example.com"+tc.path, bytes.NewBufferString("payload"))
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			if user, pass, ok := strings.Cut(tc.user, ":"); ok {
+				req.SetBasicAuth(user, pass)
+			}
+			pub := &mockPub{}
+			rr := httptest.NewRecorder()
+			requestHandler(pub, opts).ServeHTTP(rr, req)
+
+			if rr.Code != tc.want {
+				t.Fatalf("expected status %d, got %d", tc.want, rr.Code)
+			}
+			if pub.called != (tc.want == 204) {
+				t.Fatalf("expected publish only when authenticated, called=%v", pub.called)
+			}
+			if tc.want == 401 && tc.path == "/ci" && rr.Header().Get("WWW-Authenticate") == "" {
+				t.Fatalf("expected a WWW-Authenticate challenge")
+			}
+
+			// Credentials must not reach the broker or destinations.
+			if pub.called {
+				msg := pub.receivedMsg
+				if auth := http.Header(msg.Headers).Get("Authorization"); auth != "" {
+					t.Fatalf("expected Authorization to be removed, got %q", auth)
+				}
+				for _, secret := range []string{"t0ken", "abc123", "q7oken"} {
+					if strings.Contains(msg.Path, secret) {
+						t.Fatalf("expected token to be removed from path %q", msg.Path)
+					}
+				}
+				if tc.name == "path" && msg.Path != "/hooks/push" {
+					t.Fatalf("expected path /hooks/push, got %q", msg.Path)
+				}
+			}
+		})
+	}
+}
+
+// TestRequestHandlerAllowlist verifies that a route's allowlist is checked
+// against the client address behind trusted proxies.
+func TestRequestHandlerAllowlist(t *testing.T) {
+	withConfig(t, `
+trusted-proxies: [10.0.0.0/8]
+routes:
+  - path: /github
+    allow-from: [192.30.252.0/22]
+`)
+	opts, err := loadReceiverOptions()
+	if err != nil {
+		t.Fatalf("loadReceiverOptions: %v", err)
+	}
+
+	send := func(path, remote, xff string) int {
+		req := httptest.NewRequest("POST", "http://example.com"+path, bytes.NewBufferString("payload"))
+		req.RemoteAddr = remote
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		rr := httptest.NewRecorder()
+		requestHandler(&mockPub{}, opts).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := send("/github", "192.30.252.10:1000", ""); code != 204 {
+		t.Fatalf("expected allowed address to pass, got %d", code)
+	}
+	if code := send("/github", "10.1.1.1:1000", "192.30.253.1"); code != 204 {
+		t.Fatalf("expected allowed address behind a trusted proxy to pass, got %d", code)
+	}
+	if code := send("/github", "203.0.113.1:1000", "192.30.253.1"); code != 403 {
+		t.Fatalf("expected untrusted X-Forwarded-For to be ignored, got %d", code)
+	}
+	if code := send("/other", "203.0.113.1:1000", ""); code != 204 {
+		t.Fatalf("expected routes without an allowlist to be open, got %d", code)
+	}
+}
+
+// TestRequestHandlerHandshake verifies that provider verification requests
+// are answered by the receiver and not published, while events are.
+func TestRequestHandlerHandshake(t *testing.T) {
+	withConfig(t, `
+routes:
+  - path: /slack
+    handshake:
+      provider: slack
+  - path: /whatsapp
+    handshake:
+      provider: meta
+      verify-token: env:RELAY_TEST_VERIFY_TOKEN
+`)
+	t.Setenv("RELAY_TEST_VERIFY_TOKEN", "v3rify")
+	opts, err := loadReceiverOptions()
+	if err != nil {
+		t.Fatalf("loadReceiverOptions: %v", err)
+	}
+
+	send := func(method, target, body string) (*mockPub, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(method, "http://example.com"+target, bytes.NewBufferString(body))
+		pub := &mockPub{}
+		rr := httptest.NewRecorder()
+		requestHandler(pub, opts).ServeHTTP(rr, req)
+		return pub, rr
+	}
+
+	pub, rr := send("POST", "/slack/events", `{"type":"url_verification","challenge":"abc"}`)
+	if rr.Code != 200 || rr.Body.String() != "abc" || pub.called {
+		t.Fatalf("expected slack challenge to be answered locally, got %d %q called=%v", rr.Code, rr.Body.String(), pub.called)
+	}
+	pub, rr = send("POST", "/slack/events", `{"type":"event_callback"}`)
+	if rr.Code != 204 || !pub.called {
+		t.Fatalf("expected slack event to be published, got %d", rr.Code)
+	}
+
+	pub, rr = send("GET", "/whatsapp?hub.mode=subscribe&hub.verify_token=v3rify&hub.challenge=42", "")
+	if rr.Code != 200 || rr.Body.String() != "42" || pub.called {
+		t.Fatalf("expected meta verification to be answered locally, got %d %q", rr.Code, rr.Body.String())
+	}
+	if _, rr = send("GET", "/whatsapp?hub.mode=subscribe&hub.verify_token=wrong&hub.challenge=42", ""); rr.Code != 403 {
+		t.Fatalf("expected wrong verify token to be refused, got %d", rr.Code)
+	}
+}
+
+// TestRequestHandlerSignedHandshake verifies that on signed routes
+// verification requests are only answered once their signature checks out.
+func TestRequestHandlerSignedHandshake(t *testing.T) {
+	withConfig(t, `
+nonce-size: 100
+routes:
+  - path: /slack
+    handshake:
+      provider: slack
+    signature:
+      provider: slack
+      secrets: [ssecret]
+  - path: /zoom
+    handshake:
+      provider: zoom
+      secret: zsecret
+`)
+	opts, err := loadReceiverOptions()
+	if err != nil {
+		t.Fatalf("loadReceiverOptions: %v", err)
+	}
+
+	send := func(path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://example.com"+path, bytes.NewBufferString(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		requestHandler(&mockPub{}, opts).ServeHTTP(rr, req)
+		return rr
+	}
+	mac := func(secret, data string) string {
+		m := hmac.New(sha256.New, []byte(secret))
+		m.Write([]byte(data))
+		return "v0=" + hex.EncodeToString(m.Sum(nil))
+	}
+
+	challenge := `{"type":"url_verification","challenge":"abc"}`
+	if rr := send("/slack", challenge, nil); rr.Code != 401 {
+		t.Fatalf("expected unsigned slack challenge to be rejected, got %d", rr.Code)
+	}
+	ts := fmt.Sprint(time.Now().Unix())
+	rr := send("/slack", challenge, map[string]string{
+		"X-Slack-Request-Timestamp": ts,
+		"X-Slack-Signature":         mac("ssecret", "v0:"+ts+":"+challenge),
+	})
+	if rr.Code != 200 || rr.Body.String() != "abc" {
+		t.Fatalf("expected signed slack challenge to be answered, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	// An unsigned Zoom validation would make the receiver sign a forged
+	// event for whoever sent it.
+	forged := `{"event":"endpoint.url_validation","payload":{"plainToken":"v0:` + ts + `:{\"event\":\"x\"}"}}`
+	if rr := send("/zoom", forged, nil); rr.Code != 401 {
+		t.Fatalf("expected unsigned zoom validation to be rejected, got %d", rr.Code)
+	}
+	if rr := send("/zoom", forged, map[string]string{"X-Zm-Request-Timestamp": ts, "X-Zm-Signature": mac("other", "v0:"+ts+":"+forged)}); rr.Code != 401 {
+		t.Fatalf("expected badly signed zoom validation to be rejected, got %d", rr.Code)
+	}
+	if rr := send("/zoom", forged, map[string]string{"X-Zm-Request-Timestamp": ts, "X-Zm-Signature": mac("zsecret", "v0:"+ts+":"+forged)}); rr.Code != 200 {
+		t.Fatalf("expected signed zoom validation to be answered, got %d", rr.Code)
+	}
+}
+
+// TestRequestHandlerCustomResponse verifies that a route's configured
+// response, with its templated body, replaces the default 204.
+func TestRequestHandlerCustomResponse(t *testing.T) {
+	withConfig(t, `
+routes:
+  - path: /twilio
+    response:
+      headers:
+        Content-Type: text/xml
+      body: '<Response><!-- {{.ID}} --></Response>'
+  - path: /partner
+    response:
+      status: 202
+      body: '{"ok":true}'
+`)
+	opts, err := loadReceiverOptions()
+	if err != nil {
+		t.Fatalf("loadReceiverOptions: %v", err)
+	}
+
+	send := func(path string) (*mockPub, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest("POST", "http://example.com"+path, bytes.NewBufferString("payload"))
+		pub := &mockPub{}
+		rr := httptest.NewRecorder()
+		requestHandler(pub, opts).ServeHTTP(rr, req)
+		return pub, rr
+	}
+
+	pub, rr := send("/twilio")
+	if rr.Code != 200 || rr.Header().Get("Content-Type") != "text/xml" {
+		t.Fatalf("expected 200 text/xml, got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if want := "<Response><!-- " + pub.receivedMsg.ID + " --></Response>"; rr.Body.String() != want {
+		t.Fatalf("expected body %q, got %q", want, rr.Body.String())
+	}
+
+	if _, rr = send("/partner"); rr.Code != 202 || rr.Body.String() != `{"ok":true}` {
+		t.Fatalf("expected 202 {\"ok\":true}, got %d %q", rr.Code, rr.Body.String())
+	}
+	if _, rr = send("/other"); rr.Code != 204 || rr.Body.Len() != 0 {
+		t.Fatalf("expected default empty 204, got %d", rr.Code)
+	}
+}
+
+// TestRequestHandlerSignature verifies that signed routes reject forged and
+// stale requests, and replays of an accepted one.
+func TestRequestHandlerSignature(t *testing.T) {
+	withConfig(t, `
+nonce-size: 100
+routes:
+  - path: /stripe
+    signature:
+      provider: stripe
+      secrets: [whsec_old, env:RELAY_TEST_STRIPE_SECRET]
+      tolerance: 1m
+`)
+	t.Setenv("RELAY_TEST_STRIPE_SECRET", "whsec_new")
+	opts, err := loadReceiverOptions()
+	if err != nil {
+		t.Fatalf("loadReceiverOptions: %v", err)
+	}
+
+	body := `{"id":"evt_1"}`
+	sign := func(secret string, at time.Time) string {
+		ts := fmt.Sprint(at.Unix())
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(ts + "." + body))
+		return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	send := func(header string, pubErr error) (*mockPub, int) {
+		req := httptest.NewRequest("POST", "http://example.com/stripe", bytes.NewBufferString(body))
+		if header != "" {
+			req.Header.Set("Stripe-Signature", header)
+		}
+		pub := &mockPub{errToReturn: pubErr}
+		rr := httptest.NewRecorder()
+		requestHandler(pub, opts).ServeHTTP(rr, req)
+		return pub, rr.Code
+	}
+
+	now := time.Now()
+	if pub, code := send("", nil); code != 401 || pub.called {
+		t.Fatalf("expected unsigned request to be rejected, got %d", code)
+	}
+	if _, code := send(sign("whsec_other", now), nil); code != 401 {
+		t.Fatalf("expected forged signature to be rejected, got %d", code)
+	}
+	if _, code := send(sign("whsec_new", now.Add(-2*time.Minute)), nil); code != 401 {
+		t.Fatalf("expected stale signature to be rejected, got %d", code)
+	}
+
+	// A failed publish doesn't use up the signature, so the sender's retry
+	// is accepted.
+	header := sign("whsec_new", now)
+	if _, code := send(header, errors.New("boom")); code != 500 {
+		t.Fatalf("expected publish failure, got %d", code)
+	}
+	if pub, code := send(header, nil); code != 204 || !pub.called {
+		t.Fatalf("expected signed request to be published, got %d", code)
+	}
+	if pub, code := send(header, nil); code != 401 || pub.called {
+		t.Fatalf("expected replay to be rejected, got %d", code)
+	}
+	if _, code := send(sign("whsec_old", now.Add(-time.Second)), nil); code != 204 {
+		t.Fatalf("expected the previous secret to be accepted, got %d", code)
+	}
+
+	// A request signed with both secrets while rotating can't be replayed
+	// by keeping only one of its signatures.
+	at := now.Add(-2 * time.Second)
+	_, v1old, _ := strings.Cut(sign("whsec_old", at), ",")
+	if _, code := send(sign("whsec_new", at)+","+v1old, nil); code != 204 {
+		t.Fatalf("expected request signed with both secrets to be accepted, got %d", code)
+	}
+	if pub, code := send(sign("whsec_old", at), nil); code != 401 || pub.called {
+		t.Fatalf("expected replay with the other signature to be rejected, got %d", code)
+	}
+
+	// A replay arriving while the original is still being published is
+	// rejected too.
+	header = sign("whsec_new", now.Add(-3*time.Second))
+	first := &blockingPub{publishing: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan int)
+	go func() {
+		req := httptest.NewRequest("POST", "http://example.com/stripe", bytes.NewBufferString(body))
+		req.Header.Set("Stripe-Signature", header)
+		rr := httptest.NewRecorder()
+		requestHandler(first, opts).ServeHTTP(rr, req)
+		done <- rr.Code
+	}()
+	<-first.publishing
+	if pub, code := send(header, nil); code != 401 || pub.called {
+		t.Fatalf("expected concurrent replay to be rejected, got %d", code)
+	}
+	close(first.release)
+	if code := <-done; code != 204 {
+		t.Fatalf("expected the original to be published, got %d", code)
+	}
+
+	// Offloaded bodies are verified as they are read back from the store,
+	// and removed again if the signature doesn't match.
+	dir := t.TempDir()
+	store, err := blob.NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	opts.offload = &messaging.BodyOffload{Store: store, Threshold: 4}
+	if pub, code := send(sign("whsec_new", now.Add(time.Second)), nil); code != 204 || pub.receivedMsg.BodyRef == "" {
+		t.Fatalf("expected offloaded signed request to be published, got %d", code)
+	}
+	pub, code := send(sign("whsec_other", now), nil)
+	if code != 401 || pub.called {
+		t.Fatalf("expected forged offloaded request to be rejected, got %d", code)
+	}
+	if n, _ := os.ReadDir(dir); len(n) != 1 {
+		t.Fatalf("expected only the published body to be kept, got %d blobs", len(n))
+	}
+}
+
+// TestRequestHandlerSignatureDedup verifies that a retry of an accepted,
+// signed delivery on a deduplicated route is answered as a duplicate rather
+// than rejected as a replay.
+func TestRequestHandlerSignatureDedup(t *testing.T) {
+	withConfig(t, `
+nonce-size: 100
+dedup-size: 100
+dedup-ttl: 1h
+routes:
+  - path: /stripe
+    dedup: body:id
+    signature:
+      provider: stripe
+      secrets: [whsec_test]
+`)
+	opts, err := loadReceiverOptions()
+	if err != nil {
+		t.Fatalf("loadReceiverOptions: %v", err)
+	}
+
+	body := `{"id":"evt_1"}`
+	ts := fmt.Sprint(time.Now().Unix())
+	mac := hmac.New(sha256.New, []byte("whsec_test"))
+	mac.Write([]byte(ts + "." + body))
+	header := "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+	send := func() (*mockPub, int) {
+		req := httptest.NewRequest("POST", "http://example.com/stripe", bytes.NewBufferString(body))
+		req.Header.Set("Stripe-Signature", header)
+		pub := &mockPub{}
+		rr := httptest.NewRecorder()
+		requestHandler(pub, opts).ServeHTTP(rr, req)
+		return pub, rr.Code
+	}
+
+	if pub, code := send(); code != 204 || !pub.called {
+		t.Fatalf("expected signed delivery to be published, got %d", code)
+	}
+	if pub, code := send(); code != 200 || pub.called {
+		t.Fatalf("expected the retry to be answered as a duplicate, got %d called=%v", code, pub.called)
+	}
+}
+
+// TestCheckPlaintextStorage verifies that encryption is refused together with
+// settings that write bodies to disk unencrypted.
+func TestCheckPlaintextStorage(t *testing.T) {
+	withConfig(t, "spool-dir: /var/spool/relay\n")
+	line, _, _ := envelope.Generate("k1", envelope.TypeAES)
+	keys, err := envelope.Parse(strings.NewReader(line))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	if err := checkPlaintextStorage(nil, "spool-dir"); err != nil {
+		t.Fatalf("expected no error without encryption, got %v", err)
+	}
+	if err := checkPlaintextStorage(keys, "blob-dir"); err != nil {
+		t.Fatalf("expected no error for unset flags, got %v", err)
+	}
+	if err := checkPlaintextStorage(keys, "blob-dir", "spool-dir"); err == nil {
+		t.Fatalf("expected spooling to be refused with encryption")
+	}
+}
+
+// TestRequestHandlerResponseEscaping verifies that request values in a
+// response template are escaped for the response's content type.
+func TestRequestHandlerResponseEscaping(t *testing.T) {
+	withConfig(t, `
+routes:
+  - path: /json
+    response:
+      headers:
+        Content-Type: application/json
+      body: '{"ok":true,"path":"{{.Path}}"}'
+  - path: /twiml
+    response:
+      headers:
+        Content-Type: text/xml
+      body: '<Response><Say>{{.Path}}</Say></Response>'
+`)
+	opts, err := loadReceiverOptions()
+	if err != nil {
+		t.Fatalf("loadReceiverOptions: %v", err)
+	}
+
+	send := func(target string) string {
+		req := httptest.NewRequest("POST", "http://example.com"+target, bytes.NewBufferString("payload"))
+		rr := httptest.NewRecorder()
+		requestHandler(&mockPub{}, opts).ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	body := send(`/json/%22,%22ok%22:false,%22x%22:%22%3C`)
+	var resp map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("expected valid JSON, got %q: %v", body, err)
+	}
+	if resp["ok"] != true || resp["path"] != `/json/","ok":false,"x":"<` || len(resp) != 2 {
+		t.Fatalf("expected the path to stay inside its string, got %v", resp)
+	}
+
+	body = send(`/twiml/%3C/Say%3E%3CHangup/%3E`)
+	if want := "<Response><Say>/twiml/&lt;/Say&gt;&lt;Hangup/&gt;</Say></Response>"; body != want {
+		t.Fatalf("expected %q, got %q", want, body)
+	}
+}
+
+// TestStopOnFailure verifies that a failed healthcheck stops the command and
+// marks the process as failed, so it exits non-zero.
+func TestStopOnFailure(t *testing.T) {
+	t.Cleanup(func() { failed.Store(false) })
+	hc := &messaging.HealthChecker{Failure: make(chan struct{}, 1)}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	stopOnFailure(ctx, hc, stop)
+	hc.Failure <- struct{}{}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("expected the healthcheck failure to stop the command")
+	}
+	if !failed.Load() {
+		t.Fatalf("expected the process to be marked as failed")
+	}
+}
+
+// TestReceiverServerTimeouts verifies that the server's timeouts come from
+// configuration, and that negative timeouts are refused.
+func TestReceiverServerTimeouts(t *testing.T) {
+	withConfig(t, `
+read-header-timeout: 3s
+read-timeout: 10m
+write-timeout: 0s
+`)
+	s := newReceiverServer(http.NotFoundHandler(), nil)
+	if s.ReadHeaderTimeout != 3*time.Second || s.ReadTimeout != 10*time.Minute || s.WriteTimeout != 0 {
+		t.Fatalf("expected timeouts 3s, 10m and none, got %s, %s and %s", s.ReadHeaderTimeout, s.ReadTimeout, s.WriteTimeout)
+	}
+
+	withConfig(t, `read-timeout: -1s`)
+	if _, err := loadReceiverOptions(); err == nil || !strings.Contains(err.Error(), "--read-timeout") {
+		t.Fatalf("expected a negative read timeout to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/smarthall/webhook-relay/internal/messaging"
+)
+
+// responseConfig is a route's "response" setting, replacing the default empty
+// 204 sent once a webhook has been accepted.
+type responseConfig struct {
+	// Status defaults to 200.
+	Status  int               `mapstructure:"status"`
+	Headers map[string]string `mapstructure:"headers"`
+	// Body is a text/template executed with responseData, whose values are
+	// escaped to suit the Content-Type header.
+	Body string `mapstructure:"body"`
+
+	body   *template.Template
+	escape func(string) string
+}
+
+// responseData is what a response body template can refer to.
+type responseData struct {
+	// ID is the relay message ID, also sent to destinations as
+	// Relay-Message-Id.
+	ID     string
+	Method string
+	Host   string
+	Path   string
+}
+
+func (rc *responseConfig) validate() error {
+	if rc.Status == 0 {
+		rc.Status = http.StatusOK
+	}
+	if rc.Status < 200 || rc.Status > 299 {
+		return fmt.Errorf("response status must be a 2xx status")
+	}
+	t, err := template.New("response").Option("missingkey=error").Parse(rc.Body)
+	if err != nil {
+		return fmt.Errorf("invalid response body: %w", err)
+	}
+	rc.body = t
+	rc.escape = escaperFor(rc.contentType())
+	return nil
+}
+
+// contentType returns the configured Content-Type header. Config keys may
+// arrive in any case.
+func (rc *responseConfig) contentType() string {
+	for name, value := range rc.Headers {
+		if http.CanonicalHeaderKey(name) == "Content-Type" {
+			return value
+		}
+	}
+	return ""
+}
+
+// escaperFor returns how request values are escaped in a body of the given
+// content type. JSON gets string escaping and plain text none; anything else,
+// including no content type at all, is escaped for XML and HTML.
+func escaperFor(contentType string) func(string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return func(s string) string {
+			b, _ := json.Marshal(s)
+			return string(b[1 : len(b)-1])
+		}
+	case mediaType == "text/plain":
+		return func(s string) string { return s }
+	default:
+		return template.HTMLEscapeString
+	}
+}
+
+// writeAccepted answers a request whose webhook was accepted, with the
+// route's configured response or an empty 204.
+func writeAccepted(w http.ResponseWriter, route *routeConfig, msg messaging.RequestMessage) {
+	rc := route.Response
+	if rc == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var body bytes.Buffer
+	data := responseData{
+		ID:     rc.escape(msg.ID),
+		Method: rc.escape(msg.Method),
+		Host:   rc.escape(msg.Host),
+		Path:   rc.escape(msg.Path),
+	}
+	if err := rc.body.Execute(&body, data); err != nil {
+		// The webhook is already accepted, so still report success.
+		log.Printf("Failed to render response for route %s: %v", route.Path, err)
+		body.Reset()
+	}
+
+	for name, value := range rc.Headers {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(rc.Status)
+	_, _ = w.Write(body.Bytes())
+}
@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/smarthall/webhook-relay/internal/auth"
+	"github.com/smarthall/webhook-relay/internal/handshake"
+	"github.com/smarthall/webhook-relay/internal/ipallow"
+	"github.com/smarthall/webhook-relay/internal/messaging"
+	"github.com/smarthall/webhook-relay/internal/signature"
+	"github.com/spf13/viper"
+)
+
+// Actions for webhooks that no queue is bound to receive.
+const (
+	unroutableDrop      = "drop"
+	unroutableReject    = "reject"
+	unroutableAlternate = "alternate"
+	unroutableArchive   = "archive"
+)
+
+// routeConfig holds per-route settings. Routes are read from the "routes" list
+// in the config file and matched against the request path by prefix, the
+// longest prefix winning. Requests matching no route use the zero value. The
+// receiver and transmitter each use the settings that apply to them, so both
+// can share one config file.
+type routeConfig struct {
+	// Path is the path prefix the route applies to, e.g. "/github".
+	Path string `mapstructure:"path"`
+
+	// Unroutable is what happens to webhooks no queue is bound for: "drop"
+	// (the default), "reject" with UnroutableStatus, republish to
+	// AlternateExchange, or "archive" to the archive directory.
+	Unroutable        string `mapstructure:"unroutable"`
+	UnroutableStatus  int    `mapstructure:"unroutable-status"`
+	AlternateExchange string `mapstructure:"alternate-exchange"`
+
+	// SendTo overrides the transmitter's --send-to for webhooks on this
+	// route.
+	SendTo string `mapstructure:"send-to"`
+
+	// SignKeys overrides the transmitter's --sign-key for webhooks on this
+	// route. The signer is built by the transmitter.
+	SignKeys []string `mapstructure:"sign-keys"`
+	signer   *signature.StandardSigner
+
+	// Resign replaces the provider's signature with one made with the
+	// destination's secret. The resigner is built by the transmitter.
+	Resign   *resignConfig `mapstructure:"resign"`
+	resigner signature.Resigner
+
+	// RateLimit, RateBurst and MaxInFlight override the transmitter's
+	// outbound limits for this route's destination. Zero keeps the global
+	// setting.
+	RateLimit   float64 `mapstructure:"rate-limit"`
+	RateBurst   int     `mapstructure:"rate-burst"`
+	MaxInFlight int     `mapstructure:"max-in-flight"`
+
+	// ReceiveRateLimit and ReceiveRateBurst limit the requests per second the
+	// receiver accepts on this route from all senders together. Zero
+	// disables the limit.
+	ReceiveRateLimit float64 `mapstructure:"receive-rate-limit"`
+	ReceiveRateBurst int     `mapstructure:"receive-rate-burst"`
+
+	// ClientCert requires a verified TLS client certificate on this route.
+	// ClientCertSubjects and ClientCertSANs, when set, imply it and accept
+	// only certificates whose subject (common name or full distinguished
+	// name) or a subject alternative name is listed.
+	ClientCert         bool     `mapstructure:"client-cert"`
+	ClientCertSubjects []string `mapstructure:"client-cert-subjects"`
+	ClientCertSANs     []string `mapstructure:"client-cert-sans"`
+
+	// AllowFrom and AllowFromFile restrict the route to client addresses in
+	// the listed CIDR ranges, such as a provider's published webhook ranges.
+	// The file holds one range per line and is reloaded on SIGHUP and every
+	// --allowlist-refresh.
+	AllowFrom     []string `mapstructure:"allow-from"`
+	AllowFromFile string   `mapstructure:"allow-from-file"`
+	allow         *ipallow.List
+
+	// Auth authenticates requests on this route before they are published.
+	// The authenticator is built by the receiver.
+	Auth          *authConfig `mapstructure:"auth"`
+	authenticator auth.Authenticator
+
+	// Handshake answers the provider's verification requests locally
+	// instead of publishing them. The responder is built by the receiver.
+	Handshake *handshakeConfig `mapstructure:"handshake"`
+	responder handshake.Responder
+
+	// Signature verifies the provider's signature on requests, rejecting
+	// stale and replayed ones. The verifier is built by the receiver.
+	Signature *signatureConfig `mapstructure:"signature"`
+	verifier  signature.Verifier
+
+	// Response replaces the empty 204 sent once a webhook is accepted.
+	Response *responseConfig `mapstructure:"response"`
+
+	// MaxBodySize overrides the receiver's --max-body-size for this route.
+	MaxBodySize int64 `mapstructure:"max-body-size"`
+
+	// Dedup names the delivery ID used to suppress redelivered webhooks:
+	// "header:<name>", "body:<path>" or "hash". Empty disables it.
+	Dedup string `mapstructure:"dedup"`
+	dedup *dedupKey
+}
+
+// validate checks the route and fills in defaults.
+func (rc *routeConfig) validate() error {
+	if !strings.HasPrefix(rc.Path, "/") {
+		return fmt.Errorf("route path %q must start with /", rc.Path)
+	}
+
+	switch rc.Unroutable {
+	case "", unroutableDrop, unroutableArchive:
+	case unroutableReject:
+		if rc.UnroutableStatus == 0 {
+			rc.UnroutableStatus = http.StatusNotFound
+		}
+		if rc.UnroutableStatus < 400 || rc.UnroutableStatus > 599 {
+			return fmt.Errorf("route %s: unroutable-status must be a 4xx or 5xx status", rc.Path)
+		}
+	case unroutableAlternate:
+		if rc.AlternateExchange == "" {
+			return fmt.Errorf("route %s: unroutable alternate requires alternate-exchange", rc.Path)
+		}
+	default:
+		return fmt.Errorf("route %s: unsupported unroutable action %q (want drop, reject, alternate or archive)", rc.Path, rc.Unroutable)
+	}
+
+	if rc.RateLimit < 0 || rc.RateBurst < 0 || rc.MaxInFlight < 0 {
+		return fmt.Errorf("route %s: rate-limit, rate-burst and max-in-flight must not be negative", rc.Path)
+	}
+	if len(rc.ClientCertSubjects) > 0 || len(rc.ClientCertSANs) > 0 {
+		rc.ClientCert = true
+	}
+
+	if _, err := ipallow.ParsePrefixes(rc.AllowFrom); err != nil {
+		return fmt.Errorf("route %s: allow-from: %w", rc.Path, err)
+	}
+
+	if rc.Auth != nil {
+		if err := rc.Auth.validate(); err != nil {
+			return fmt.Errorf("route %s: %w", rc.Path, err)
+		}
+	}
+
+	if rc.Handshake != nil {
+		if err := rc.Handshake.validate(); err != nil {
+			return fmt.Errorf("route %s: %w", rc.Path, err)
+		}
+	}
+
+	if rc.Signature != nil {
+		if err := rc.Signature.validate(); err != nil {
+			return fmt.Errorf("route %s: %w", rc.Path, err)
+		}
+	}
+
+	if rc.Resign != nil {
+		if err := rc.Resign.validate(); err != nil {
+			return fmt.Errorf("route %s: resign: %w", rc.Path, err)
+		}
+	}
+
+	if rc.Response != nil {
+		if err := rc.Response.validate(); err != nil {
+			return fmt.Errorf("route %s: %w", rc.Path, err)
+		}
+	}
+
+	if rc.MaxBodySize < 0 {
+		return fmt.Errorf("route %s: max-body-size must not be negative", rc.Path)
+	}
+	if rc.ReceiveRateLimit < 0 || rc.ReceiveRateBurst < 0 {
+		return fmt.Errorf("route %s: receive-rate-limit and receive-rate-burst must not be negative", rc.Path)
+	}
+
+	if rc.Dedup != "" {
+		key, err := parseDedupKey(rc.Dedup)
+		if err != nil {
+			return fmt.Errorf("route %s: %w", rc.Path, err)
+		}
+		rc.dedup = &key
+	}
+
+	return nil
+}
+
+// publishOptions returns the options used to publish webhooks on this route.
+func (rc *routeConfig) publishOptions() messaging.PublishOptions {
+	switch rc.Unroutable {
+	case unroutableReject, unroutableArchive:
+		return messaging.PublishOptions{Mandatory: true}
+	case unroutableAlternate:
+		return messaging.PublishOptions{Mandatory: true, AlternateExchange: rc.AlternateExchange}
+	default:
+		return messaging.PublishOptions{}
+	}
+}
+
+// allowsClient reports whether a client with the verified certificate id may
+// use the route. It is only meaningful when ClientCert is set.
+func (rc *routeConfig) allowsClient(id *messaging.ClientIdentity) bool {
+	if id == nil {
+		return false
+	}
+	if len(rc.ClientCertSubjects) == 0 && len(rc.ClientCertSANs) == 0 {
+		return true
+	}
+	for _, subject := range rc.ClientCertSubjects {
+		if subject == id.CommonName || subject == id.Subject {
+			return true
+		}
+	}
+	for _, allowed := range rc.ClientCertSANs {
+		for _, san := range id.SANs {
+			if allowed == san {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matches reports whether path falls under the route's path prefix. The
+// prefix must end on a path segment boundary, so "/git" does not match
+// "/github".
+func (rc *routeConfig) matches(path string) bool {
+	prefix := strings.TrimSuffix(rc.Path, "/")
+	if prefix == "" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// routeTable is a list of routes sorted longest path first.
+type routeTable []routeConfig
+
+// loadRoutes reads and validates the routes from config.
+func loadRoutes() (routeTable, error) {
+	var routes routeTable
+	if err := viper.UnmarshalKey("routes", &routes); err != nil {
+		return nil, fmt.Errorf("invalid routes: %w", err)
+	}
+	for i := range routes {
+		if err := routes[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].Path) > len(routes[j].Path)
+	})
+	return routes, nil
+}
+
+// match returns the route for path, or an empty default route if none
+// matches.
+func (rt routeTable) match(path string) *routeConfig {
+	for i := range rt {
+		if rt[i].matches(path) {
+			return &rt[i]
+		}
+	}
+	return &routeConfig{Path: "/"}
+}
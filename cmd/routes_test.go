@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// withConfig loads yaml into viper for the duration of the test.
+func withConfig(t *testing.T, yaml string) {
+	t.Helper()
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader(yaml)); err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	t.Cleanup(viper.Reset)
+}
+
+func TestLoadRoutesAndMatch(t *testing.T) {
+	withConfig(t, `
+routes:
+  - path: /git
+  - path: /github
+    unroutable: reject
+  - path: /github/enterprise/
+    unroutable: alternate
+    alternate-exchange: unrouted
+`)
+
+	routes, err := loadRoutes()
+	if err != nil {
+		t.Fatalf("loadRoutes: %v", err)
+	}
+
+	tests := map[string]string{
+		"/github":                "/github",
+		"/github/push":           "/github",
+		"/github/enterprise":     "/github/enterprise/",
+		"/github/enterprise/org": "/github/enterprise/",
+		"/git":                   "/git",
+		"/gitlab":                "/",
+		"/":                      "/",
+	}
+	for path, want := range tests {
+		if got := routes.match(path).Path; got != want {
+			t.Fatalf("match(%q): expected route %q, got %q", path, want, got)
+		}
+	}
+
+	if got := routes.match("/github").UnroutableStatus; got != 404 {
+		t.Fatalf("expected reject to default to 404, got %d", got)
+	}
+}
+
+func TestLoadRoutesInvalid(t *testing.T) {
+	withConfig(t, `
+routes:
+  - path: /github
+    unroutable: alternate
+`)
+
+	if _, err := loadRoutes(); err == nil {
+		t.Fatalf("expected error for alternate route without an exchange")
+	}
+}
+
+func TestLoadRoutesInvalidAuth(t *testing.T) {
+	withConfig(t, `
+routes:
+  - path: /ci
+    auth:
+      type: query
+      tokens: [abc]
+`)
+
+	if _, err := loadRoutes(); err == nil {
+		t.Fatalf("expected error for query auth without a param")
+	}
+}
+
+func TestLoadRoutesInvalidHandshake(t *testing.T) {
+	withConfig(t, `
+routes:
+  - path: /zoom
+    handshake:
+      provider: zoom
+`)
+
+	if _, err := loadRoutes(); err == nil {
+		t.Fatalf("expected error for zoom handshake without a secret")
+	}
+}
+
+func TestLoadRoutesInvalidResponse(t *testing.T) {
+	withConfig(t, `
+routes:
+  - path: /hooks
+    response:
+      body: '{{.ID'
+`)
+
+	if _, err := loadRoutes(); err == nil {
+		t.Fatalf("expected error for an invalid response template")
+	}
+}
+
+func TestLoadRoutesInvalidSignature(t *testing.T) {
+	withConfig(t, `
+routes:
+  - path: /stripe
+    signature:
+      provider: stripe
+`)
+
+	if _, err := loadRoutes(); err == nil {
+		t.Fatalf("expected error for a signature without secrets")
+	}
+}
+
+func TestLoadRoutesInvalidResign(t *testing.T) {
+	withConfig(t, `
+routes:
+  - path: /hooks
+    resign:
+      provider: hmac
+      secret: s3cret
+`)
+
+	if _, err := loadRoutes(); err == nil {
+		t.Fatalf("expected error for hmac resign without a header")
+	}
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/smarthall/webhook-relay/internal/messaging"
+	"github.com/smarthall/webhook-relay/internal/tlsutil"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	receiverCmd.Flags().String("tls-cert", "", "Certificate file to serve HTTPS with, reloaded when it changes (requires --tls-key)")
+	viper.BindPFlag("tls-cert", receiverCmd.Flags().Lookup("tls-cert"))
+
+	receiverCmd.Flags().String("tls-key", "", "Private key file for --tls-cert")
+	viper.BindPFlag("tls-key", receiverCmd.Flags().Lookup("tls-key"))
+
+	receiverCmd.Flags().String("tls-min-version", "1.2", "Minimum TLS version served: 1.0, 1.1, 1.2 or 1.3")
+	viper.BindPFlag("tls-min-version", receiverCmd.Flags().Lookup("tls-min-version"))
+
+	receiverCmd.Flags().String("tls-client-ca", "", "CA bundle used to verify client certificates; clients may then present one, and routes with client-cert require it")
+	viper.BindPFlag("tls-client-ca", receiverCmd.Flags().Lookup("tls-client-ca"))
+}
+
+// receiverTLSConfig returns the TLS configuration for the receiver's server,
+// or nil to serve plain HTTP. Certificates and the client CA bundle are
+// reloaded when their files change.
+func receiverTLSConfig(routes routeTable) (*tls.Config, error) {
+	certFile, keyFile := viper.GetString("tls-cert"), viper.GetString("tls-key")
+	clientCA := viper.GetString("tls-client-ca")
+
+	for _, route := range routes {
+		if route.ClientCert && clientCA == "" {
+			return nil, fmt.Errorf("route %s requires a client certificate but --tls-client-ca is not set", route.Path)
+		}
+	}
+	if certFile == "" && keyFile == "" {
+		if clientCA != "" {
+			return nil, errors.New("--tls-client-ca requires --tls-cert and --tls-key")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("--tls-cert and --tls-key must be set together")
+	}
+
+	minVersion, err := tlsutil.ParseVersion(viper.GetString("tls-min-version"))
+	if err != nil {
+		return nil, err
+	}
+	kp, err := tlsutil.NewKeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: kp.GetCertificate,
+	}
+
+	if clientCA != "" {
+		pool, err := tlsutil.NewCertPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		// Request rather than require certificates, verifying them against
+		// the reloadable pool, so routes without client-cert stay open to
+		// everyone.
+		cfg.ClientAuth = tls.RequestClientCert
+		cfg.VerifyConnection = pool.VerifyClient()
+	}
+	return cfg, nil
+}
+
+// checkClientCert enforces the route's client certificate requirement. If the
+// request is rejected it writes the response and returns false.
+func checkClientCert(w http.ResponseWriter, r *http.Request, route *routeConfig) bool {
+	if !route.ClientCert {
+		return true
+	}
+	id := messaging.ClientIdentityOf(r.TLS)
+	if id == nil {
+		log.Printf("Rejected request without client certificate at %s", r.URL.Path)
+		rejected.Add("client_cert", 1)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	if !route.allowsClient(id) {
+		log.Printf("Rejected client certificate %q at %s", id.Subject, r.URL.Path)
+		rejected.Add("client_cert", 1)
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
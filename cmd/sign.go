@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/smarthall/webhook-relay/internal/auth"
+	"github.com/smarthall/webhook-relay/internal/messaging"
+	"github.com/smarthall/webhook-relay/internal/signature"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	transmitterCmd.Flags().StringSlice("sign-key", nil, "Sign deliveries per Standard Webhooks with this whsec_ (HMAC) or whsk_ (Ed25519) key; repeat while rotating keys (env:NAME and file:PATH allowed)")
+	viper.BindPFlag("sign-key", transmitterCmd.Flags().Lookup("sign-key"))
+}
+
+// newSigner builds a Standard Webhooks signer, resolving the keys.
+func newSigner(keys []string) (*signature.StandardSigner, error) {
+	resolved, err := auth.Secrets(keys)
+	if err != nil {
+		return nil, err
+	}
+	return signature.NewStandardSigner(resolved)
+}
+
+// resignConfig is a route's "resign" setting, which replaces the provider's
+// signature with one the destination can verify with its own secret. The
+// secret may be given literally, as "env:NAME" or as "file:PATH".
+type resignConfig struct {
+	// Provider is github, slack, stripe or hmac.
+	Provider string `mapstructure:"provider"`
+	Secret   string `mapstructure:"secret"`
+	// Header, Prefix and Encoding describe the hmac provider's header.
+	Header   string `mapstructure:"header"`
+	Prefix   string `mapstructure:"prefix"`
+	Encoding string `mapstructure:"encoding"`
+}
+
+func (rc *resignConfig) validate() error {
+	// The secret isn't resolved here, only checked to be set.
+	_, err := signature.NewResigner(rc.Provider, rc.Secret, rc.format())
+	return err
+}
+
+func (rc *resignConfig) format() signature.HMACFormat {
+	return signature.HMACFormat{Header: rc.Header, Prefix: rc.Prefix, Encoding: rc.Encoding}
+}
+
+// resigner builds the resigner, resolving the secret.
+func (rc *resignConfig) resigner() (signature.Resigner, error) {
+	secret, err := auth.Secret(rc.Secret)
+	if err != nil {
+		return nil, err
+	}
+	return signature.NewResigner(rc.Provider, secret, rc.format())
+}
+
+// loadSigners builds the signer for --sign-key, and the signers and
+// resigners of routes.
+func loadSigners(opts *transmitOptions) error {
+	var err error
+	if keys := viper.GetStringSlice("sign-key"); len(keys) > 0 {
+		if opts.signer, err = newSigner(keys); err != nil {
+			return fmt.Errorf("--sign-key: %w", err)
+		}
+	}
+	for i, route := range opts.routes {
+		if len(route.SignKeys) > 0 {
+			if opts.routes[i].signer, err = newSigner(route.SignKeys); err != nil {
+				return fmt.Errorf("route %s: sign-keys: %w", route.Path, err)
+			}
+		}
+		if route.Resign != nil {
+			if opts.routes[i].resigner, err = route.Resign.resigner(); err != nil {
+				return fmt.Errorf("route %s: resign: %w", route.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// signRequest re-signs req in the provider's format if its route says so, and
+// signs it per Standard Webhooks as the message id if a signer applies. The
+// body is read into memory to be signed.
+func (o transmitOptions) signRequest(req *http.Request, reqmsg messaging.RequestMessage, id string) error {
+	route := o.routes.match(reqmsg.Path)
+	signer := o.signer
+	if route.signer != nil {
+		signer = route.signer
+	}
+	if signer == nil && route.resigner == nil {
+		return nil
+	}
+
+	body, err := bufferBody(req)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if route.resigner != nil {
+		route.resigner.Resign(req.Header, now.Unix(), body)
+	}
+	if signer != nil {
+		signer.Sign(req.Header, id, now, body)
+	}
+	return nil
+}
+
+// bufferBody reads the request body into memory, replacing it with a copy,
+// and returns it.
+func bufferBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	req.ContentLength = int64(len(body))
+	return body, nil
+}
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/smarthall/webhook-relay/internal/auth"
+	"github.com/smarthall/webhook-relay/internal/blob"
+	"github.com/smarthall/webhook-relay/internal/dedup"
+	"github.com/smarthall/webhook-relay/internal/messaging"
+	"github.com/smarthall/webhook-relay/internal/signature"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	receiverCmd.Flags().Int("nonce-size", 100000, "Maximum number of signed webhooks remembered to reject replays")
+	viper.BindPFlag("nonce-size", receiverCmd.Flags().Lookup("nonce-size"))
+}
+
+// defaultTolerance is how far a signed timestamp may be from the current time
+// when the route doesn't say.
+const defaultTolerance = 5 * time.Minute
+
+// signatureConfig is a route's "signature" setting. Secrets may be given
+// literally, as "env:NAME" or as "file:PATH".
+type signatureConfig struct {
+	// Provider is stripe, slack, standard (Standard Webhooks and Svix) or
+	// github.
+	Provider string `mapstructure:"provider"`
+	// Secrets are the signing secrets. Several may be listed to allow
+	// rotation.
+	Secrets []string `mapstructure:"secrets"`
+	// Tolerance is how far the signed timestamp may be from now. Used
+	// signatures are remembered for twice as long, so a request can't be
+	// replayed while its timestamp is acceptable. For providers that sign
+	// no timestamp it is only how long signatures are remembered.
+	Tolerance time.Duration `mapstructure:"tolerance"`
+}
+
+func (sc *signatureConfig) validate() error {
+	if len(sc.Secrets) == 0 {
+		return errors.New("signature requires secrets")
+	}
+	if sc.Tolerance < 0 {
+		return errors.New("signature tolerance must not be negative")
+	}
+	if sc.Tolerance == 0 {
+		sc.Tolerance = defaultTolerance
+	}
+	for _, p := range signature.Providers {
+		if p == sc.Provider {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported signature provider %q (want %s)", sc.Provider, strings.Join(signature.Providers, ", "))
+}
+
+// verifier builds the signature verifier, resolving secrets.
+func (sc *signatureConfig) verifier() (signature.Verifier, error) {
+	secrets, err := auth.Secrets(sc.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	return signature.New(sc.Provider, secrets)
+}
+
+// openNonceCache returns the cache of used signatures, remembering each for
+// twice the longest route tolerance, or nil if no route checks signatures.
+func openNonceCache(routes routeTable) *dedup.Cache {
+	var window time.Duration
+	for _, route := range routes {
+		if route.Signature != nil && 2*route.Signature.Tolerance > window {
+			window = 2 * route.Signature.Tolerance
+		}
+	}
+	if window == 0 {
+		return nil
+	}
+	return dedup.New(viper.GetInt("nonce-size"), window)
+}
+
+// checkSignature verifies the route's signature on msg, rejecting forged and
+// stale requests. If the request is rejected it writes the response and
+// returns false. Otherwise it returns the request's nonce, to be claimed with
+// claimNonce, which is empty if the route checks no signature.
+func checkSignature(w http.ResponseWriter, r *http.Request, route *routeConfig, msg messaging.RequestMessage, opts receiverOptions) (string, bool) {
+	if route.verifier == nil {
+		return "", true
+	}
+
+	reject := func(reason string, err error) (string, bool) {
+		log.Printf("Rejected request at %s: %v", r.URL.Path, err)
+		rejected.Add(reason, 1)
+		w.WriteHeader(http.StatusUnauthorized)
+		return "", false
+	}
+
+	var store blob.Store
+	if opts.offload != nil {
+		store = opts.offload.Store
+	}
+	body, err := msg.OpenBody(r.Context(), store)
+	if err != nil {
+		log.Printf("Failed to read offloaded body: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return "", false
+	}
+	defer body.Close()
+	res, err := route.verifier.Verify(http.Header(msg.Headers), body)
+	switch {
+	case errors.Is(err, signature.ErrMissing) || errors.Is(err, signature.ErrMismatch):
+		return reject("signature", err)
+	case err != nil:
+		log.Printf("Failed to verify signature at %s: %v", r.URL.Path, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return "", false
+	}
+	if err := signature.CheckTimestamp(res, route.Signature.Tolerance, time.Now()); err != nil {
+		return reject("signature_stale", err)
+	}
+
+	return route.Path + " " + res.Nonce, true
+}
+
+// claimNonce rejects a replayed request, writing the response and returning
+// false. Claiming the nonce before publishing, rather than once accepted,
+// stops concurrent replays from all getting through; it is released with
+// releaseNonce if the webhook isn't accepted. Deduplicated routes check for
+// redeliveries first, so the sender's retries of an accepted webhook are
+// answered as duplicates rather than rejected.
+func claimNonce(w http.ResponseWriter, r *http.Request, opts receiverOptions, nonce string) bool {
+	if nonce == "" || opts.nonces == nil {
+		return true
+	}
+	if added, _ := opts.nonces.AddIfAbsent(nonce); !added {
+		log.Printf("Rejected request at %s: request already accepted", r.URL.Path)
+		rejected.Add("replay", 1)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// releaseNonce forgets the nonce of a webhook that wasn't accepted, so the
+// sender's retry goes through.
+func releaseNonce(opts receiverOptions, nonce string) {
+	if nonce == "" || opts.nonces == nil {
+		return
+	}
+	if err := opts.nonces.Remove(nonce); err != nil {
+		log.Printf("Failed to release nonce: %v", err)
+	}
+}
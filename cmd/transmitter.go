@@ -2,17 +2,29 @@ package cmd
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/smarthall/webhook-relay/internal/blob"
+	"github.com/smarthall/webhook-relay/internal/breaker"
+	"github.com/smarthall/webhook-relay/internal/dedup"
+	"github.com/smarthall/webhook-relay/internal/envelope"
 	"github.com/smarthall/webhook-relay/internal/messaging"
+	"github.com/smarthall/webhook-relay/internal/ratelimit"
+	"github.com/smarthall/webhook-relay/internal/signature"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -24,97 +36,684 @@ func init() {
 	transmitterCmd.Flags().String("queue-name", "", "Name of the queue to use (durable, non-exclusive)")
 	viper.BindPFlag("queue-name", transmitterCmd.Flags().Lookup("queue-name"))
 
+	transmitterCmd.Flags().StringArray("match", nil, "Bind with a header match for headers exchanges, as header=value (repeatable)")
+	viper.BindPFlag("match", transmitterCmd.Flags().Lookup("match"))
+
+	transmitterCmd.Flags().String("match-type", "all", "Whether all or any of the --match headers must match")
+	viper.BindPFlag("match-type", transmitterCmd.Flags().Lookup("match-type"))
+
+	transmitterCmd.Flags().String("queue-type", "", "Queue type: classic, quorum or stream (default is the broker default)")
+	viper.BindPFlag("queue-type", transmitterCmd.Flags().Lookup("queue-type"))
+
+	transmitterCmd.Flags().Duration("queue-message-ttl", 0, "Discard queued messages older than this (0 disables)")
+	viper.BindPFlag("queue-message-ttl", transmitterCmd.Flags().Lookup("queue-message-ttl"))
+
+	transmitterCmd.Flags().Int("queue-max-length", 0, "Maximum number of ready messages in the queue (0 disables)")
+	viper.BindPFlag("queue-max-length", transmitterCmd.Flags().Lookup("queue-max-length"))
+
+	transmitterCmd.Flags().Int("queue-max-length-bytes", 0, "Maximum total size in bytes of ready messages in the queue (0 disables)")
+	viper.BindPFlag("queue-max-length-bytes", transmitterCmd.Flags().Lookup("queue-max-length-bytes"))
+
+	transmitterCmd.Flags().String("queue-overflow", "", "Behaviour when a queue limit is reached: drop-head, reject-publish or reject-publish-dlx")
+	viper.BindPFlag("queue-overflow", transmitterCmd.Flags().Lookup("queue-overflow"))
+
+	transmitterCmd.Flags().Bool("queue-single-active-consumer", false, "Only deliver to one consumer of the queue at a time")
+	viper.BindPFlag("queue-single-active-consumer", transmitterCmd.Flags().Lookup("queue-single-active-consumer"))
+
+	transmitterCmd.Flags().Int("prefetch", 0, "Maximum unacknowledged messages; enables manual acknowledgement (0 uses auto-ack, except for streams)")
+	viper.BindPFlag("prefetch", transmitterCmd.Flags().Lookup("prefetch"))
+
+	transmitterCmd.Flags().String("stream-offset", "", "Where to start consuming a stream queue: first, last, next, an offset, an RFC 3339 timestamp or a duration ago (e.g. 24h)")
+	viper.BindPFlag("stream-offset", transmitterCmd.Flags().Lookup("stream-offset"))
+
+	transmitterCmd.Flags().String("stream-offset-file", "", "File used to persist the last delivered stream offset; takes precedence over --stream-offset once written")
+	viper.BindPFlag("stream-offset-file", transmitterCmd.Flags().Lookup("stream-offset-file"))
+
 	transmitterCmd.Flags().String("send-to", "http://localhost:8000", "URI to send webhooks to")
 	viper.BindPFlag("send-to", transmitterCmd.Flags().Lookup("send-to"))
 
 	transmitterCmd.Flags().Bool("insecure", false, "Skip SSL verification")
 	viper.BindPFlag("insecure", transmitterCmd.Flags().Lookup("insecure"))
 
-	transmitterCmd.Flags().Bool("extra-headers", true, "Send extra headers to the webhook host")
+	transmitterCmd.Flags().Bool("extra-headers", true, "Send the Relay-Original-Path, Relay-Original-Host, Relay-Message-Id and Idempotency-Key headers to the webhook host; when disabled, the webhook-id of a --sign-key signature is the only message ID sent")
 	viper.BindPFlag("extra-headers", transmitterCmd.Flags().Lookup("extra-headers"))
 
 	transmitterCmd.Flags().Bool("preserve-host", false, "Preserve the original host header in the request")
 	viper.BindPFlag("preserve-host", transmitterCmd.Flags().Lookup("preserve-host"))
 
+	transmitterCmd.Flags().Bool("skip-processed", false, "Remember delivered message IDs and skip redeliveries of them")
+	viper.BindPFlag("skip-processed", transmitterCmd.Flags().Lookup("skip-processed"))
+
+	transmitterCmd.Flags().Duration("processed-ttl", 24*time.Hour, "How long delivered message IDs are remembered")
+	viper.BindPFlag("processed-ttl", transmitterCmd.Flags().Lookup("processed-ttl"))
+
+	transmitterCmd.Flags().Int("processed-size", 100000, "Maximum number of delivered message IDs remembered")
+	viper.BindPFlag("processed-size", transmitterCmd.Flags().Lookup("processed-size"))
+
+	transmitterCmd.Flags().String("processed-file", "", "Journal file that persists delivered message IDs across restarts (in-memory only when empty)")
+	viper.BindPFlag("processed-file", transmitterCmd.Flags().Lookup("processed-file"))
+
+	transmitterCmd.Flags().Float64("rate-limit", 0, "Maximum requests per second to each destination host (0 disables)")
+	viper.BindPFlag("rate-limit", transmitterCmd.Flags().Lookup("rate-limit"))
+
+	transmitterCmd.Flags().Int("rate-burst", 1, "Requests that may be sent to a destination host at once before --rate-limit applies")
+	viper.BindPFlag("rate-burst", transmitterCmd.Flags().Lookup("rate-burst"))
+
+	transmitterCmd.Flags().Int("max-in-flight", 0, "Maximum concurrent requests to each destination host (0 disables)")
+	viper.BindPFlag("max-in-flight", transmitterCmd.Flags().Lookup("max-in-flight"))
+
+	transmitterCmd.Flags().Int("concurrency", 1, "Number of messages delivered concurrently")
+	viper.BindPFlag("concurrency", transmitterCmd.Flags().Lookup("concurrency"))
+
+	transmitterCmd.Flags().Bool("circuit-breaker", false, "Pause delivery to a destination host while too many requests to it fail")
+	viper.BindPFlag("circuit-breaker", transmitterCmd.Flags().Lookup("circuit-breaker"))
+
+	transmitterCmd.Flags().Float64("breaker-failure-ratio", 0.5, "Fraction of failed requests that opens a destination's circuit breaker")
+	viper.BindPFlag("breaker-failure-ratio", transmitterCmd.Flags().Lookup("breaker-failure-ratio"))
+
+	transmitterCmd.Flags().Int("breaker-min-requests", 10, "Requests a destination must see in the window before its breaker can open")
+	viper.BindPFlag("breaker-min-requests", transmitterCmd.Flags().Lookup("breaker-min-requests"))
+
+	transmitterCmd.Flags().Duration("breaker-window", time.Minute, "Period over which a destination's failures are counted")
+	viper.BindPFlag("breaker-window", transmitterCmd.Flags().Lookup("breaker-window"))
+
+	transmitterCmd.Flags().Duration("breaker-cooldown", 30*time.Second, "How long an open breaker waits before probing the destination again")
+	viper.BindPFlag("breaker-cooldown", transmitterCmd.Flags().Lookup("breaker-cooldown"))
+
+	transmitterCmd.Flags().Int("max-redeliveries", 10, "Times a message failing with a connection error, 5xx or 429 is requeued under --circuit-breaker before it is rejected to the dead letter exchange (0 means no limit)")
+	viper.BindPFlag("max-redeliveries", transmitterCmd.Flags().Lookup("max-redeliveries"))
+
 	rootCmd.AddCommand(transmitterCmd)
 }
 
+// transmitOptions controls how deliveries are sent to the destination.
+type transmitOptions struct {
+	sendTo       string
+	extraHeaders bool
+	preserveHost bool
+	// routes may override sendTo per original request path.
+	routes routeTable
+	// processed remembers IDs of messages delivered successfully, so
+	// redeliveries can be skipped. Nil disables skipping.
+	processed *dedup.Cache
+	// breakers holds a circuit breaker per destination host. Nil disables
+	// them.
+	breakers *breaker.Set
+	// limits holds the outbound rate limiter per destination host, created
+	// from limit and the route's overrides. Nil disables limiting.
+	limits *ratelimit.Set
+	limit  ratelimit.Config
+	// blobs holds bodies the receiver offloaded. Nil if none is configured.
+	blobs blob.Store
+	// keys decrypts encrypted messages. Nil if none are configured, in
+	// which case messages must be unencrypted.
+	keys *envelope.Keyring
+	// allowPlaintext accepts unencrypted messages even with keys.
+	allowPlaintext bool
+	// signer signs deliveries on routes without their own signer. Nil
+	// leaves them unsigned.
+	signer *signature.StandardSigner
+}
+
+// destination returns where the message should be sent and the limits that
+// apply to it.
+func (o transmitOptions) destination(reqmsg messaging.RequestMessage) (string, ratelimit.Config) {
+	route := o.routes.match(reqmsg.Path)
+	sendTo, limit := o.sendTo, o.limit
+	if route.SendTo != "" {
+		sendTo = route.SendTo
+	}
+	if route.RateLimit > 0 {
+		limit.Rate = route.RateLimit
+	}
+	if route.RateBurst > 0 {
+		limit.Burst = route.RateBurst
+	}
+	if route.MaxInFlight > 0 {
+		limit.MaxInFlight = route.MaxInFlight
+	}
+	return sendTo, limit
+}
+
+// checkLimits rejects routes that send to the same host with different
+// outbound limits. Limiters are kept per host, so only the limits of
+// whichever route sent first would apply.
+func (o transmitOptions) checkLimits() error {
+	// The empty path stands for webhooks no route matches, unless a route
+	// catches everything.
+	paths := []string{""}
+	for _, route := range o.routes {
+		if route.Path == "/" {
+			paths = paths[1:]
+		}
+		paths = append(paths, route.Path)
+	}
+
+	type use struct {
+		path  string
+		limit ratelimit.Config
+	}
+	hosts := map[string]use{}
+	for _, path := range paths {
+		sendTo, limit := o.destination(messaging.RequestMessage{Path: path})
+		u, err := url.Parse(sendTo)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		if path == "" {
+			path = "--send-to"
+		}
+		if prev, ok := hosts[u.Host]; ok && prev.limit != limit {
+			return fmt.Errorf("%s and %s send to %s with different rate-limit, rate-burst or max-in-flight; limits apply per host, so they must match", prev.path, path, u.Host)
+		}
+		hosts[u.Host] = use{path: path, limit: limit}
+	}
+	return nil
+}
+
+// limited reports whether any outbound limit is configured, globally or on a
+// route.
+func (o transmitOptions) limited() bool {
+	if o.limit.Rate > 0 || o.limit.MaxInFlight > 0 {
+		return true
+	}
+	for _, route := range o.routes {
+		if route.RateLimit > 0 || route.MaxInFlight > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// breakerOpenError is returned when a message was not sent because its
+// destination's circuit breaker is open.
+type breakerOpenError struct {
+	host string
+	wait time.Duration
+}
+
+func (e *breakerOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for %s is open, retry in %s", e.host, e.wait.Round(time.Second))
+}
+
+// retryableError is returned when the destination failed in a way that may
+// succeed later: a connection error, a server error or throttling.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+
+func (e *retryableError) Unwrap() error { return e.err }
+
+// redeliveries counts how often messages have been requeued, so that one
+// the destination always fails can't become the breaker's probe forever.
+// Quorum queues count deliveries in x-delivery-count; for other queues the
+// requeues are counted in memory.
+type redeliveries struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newRedeliveries() *redeliveries {
+	return &redeliveries{counts: make(map[string]int)}
+}
+
+func redeliveryKey(msg amqp.Delivery) string {
+	if msg.MessageId != "" {
+		return msg.MessageId
+	}
+	sum := sha256.Sum256(msg.Body)
+	return hex.EncodeToString(sum[:])
+}
+
+// requeue records that msg is about to be requeued and returns how many
+// times it will have been.
+func (r *redeliveries) requeue(msg amqp.Delivery) int {
+	switch n := msg.Headers["x-delivery-count"].(type) {
+	case int64:
+		return int(n) + 1
+	case int32:
+		return int(n) + 1
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := redeliveryKey(msg)
+	r.counts[key]++
+	return r.counts[key]
+}
+
+// forget drops the count of a message that has been settled.
+func (r *redeliveries) forget(msg amqp.Delivery) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.counts, redeliveryKey(msg))
+}
+
+// messageID returns a stable ID for the delivery. Messages from older
+// receivers carry no ID, so one is derived from the delivery body, which is
+// identical across redeliveries.
+func messageID(msg amqp.Delivery, reqmsg messaging.RequestMessage) string {
+	if reqmsg.ID != "" {
+		return reqmsg.ID
+	}
+	if msg.MessageId != "" {
+		return msg.MessageId
+	}
+	sum := sha256.Sum256(msg.Body)
+	return hex.EncodeToString(sum[:16])
+}
+
 // processDelivery handles a single AMQP delivery: it unmarshals the message and
-// sends the contained HTTP request to the destination host.
-func processDelivery(msg amqp.Delivery, client *http.Client, sendTo string, extraHeaders bool, preserveHost bool) error {
+// sends the contained HTTP request to the destination host. ctx bounds only
+// the wait for the destination's rate limit, not the request itself.
+func processDelivery(ctx context.Context, msg amqp.Delivery, client *http.Client, opts transmitOptions) error {
+	body, err := messaging.DeliveryBody(msg, opts.keys)
+	if errors.Is(err, messaging.ErrUnencrypted) && opts.allowPlaintext {
+		body, err = msg.Body, nil
+	}
+	if err != nil {
+		return err
+	}
 	var reqmsg messaging.RequestMessage
-	if err := json.Unmarshal(msg.Body, &reqmsg); err != nil {
+	if err := json.Unmarshal(body, &reqmsg); err != nil {
 		return fmt.Errorf("failed to unmarshal message: %w", err)
 	}
+	id := messageID(msg, reqmsg)
+
+	if opts.processed != nil && opts.processed.Contains(id) {
+		log.Printf("Skipping already delivered message %s", id)
+		return nil
+	}
 
+	sendTo, limit := opts.destination(reqmsg)
 	req, err := reqmsg.ToHTTPRequest(sendTo)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
+	if reqmsg.BodyRef != "" {
+		open := func() (io.ReadCloser, error) { return reqmsg.OpenBody(ctx, opts.blobs) }
+		body, err := open()
+		if err != nil {
+			return fmt.Errorf("failed to open offloaded body: %w", err)
+		}
+		req.Body, req.GetBody, req.ContentLength = body, open, reqmsg.BodySize
+	}
+	// client.Do closes the body; close it here if the message is held back
+	// before it is sent.
+	sent := false
+	defer func() {
+		if !sent {
+			req.Body.Close()
+		}
+	}()
+
+	if opts.limits != nil {
+		release, err := opts.limits.Get(req.URL.Host, limit).Acquire(ctx)
+		if err != nil {
+			return fmt.Errorf("waiting for rate limit: %w", err)
+		}
+		defer release()
+	}
+
+	var cb *breaker.Breaker
+	if opts.breakers != nil {
+		cb = opts.breakers.Get(req.URL.Host)
+		if wait, ok := cb.Allow(); !ok {
+			return &breakerOpenError{host: req.URL.Host, wait: wait}
+		}
+		// A request held back before it is sent has no outcome to record,
+		// but may be the half-open breaker's probe.
+		defer func() {
+			if !sent {
+				cb.Cancel()
+			}
+		}()
+	}
 
-	if extraHeaders {
+	if opts.extraHeaders {
 		req.Header.Set("Relay-Original-Path", reqmsg.Path)
 		req.Header["Relay-Original-Host"] = []string{reqmsg.Host}
+		req.Header.Set("Relay-Message-Id", id)
+		req.Header.Set("Idempotency-Key", id)
 	}
 
-	if preserveHost {
+	if opts.preserveHost {
 		req.Host = reqmsg.Host
 	}
 
+	if err := opts.signRequest(req, reqmsg, id); err != nil {
+		return fmt.Errorf("failed to sign request: %w", err)
+	}
+
 	log.Printf("Sending request to: %s", req.URL.String())
+	sent = true
 	response, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		if cb != nil {
+			cb.Record(false)
+		}
+		return &retryableError{fmt.Errorf("failed to send request: %w", err)}
 	}
+	defer response.Body.Close()
 	log.Printf("Received response: %s", response.Status)
+
+	// Server errors and throttling mean the destination is struggling;
+	// other client errors are problems with the message itself.
+	struggling := response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+	if cb != nil {
+		cb.Record(!struggling)
+	}
+	if struggling {
+		return &retryableError{fmt.Errorf("destination responded %s", response.Status)}
+	}
+
+	if opts.processed != nil && response.StatusCode >= 200 && response.StatusCode < 300 {
+		if err := opts.processed.Add(id); err != nil {
+			log.Printf("Failed to record delivered message %s: %v", id, err)
+		}
+	}
 	return nil
 }
 
+// deliver processes msg, holding on to it while its destination's circuit
+// breaker is open so that consumption pauses until the destination recovers.
+// It gives up and returns the breaker error if ctx is cancelled first.
+func deliver(ctx context.Context, msg amqp.Delivery, client *http.Client, opts transmitOptions) error {
+	for {
+		err := processDelivery(ctx, msg, client, opts)
+		var open *breakerOpenError
+		if !errors.As(err, &open) {
+			return err
+		}
+		log.Printf("Pausing delivery: %v", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(open.wait):
+		}
+	}
+}
+
+// streamRetryMin and streamRetryMax bound the back-off between attempts at
+// a failed stream message.
+var (
+	streamRetryMin = time.Second
+	streamRetryMax = time.Minute
+)
+
+// redeliverStream retries a stream message whose delivery failed with a
+// retryable error until it is delivered, backing off between attempts. A
+// queue's failed messages are nacked, but committing a later stream offset
+// would skip this one. It returns the last error if ctx is cancelled or the
+// failure isn't retryable.
+func redeliverStream(ctx context.Context, msg amqp.Delivery, client *http.Client, opts transmitOptions, err error) error {
+	backoff := streamRetryMin
+	for {
+		var retry *retryableError
+		if !errors.As(err, &retry) {
+			return err
+		}
+		log.Printf("Failed to deliver stream message, retrying in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, streamRetryMax)
+		err = deliver(ctx, msg, client, opts)
+	}
+}
+
 var transmitterCmd = &cobra.Command{
 	Use:   "transmitter",
 	Short: "Transmitter listens to RabbitMQ and sends webhooks to a host",
 	Long:  `Transmitter listens to RabbitMQ and sends webhooks to a host.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		sub := messaging.NewSubscriber(viper.GetString("amqp"), viper.GetString("key"), viper.GetString("queue-name"))
+		exchange, err := exchangeConfig()
+		if err != nil {
+			log.Fatalf("Invalid exchange configuration: %s", err)
+		}
+		match := map[string]string{}
+		for _, m := range viper.GetStringSlice("match") {
+			name, value, err := messaging.ParseHeaderMatch(m)
+			if err != nil {
+				log.Fatalf("Invalid --match: %s", err)
+			}
+			match[name] = value
+		}
+		matchType := viper.GetString("match-type")
+		if matchType != "all" && matchType != "any" {
+			log.Fatalf("Invalid --match-type %q: want all or any", matchType)
+		}
+
+		streamOffset, err := messaging.ParseStreamOffset(viper.GetString("stream-offset"), time.Now())
+		if err != nil {
+			log.Fatalf("Invalid --stream-offset: %s", err)
+		}
+		var offsets *messaging.OffsetFile
+		if path := viper.GetString("stream-offset-file"); path != "" {
+			offsets = messaging.NewOffsetFile(path)
+			committed, ok, err := offsets.Load()
+			if err != nil {
+				log.Fatalf("Failed to load stream offset: %s", err)
+			}
+			if ok {
+				log.Printf("Resuming stream after committed offset %d", committed)
+				streamOffset = committed + 1
+			}
+		}
+
+		routes, err := loadRoutes()
+		if err != nil {
+			log.Fatalf("Invalid configuration: %s", err)
+		}
+
+		blobs, err := openBlobStore()
+		if err != nil {
+			log.Fatalf("Failed to open blob store: %s", err)
+		}
+
+		opts := transmitOptions{
+			sendTo:       viper.GetString("send-to"),
+			extraHeaders: viper.GetBool("extra-headers"),
+			preserveHost: viper.GetBool("preserve-host"),
+			routes:       routes,
+			limit: ratelimit.Config{
+				Rate:        viper.GetFloat64("rate-limit"),
+				Burst:       viper.GetInt("rate-burst"),
+				MaxInFlight: viper.GetInt("max-in-flight"),
+			},
+		}
+		if opts.limited() {
+			if err := opts.checkLimits(); err != nil {
+				log.Fatalf("Invalid routes: %s", err)
+			}
+			opts.limits = ratelimit.NewSet()
+		}
+		if err := loadSigners(&opts); err != nil {
+			log.Fatalf("Invalid signing configuration: %s", err)
+		}
+		if opts.keys, err = loadKeyring(); err != nil {
+			log.Fatalf("Failed to load encryption keys: %s", err)
+		}
+		opts.allowPlaintext = viper.GetBool("allow-plaintext")
+		if blobs != nil {
+			opts.blobs = blobs
+		}
+
+		concurrency := viper.GetInt("concurrency")
+		if concurrency < 1 {
+			log.Fatalf("Invalid --concurrency %d: must be at least 1", concurrency)
+		}
+		if concurrency > 1 && offsets != nil {
+			log.Fatalf("--stream-offset-file requires --concurrency 1 so offsets are committed in order")
+		}
+
+		// Messages waiting on a rate limit, a circuit breaker or a worker
+		// should stay in RabbitMQ rather than buffer in memory, so limit the
+		// prefetch to what the workers can hold. This also turns on manual
+		// acknowledgement, which the circuit breaker needs to hand messages
+		// back for retrying.
+		prefetch := viper.GetInt("prefetch")
+		if prefetch == 0 && (opts.limits != nil || concurrency > 1 || viper.GetBool("circuit-breaker")) {
+			prefetch = concurrency
+		}
+
+		connCfg := connectionConfig(cmd.Name())
+		if err := connCfg.Validate(); err != nil {
+			log.Fatalf("Invalid AMQP configuration: %s", err)
+		}
+		connCfg.Properties["queue_name"] = viper.GetString("queue-name")
+
+		subCfg := messaging.SubscriberConfig{
+			Exchange:  exchange,
+			Key:       viper.GetString("key"),
+			QueueName: viper.GetString("queue-name"),
+			Match:     match,
+			MatchAny:  matchType == "any",
+			Queue: messaging.QueueArguments{
+				Type:                 viper.GetString("queue-type"),
+				MessageTTL:           viper.GetDuration("queue-message-ttl"),
+				MaxLength:            viper.GetInt("queue-max-length"),
+				MaxLengthBytes:       viper.GetInt("queue-max-length-bytes"),
+				Overflow:             viper.GetString("queue-overflow"),
+				SingleActiveConsumer: viper.GetBool("queue-single-active-consumer"),
+			},
+			Prefetch:     prefetch,
+			StreamOffset: streamOffset,
+			ConsumerTag:  connCfg.Name,
+		}
+		if err := subCfg.Validate(); err != nil {
+			log.Fatalf("Invalid subscription: %s", err)
+		}
+		sub := messaging.NewSubscriber(connCfg, subCfg)
 		msgs, err := sub.Subscribe()
 		if err != nil {
 			log.Panicf("Failed to consume messages: %s", err)
 		}
 
+		if viper.GetBool("skip-processed") {
+			size, ttl := viper.GetInt("processed-size"), viper.GetDuration("processed-ttl")
+			if path := viper.GetString("processed-file"); path != "" {
+				if opts.processed, err = dedup.Open(path, size, ttl); err != nil {
+					log.Fatalf("Failed to open processed message journal: %s", err)
+				}
+				defer opts.processed.Close()
+			} else {
+				opts.processed = dedup.New(size, ttl)
+			}
+		}
+
+		if viper.GetBool("circuit-breaker") {
+			opts.breakers = breaker.NewSet(breaker.Config{
+				FailureRatio: viper.GetFloat64("breaker-failure-ratio"),
+				MinRequests:  viper.GetInt("breaker-min-requests"),
+				Window:       viper.GetDuration("breaker-window"),
+				Cooldown:     viper.GetDuration("breaker-cooldown"),
+			})
+			registerHealth("circuit_breakers", func() interface{} { return opts.breakers.States() })
+		}
+
 		tr := &http.Transport{
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: viper.GetBool("insecure")},
 		}
 		client := &http.Client{Transport: tr}
 
+		stopAdmin := startAdminServer()
+		defer stopAdmin()
+
 		// Create a context that cancels on SIGINT or SIGTERM
 		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 		defer stop()
 
 		// Create and start a health checker. If the health checker signals
-		// failure the process will gracefully shut down.
-		hc := messaging.NewHealthChecker(viper.GetString("amqp"), 1*time.Second, 2*time.Second)
+		// failure the process will gracefully shut down and exit non-zero.
+		hc := messaging.NewHealthChecker(connCfg, 1*time.Second, 2*time.Second)
 		defer hc.Stop()
+		stopOnFailure(ctx, hc, stop)
 
-		// Process messages until the channel closes or we receive a shutdown signal
-		for {
-			select {
-			case <-ctx.Done():
-				log.Printf("shutdown signal received, stopping transmitter")
-				return
-			case <-hc.Failure:
-				log.Printf("healthcheck failure detected, initiating shutdown")
-				stop()
-				return
-			case msg, ok := <-msgs:
-				if !ok {
-					log.Printf("message channel closed, exiting")
+		requeues := newRedeliveries()
+		maxRedeliveries := viper.GetInt("max-redeliveries")
+
+		// Each worker processes messages until the channel closes or we
+		// receive a shutdown signal
+		work := func() {
+			for {
+				select {
+				case <-ctx.Done():
 					return
-				}
-				if err := processDelivery(msg, client, viper.GetString("send-to"), viper.GetBool("extra-headers"), viper.GetBool("preserve-host")); err != nil {
-					log.Printf("Failed to process message: %v", err)
-					continue
+				case msg, ok := <-msgs:
+					if !ok {
+						log.Printf("message channel closed, exiting")
+						failed.Store(true)
+						stop()
+						return
+					}
+					err := deliver(ctx, msg, client, opts)
+					offset, inStream := messaging.StreamOffsetOf(msg)
+					inStream = inStream && offsets != nil
+					if inStream {
+						err = redeliverStream(ctx, msg, client, opts, err)
+					}
+					if err != nil && ctx.Err() != nil {
+						// Shutting down while waiting on the destination:
+						// hand the message back.
+						if err := sub.Release(msg); err != nil {
+							log.Printf("Failed to release message: %v", err)
+						}
+						return
+					}
+					var retry *retryableError
+					if opts.breakers != nil && errors.As(err, &retry) {
+						// Hand the message back to be retried; the
+						// destination's breaker paces the retries.
+						if n := requeues.requeue(msg); maxRedeliveries == 0 || n <= maxRedeliveries {
+							log.Printf("Failed to deliver message, requeueing (%d): %v", n, err)
+							if err := sub.Release(msg); err != nil {
+								log.Printf("Failed to release message: %v", err)
+							}
+							continue
+						}
+						// Settling rejects it to the dead letter
+						// exchange, if the queue has one.
+						log.Printf("Giving up on message after %d redeliveries", maxRedeliveries)
+					}
+					requeues.forget(msg)
+					if err != nil {
+						log.Printf("Failed to process message: %v", err)
+					}
+					if err := sub.Settle(msg, err); err != nil {
+						log.Printf("Failed to acknowledge message: %v", err)
+					}
+					if !inStream {
+						continue
+					}
+					if err != nil {
+						// Committing a later offset would skip the
+						// message, so stop at it instead.
+						log.Printf("Stopping at undeliverable stream offset %d; write it to --stream-offset-file to skip it", offset)
+						failed.Store(true)
+						stop()
+						return
+					}
+					if err := offsets.Commit(offset); err != nil {
+						log.Printf("Failed to commit stream offset %d: %v", offset, err)
+					}
 				}
 			}
 		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				work()
+			}()
+		}
+		<-ctx.Done()
+		log.Printf("shutdown signal received, stopping transmitter")
+		wg.Wait()
 	},
 }
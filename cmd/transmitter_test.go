@@ -1,13 +1,27 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/smarthall/webhook-relay/internal/blob"
+	"github.com/smarthall/webhook-relay/internal/breaker"
+	"github.com/smarthall/webhook-relay/internal/dedup"
+	"github.com/smarthall/webhook-relay/internal/envelope"
 	"github.com/smarthall/webhook-relay/internal/messaging"
+	"github.com/smarthall/webhook-relay/internal/ratelimit"
+	"github.com/smarthall/webhook-relay/internal/signature"
+	"github.com/spf13/viper"
 )
 
 func TestProcessDelivery_HeadersAndHost(t *testing.T) {
@@ -54,7 +68,7 @@ func TestProcessDelivery_HeadersAndHost(t *testing.T) {
 			del := amqp.Delivery{Body: b}
 
 			client := srv.Client()
-			if err := processDelivery(del, client, srv.URL, tc.extraHeaders, tc.preserveHost); err != nil {
+			if err := processDelivery(context.Background(), del, client, transmitOptions{sendTo: srv.URL, extraHeaders: tc.extraHeaders, preserveHost: tc.preserveHost}); err != nil {
 				t.Fatalf("processDelivery returned error: %v", err)
 			}
 
@@ -89,3 +103,450 @@ func TestProcessDelivery_HeadersAndHost(t *testing.T) {
 		})
 	}
 }
+
+// TestProcessDelivery_Idempotency verifies that redeliveries carry the same
+// Idempotency-Key and are skipped once delivered when a processed-ID store
+// is configured.
+func TestProcessDelivery_Idempotency(t *testing.T) {
+	var keys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if r.Header.Get("Relay-Message-Id") != r.Header.Get("Idempotency-Key") {
+			t.Errorf("expected Relay-Message-Id to match Idempotency-Key")
+		}
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	b, err := json.Marshal(messaging.RequestMessage{ID: "msg-1", Method: "POST", Path: "/p", Body: "x"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	del := amqp.Delivery{Body: b}
+
+	// Without a store every redelivery is sent, with the same key.
+	opts := transmitOptions{sendTo: srv.URL, extraHeaders: true}
+	for i := 0; i < 2; i++ {
+		if err := processDelivery(context.Background(), del, srv.Client(), opts); err != nil {
+			t.Fatalf("processDelivery: %v", err)
+		}
+	}
+	if len(keys) != 2 || keys[0] != "msg-1" || keys[1] != "msg-1" {
+		t.Fatalf("expected two sends keyed msg-1, got %v", keys)
+	}
+
+	// With a store the redelivery is skipped.
+	keys = nil
+	opts.processed = dedup.New(10, time.Hour)
+	for i := 0; i < 2; i++ {
+		if err := processDelivery(context.Background(), del, srv.Client(), opts); err != nil {
+			t.Fatalf("processDelivery: %v", err)
+		}
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected one send, got %d", len(keys))
+	}
+
+	// Messages without an ID get a key derived from the delivery body.
+	legacy := amqp.Delivery{Body: []byte(`{"method":"POST","path":"/p","body":"x"}`)}
+	if messageID(legacy, messaging.RequestMessage{}) != messageID(legacy, messaging.RequestMessage{}) {
+		t.Fatalf("expected derived message ID to be stable")
+	}
+}
+
+// TestProcessDelivery_CircuitBreaker verifies that a failing destination opens
+// its breaker, which stops further sends until the cool-down has passed.
+func TestProcessDelivery_CircuitBreaker(t *testing.T) {
+	var sends int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sends++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	b, err := json.Marshal(messaging.RequestMessage{ID: "msg-1", Method: "POST", Path: "/p", Body: "x"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	del := amqp.Delivery{Body: b}
+
+	opts := transmitOptions{
+		sendTo:   srv.URL,
+		breakers: breaker.NewSet(breaker.Config{FailureRatio: 0.5, MinRequests: 2, Window: time.Minute, Cooldown: time.Hour}),
+	}
+	for i := 0; i < 2; i++ {
+		var retry *retryableError
+		if err := processDelivery(context.Background(), del, srv.Client(), opts); !errors.As(err, &retry) {
+			t.Fatalf("expected a retryable error for 503, got %v", err)
+		}
+	}
+
+	err = processDelivery(context.Background(), del, srv.Client(), opts)
+	var open *breakerOpenError
+	if !errors.As(err, &open) {
+		t.Fatalf("expected breaker to be open, got %v", err)
+	}
+	if sends != 2 {
+		t.Fatalf("expected no send while open, got %d sends", sends)
+	}
+	if state := opts.breakers.States()[open.host]; state != "open" {
+		t.Fatalf("expected %s to report open, got %q", open.host, state)
+	}
+
+	// deliver gives up waiting once the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := deliver(ctx, del, srv.Client(), opts); !errors.As(err, &open) {
+		t.Fatalf("expected deliver to return the breaker error, got %v", err)
+	}
+}
+
+// TestRedeliveries verifies that requeues are counted from quorum queues'
+// x-delivery-count, or in memory for other queues.
+func TestRedeliveries(t *testing.T) {
+	r := newRedeliveries()
+	quorum := amqp.Delivery{Headers: amqp.Table{"x-delivery-count": int64(4)}}
+	if n := r.requeue(quorum); n != 5 {
+		t.Fatalf("expected the broker's count to be used, got %d", n)
+	}
+
+	classic := amqp.Delivery{MessageId: "msg-1"}
+	for want := 1; want <= 3; want++ {
+		if n := r.requeue(classic); n != want {
+			t.Fatalf("expected requeue %d, got %d", want, n)
+		}
+	}
+	if n := r.requeue(amqp.Delivery{MessageId: "msg-2"}); n != 1 {
+		t.Fatalf("expected messages to be counted separately, got %d", n)
+	}
+	r.forget(classic)
+	if n := r.requeue(classic); n != 1 {
+		t.Fatalf("expected a settled message's count to be dropped, got %d", n)
+	}
+}
+
+// TestRedeliverStream verifies that a stream message is retried until it is
+// delivered, and that failures retrying can't fix are returned.
+func TestRedeliverStream(t *testing.T) {
+	defer func(lo, hi time.Duration) { streamRetryMin, streamRetryMax = lo, hi }(streamRetryMin, streamRetryMax)
+	streamRetryMin, streamRetryMax = time.Millisecond, 4*time.Millisecond
+
+	var sends int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sends++
+		if sends < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	b, err := json.Marshal(messaging.RequestMessage{ID: "msg-1", Method: "POST", Path: "/p", Body: "x"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	del := amqp.Delivery{Body: b}
+	opts := transmitOptions{sendTo: srv.URL}
+
+	err = processDelivery(context.Background(), del, srv.Client(), opts)
+	if err := redeliverStream(context.Background(), del, srv.Client(), opts, err); err != nil || sends != 3 {
+		t.Fatalf("expected delivery on the third attempt, got %v after %d sends", err, sends)
+	}
+
+	bad := amqp.Delivery{Body: []byte("not json")}
+	err = processDelivery(context.Background(), bad, srv.Client(), opts)
+	if err := redeliverStream(context.Background(), bad, srv.Client(), opts, err); err == nil || sends != 3 {
+		t.Fatalf("expected an undecodable message to fail without retrying, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	retry := &retryableError{errors.New("destination responded 503")}
+	if err := redeliverStream(ctx, del, srv.Client(), opts, retry); err != retry {
+		t.Fatalf("expected redelivery to stop once cancelled, got %v", err)
+	}
+}
+
+func TestTransmitOptionsDestination(t *testing.T) {
+	opts := transmitOptions{
+		sendTo: "http://default",
+		routes: routeTable{{Path: "/github", SendTo: "http://ci", MaxInFlight: 2}},
+		limit:  ratelimit.Config{Rate: 5, Burst: 10},
+	}
+	if got, _ := opts.destination(messaging.RequestMessage{Path: "/github/push"}); got != "http://ci" {
+		t.Fatalf("expected route destination, got %q", got)
+	}
+	if got, _ := opts.destination(messaging.RequestMessage{Path: "/stripe"}); got != "http://default" {
+		t.Fatalf("expected default destination, got %q", got)
+	}
+
+	// Route limits override the global ones field by field.
+	_, limit := opts.destination(messaging.RequestMessage{Path: "/github/push"})
+	if limit != (ratelimit.Config{Rate: 5, Burst: 10, MaxInFlight: 2}) {
+		t.Fatalf("unexpected route limit %+v", limit)
+	}
+	if !opts.limited() {
+		t.Fatalf("expected limits to be enabled")
+	}
+}
+
+func TestTransmitOptionsCheckLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		routes  routeTable
+		wantErr bool
+	}{
+		{name: "no-routes"},
+		{name: "other-host", routes: routeTable{{Path: "/github", SendTo: "http://ci", MaxInFlight: 2}}},
+		{name: "same-limits", routes: routeTable{
+			{Path: "/github", SendTo: "http://ci", MaxInFlight: 2},
+			{Path: "/gitlab", SendTo: "http://ci/hooks", MaxInFlight: 2},
+		}},
+		{name: "conflict", routes: routeTable{
+			{Path: "/github", SendTo: "http://ci", MaxInFlight: 2},
+			{Path: "/gitlab", SendTo: "http://ci/", MaxInFlight: 3},
+		}, wantErr: true},
+		{name: "conflicts-with-default", routes: routeTable{{Path: "/github", RateLimit: 1}}, wantErr: true},
+		{name: "catch-all", routes: routeTable{{Path: "/", RateLimit: 1}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := transmitOptions{sendTo: "http://default", routes: tc.routes, limit: ratelimit.Config{Rate: 5}}
+			if err := opts.checkLimits(); (err != nil) != tc.wantErr {
+				t.Fatalf("expected error=%v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestProcessDelivery_RateLimit verifies that sends to a destination wait for
+// its rate limit and that the wait is abandoned when the context ends.
+func TestProcessDelivery_RateLimit(t *testing.T) {
+	var sends int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sends++
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	b, err := json.Marshal(messaging.RequestMessage{Method: "POST", Path: "/p", Body: "x"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	del := amqp.Delivery{Body: b}
+
+	opts := transmitOptions{
+		sendTo: srv.URL,
+		limits: ratelimit.NewSet(),
+		limit:  ratelimit.Config{Rate: 0.001, Burst: 1},
+	}
+	if err := processDelivery(context.Background(), del, srv.Client(), opts); err != nil {
+		t.Fatalf("processDelivery: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := processDelivery(ctx, del, srv.Client(), opts); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the second send to wait for the rate limit, got %v", err)
+	}
+	if sends != 1 {
+		t.Fatalf("expected one send, got %d", sends)
+	}
+}
+
+// TestProcessDelivery_OffloadedBody verifies that a body the receiver moved to
+// the blob store is sent in full.
+func TestProcessDelivery_OffloadedBody(t *testing.T) {
+	store, err := blob.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	if err := store.Put(context.Background(), "msg-1", strings.NewReader("large body")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	var got string
+	var gotLength int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got, gotLength = string(b), r.ContentLength
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	b, err := json.Marshal(messaging.RequestMessage{ID: "msg-1", Method: "POST", Path: "/p", BodyRef: "msg-1", BodySize: 10})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	del := amqp.Delivery{Body: b}
+
+	if err := processDelivery(context.Background(), del, srv.Client(), transmitOptions{sendTo: srv.URL}); err == nil {
+		t.Fatalf("expected an error without a blob store")
+	}
+	if err := processDelivery(context.Background(), del, srv.Client(), transmitOptions{sendTo: srv.URL, blobs: store}); err != nil {
+		t.Fatalf("processDelivery: %v", err)
+	}
+	if got != "large body" || gotLength != 10 {
+		t.Fatalf("expected offloaded body with length 10, got %q (%d)", got, gotLength)
+	}
+}
+
+// TestProcessDelivery_Signing verifies that deliveries are signed per
+// Standard Webhooks with the route's keys, or the global ones.
+func TestProcessDelivery_Signing(t *testing.T) {
+	globalKey := "whsec_" + base64.StdEncoding.EncodeToString([]byte("global"))
+	routeKey := "whsec_" + base64.StdEncoding.EncodeToString([]byte("route"))
+	withConfig(t, `
+routes:
+  - path: /github
+    sign-keys: [env:RELAY_TEST_SIGN_KEY]
+`)
+	t.Setenv("RELAY_TEST_SIGN_KEY", routeKey)
+	viper.Set("sign-key", []string{globalKey})
+
+	routes, err := loadRoutes()
+	if err != nil {
+		t.Fatalf("loadRoutes: %v", err)
+	}
+	opts := transmitOptions{routes: routes}
+	if err := loadSigners(&opts); err != nil {
+		t.Fatalf("loadSigners: %v", err)
+	}
+
+	var got http.Header
+	var gotBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+	opts.sendTo = srv.URL
+
+	for path, key := range map[string]string{"/github/push": routeKey, "/stripe": globalKey} {
+		b, err := json.Marshal(messaging.RequestMessage{ID: "msg-1", Method: "POST", Path: path, Body: `{"a":1}`})
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		if err := processDelivery(context.Background(), amqp.Delivery{Body: b}, srv.Client(), opts); err != nil {
+			t.Fatalf("processDelivery: %v", err)
+		}
+		if got.Get("Webhook-Id") != "msg-1" || string(gotBody) != `{"a":1}` {
+			t.Fatalf("%s: unexpected request %v %q", path, got, gotBody)
+		}
+		v, err := signature.New("standard", []string{key})
+		if err != nil {
+			t.Fatalf("signature.New: %v", err)
+		}
+		if _, err := v.Verify(got, bytes.NewReader(gotBody)); err != nil {
+			t.Fatalf("%s: Verify: %v", path, err)
+		}
+	}
+}
+
+// TestProcessDelivery_Resign verifies that a route's resign setting replaces
+// the provider's signature with one made with the destination's secret.
+func TestProcessDelivery_Resign(t *testing.T) {
+	withConfig(t, `
+routes:
+  - path: /github
+    resign:
+      provider: github
+      secret: env:RELAY_TEST_RESIGN_SECRET
+`)
+	t.Setenv("RELAY_TEST_RESIGN_SECRET", "internal")
+	routes, err := loadRoutes()
+	if err != nil {
+		t.Fatalf("loadRoutes: %v", err)
+	}
+	opts := transmitOptions{routes: routes}
+	if err := loadSigners(&opts); err != nil {
+		t.Fatalf("loadSigners: %v", err)
+	}
+
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+	opts.sendTo = srv.URL
+
+	body := `{"action":"opened"}`
+	b, err := json.Marshal(messaging.RequestMessage{
+		Method:  "POST",
+		Path:    "/github/push",
+		Headers: map[string][]string{"X-Hub-Signature-256": {"sha256=0000"}, "X-Hub-Signature": {"sha1=0000"}},
+		Body:    body,
+	})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if err := processDelivery(context.Background(), amqp.Delivery{Body: b}, srv.Client(), opts); err != nil {
+		t.Fatalf("processDelivery: %v", err)
+	}
+
+	v, _ := signature.New("github", []string{"internal"})
+	if _, err := v.Verify(got, strings.NewReader(body)); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if got.Get("X-Hub-Signature") != "" {
+		t.Fatalf("expected the SHA-1 signature to be stripped")
+	}
+}
+
+// TestProcessDelivery_Encrypted verifies that messages encrypted by the
+// receiver are decrypted before being sent.
+func TestProcessDelivery_Encrypted(t *testing.T) {
+	priv, pub, err := envelope.Generate("k1", "x25519")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	sealer, _ := envelope.Parse(strings.NewReader(pub))
+	keys, _ := envelope.Parse(strings.NewReader(priv))
+
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got = string(b)
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	b, err := json.Marshal(messaging.RequestMessage{Method: "POST", Path: "/p", Body: "customer data"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	env, err := sealer.Seal(b)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	del := amqp.Delivery{
+		Headers: amqp.Table{
+			"relay-encryption":  env.Scheme,
+			"relay-key-id":      env.KeyID,
+			"relay-wrapped-key": base64.StdEncoding.EncodeToString(env.WrappedKey),
+		},
+		Body: env.Ciphertext,
+	}
+
+	if err := processDelivery(context.Background(), del, srv.Client(), transmitOptions{sendTo: srv.URL}); err == nil {
+		t.Fatalf("expected an error without keys")
+	}
+	if err := processDelivery(context.Background(), del, srv.Client(), transmitOptions{sendTo: srv.URL, keys: keys}); err != nil {
+		t.Fatalf("processDelivery: %v", err)
+	}
+	if got != "customer data" {
+		t.Fatalf("expected decrypted body, got %q", got)
+	}
+
+	// Unencrypted messages are refused unless plaintext is allowed.
+	plain := amqp.Delivery{Body: b}
+	if err := processDelivery(context.Background(), plain, srv.Client(), transmitOptions{sendTo: srv.URL, keys: keys}); !errors.Is(err, messaging.ErrUnencrypted) {
+		t.Fatalf("expected ErrUnencrypted, got %v", err)
+	}
+	got = ""
+	if err := processDelivery(context.Background(), plain, srv.Client(), transmitOptions{sendTo: srv.URL, keys: keys, allowPlaintext: true}); err != nil || got != "customer data" {
+		t.Fatalf("expected plaintext to be accepted, got %q (%v)", got, err)
+	}
+}
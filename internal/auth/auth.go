@@ -0,0 +1,188 @@
+// Package auth authenticates inbound webhook requests by bearer token, HTTP
+// Basic credentials, a secret in the query string or path, or a JWT.
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ErrUnauthorized is returned, possibly wrapped, when a request's credentials
+// are missing or wrong.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Authenticator checks the credentials on a request.
+type Authenticator interface {
+	// Authenticate returns nil if the request carries valid credentials.
+	Authenticate(r *http.Request) error
+	// Challenge is the WWW-Authenticate header value sent with a 401, or
+	// empty for none.
+	Challenge() string
+	// Strip removes the credentials from the request, so they are not
+	// logged or forwarded.
+	Strip(r *http.Request)
+}
+
+// Secret resolves a configured secret: "env:NAME" reads an environment
+// variable, "file:PATH" reads a file (trimming surrounding whitespace), and
+// anything else is used literally.
+func Secret(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, "env:"):
+		v, ok := os.LookupEnv(strings.TrimPrefix(s, "env:"))
+		if !ok || v == "" {
+			return "", fmt.Errorf("environment variable %s is not set", strings.TrimPrefix(s, "env:"))
+		}
+		return v, nil
+	case strings.HasPrefix(s, "file:"):
+		b, err := os.ReadFile(strings.TrimPrefix(s, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	default:
+		return s, nil
+	}
+}
+
+// Secrets resolves each of secrets with Secret.
+func Secrets(secrets []string) ([]string, error) {
+	out := make([]string, 0, len(secrets))
+	for _, s := range secrets {
+		v, err := Secret(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// Equal compares two secrets in constant time, without leaking their
+// lengths.
+func Equal(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// tokenSet matches a presented token against the accepted tokens. Several
+// tokens may be accepted at once so they can be rotated.
+type tokenSet []string
+
+func (ts tokenSet) check(token string) error {
+	if token == "" {
+		return fmt.Errorf("%w: no credentials", ErrUnauthorized)
+	}
+	ok := false
+	for _, t := range ts {
+		// Check every token so timing doesn't reveal which one matched.
+		if Equal(t, token) {
+			ok = true
+		}
+	}
+	if !ok {
+		return fmt.Errorf("%w: invalid credentials", ErrUnauthorized)
+	}
+	return nil
+}
+
+// Bearer accepts requests with "Authorization: Bearer <token>" for one of
+// its tokens.
+type Bearer struct {
+	Tokens []string
+}
+
+func (b Bearer) Authenticate(r *http.Request) error {
+	return tokenSet(b.Tokens).check(bearerToken(r))
+}
+
+func (Bearer) Challenge() string { return `Bearer realm="webhook-relay"` }
+
+func (Bearer) Strip(r *http.Request) { r.Header.Del("Authorization") }
+
+// bearerToken returns the token from the Authorization header, or "".
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// Basic accepts requests with HTTP Basic credentials matching Users, a map of
+// user name to password.
+type Basic struct {
+	Users map[string]string
+}
+
+func (b Basic) Authenticate(r *http.Request) error {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return fmt.Errorf("%w: no credentials", ErrUnauthorized)
+	}
+	want, known := b.Users[user]
+	// Compare even for unknown users so timing doesn't reveal which exist.
+	if !Equal(want, pass) || !known {
+		return fmt.Errorf("%w: invalid credentials for %q", ErrUnauthorized, user)
+	}
+	return nil
+}
+
+func (Basic) Challenge() string { return `Basic realm="webhook-relay"` }
+
+func (Basic) Strip(r *http.Request) { r.Header.Del("Authorization") }
+
+// Query accepts requests whose Param query parameter is one of Tokens.
+type Query struct {
+	Param  string
+	Tokens []string
+}
+
+func (q Query) Authenticate(r *http.Request) error {
+	return tokenSet(q.Tokens).check(r.URL.Query().Get(q.Param))
+}
+
+func (Query) Challenge() string { return "" }
+
+func (q Query) Strip(r *http.Request) {
+	query := r.URL.Query()
+	query.Del(q.Param)
+	r.URL.RawQuery = query.Encode()
+	r.RequestURI = r.URL.RequestURI()
+}
+
+// PathToken accepts requests whose path segment directly after Prefix is one
+// of Tokens, as in /hooks/<token>/....
+type PathToken struct {
+	Prefix string
+	Tokens []string
+}
+
+func (p PathToken) Authenticate(r *http.Request) error {
+	rest := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(p.Prefix, "/"))
+	segment, _, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	return tokenSet(p.Tokens).check(segment)
+}
+
+func (PathToken) Challenge() string { return "" }
+
+// Strip cuts the token segment out of the path, so /hooks/<token>/push
+// becomes /hooks/push.
+func (p PathToken) Strip(r *http.Request) {
+	prefix := strings.TrimSuffix(p.Prefix, "/")
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	path := prefix
+	if _, after, ok := strings.Cut(rest, "/"); ok {
+		path += "/" + after
+	}
+	if path == "" {
+		path = "/"
+	}
+	r.URL.Path, r.URL.RawPath = path, ""
+	r.RequestURI = r.URL.RequestURI()
+}
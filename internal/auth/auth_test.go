@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStaticAuthenticators(t *testing.T) {
+	tests := []struct {
+		name  string
+		auth  Authenticator
+		setup func(r *httptestRequest)
+		ok    bool
+	}{
+		{name: "bearer", auth: Bearer{Tokens: []string{"old", "new"}}, setup: header("Authorization", "Bearer new"), ok: true},
+		{name: "bearer-wrong", auth: Bearer{Tokens: []string{"old"}}, setup: header("Authorization", "Bearer nope")},
+		{name: "bearer-missing", auth: Bearer{Tokens: []string{"old"}}, setup: header("X-Other", "old")},
+		{name: "basic", auth: Basic{Users: map[string]string{"github": "s3cret"}}, setup: basic("github", "s3cret"), ok: true},
+		{name: "basic-wrong", auth: Basic{Users: map[string]string{"github": "s3cret"}}, setup: basic("github", "nope")},
+		{name: "basic-unknown-user", auth: Basic{Users: map[string]string{"github": "s3cret"}}, setup: basic("other", "")},
+		{name: "query", auth: Query{Param: "token", Tokens: []string{"abc"}}, setup: target("/hook?token=abc"), ok: true},
+		{name: "query-wrong", auth: Query{Param: "token", Tokens: []string{"abc"}}, setup: target("/hook?token=abd")},
+		{name: "path", auth: PathToken{Prefix: "/hooks", Tokens: []string{"abc"}}, setup: target("/hooks/abc/push"), ok: true},
+		{name: "path-wrong", auth: PathToken{Prefix: "/hooks/", Tokens: []string{"abc"}}, setup: target("/hooks/push/abc")},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &httptestRequest{target: "/hook"}
+			tc.setup(req)
+			err := tc.auth.Authenticate(req.build())
+			if tc.ok && err != nil {
+				t.Fatalf("expected success, got %v", err)
+			}
+			if !tc.ok && !errors.Is(err, ErrUnauthorized) {
+				t.Fatalf("expected ErrUnauthorized, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStrip(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://example.com/hooks/abc/push?token=abc&page=2", nil)
+	r.Header.Set("Authorization", "Bearer abc")
+
+	Bearer{}.Strip(r)
+	Query{Param: "token"}.Strip(r)
+	PathToken{Prefix: "/hooks/"}.Strip(r)
+
+	if r.Header.Get("Authorization") != "" {
+		t.Fatalf("expected Authorization to be removed")
+	}
+	if got := r.URL.RequestURI(); got != "/hooks/push?page=2" {
+		t.Fatalf("expected the token to be cut from the URL, got %q", got)
+	}
+
+	r = httptest.NewRequest("POST", "http://example.com/hooks/abc", nil)
+	PathToken{Prefix: "/hooks"}.Strip(r)
+	if r.URL.Path != "/hooks" {
+		t.Fatalf("expected /hooks, got %q", r.URL.Path)
+	}
+}
+
+// httptestRequest collects how a test request should be built.
+type httptestRequest struct {
+	target  string
+	headers [][2]string
+	user    *[2]string
+}
+
+func (h *httptestRequest) build() *http.Request {
+	r := httptest.NewRequest("POST", "http://example.com"+h.target, nil)
+	for _, kv := range h.headers {
+		r.Header.Set(kv[0], kv[1])
+	}
+	if h.user != nil {
+		r.SetBasicAuth(h.user[0], h.user[1])
+	}
+	return r
+}
+
+func header(name, value string) func(*httptestRequest) {
+	return func(r *httptestRequest) { r.headers = append(r.headers, [2]string{name, value}) }
+}
+
+func basic(user, pass string) func(*httptestRequest) {
+	return func(r *httptestRequest) { r.user = &[2]string{user, pass} }
+}
+
+func target(t string) func(*httptestRequest) {
+	return func(r *httptestRequest) { r.target = t }
+}
+
+func TestSecret(t *testing.T) {
+	t.Setenv("RELAY_TEST_SECRET", "from-env")
+	file := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for in, want := range map[string]string{
+		"literal":               "literal",
+		"env:RELAY_TEST_SECRET": "from-env",
+		"file:" + file:          "from-file",
+	} {
+		got, err := Secret(in)
+		if err != nil || got != want {
+			t.Fatalf("Secret(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := Secret("env:RELAY_TEST_UNSET"); err == nil {
+		t.Fatalf("expected error for unset variable")
+	}
+}
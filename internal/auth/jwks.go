@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// jwk is a JSON Web Key as found in a JWKS document.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// key is a parsed public key from a JWKS.
+type key struct {
+	kid string
+	alg string
+	pub crypto.PublicKey
+}
+
+// JWKS is a JSON Web Key Set loaded from a local file and reloaded when the
+// file changes.
+type JWKS struct {
+	file string
+
+	mu   sync.Mutex
+	keys []key
+	mod  time.Time
+}
+
+// NewJWKS loads the key set, returning an error if it can't be read or holds
+// no usable keys.
+func NewJWKS(file string) (*JWKS, error) {
+	j := &JWKS{file: file}
+	if _, err := j.Keys(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Keys returns the current keys, reloading the file if it has changed. If a
+// reload fails the previous keys stay in use.
+func (j *JWKS) Keys() ([]key, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	fi, err := os.Stat(j.file)
+	if err != nil {
+		if j.keys != nil {
+			return j.keys, nil
+		}
+		return nil, err
+	}
+	if j.keys != nil && fi.ModTime().Equal(j.mod) {
+		return j.keys, nil
+	}
+
+	keys, err := loadJWKS(j.file)
+	if err != nil {
+		if j.keys != nil {
+			return j.keys, nil
+		}
+		return nil, err
+	}
+	j.keys = keys
+	j.mod = fi.ModTime()
+	return j.keys, nil
+}
+
+func loadJWKS(file string) ([]key, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JWKS %s: %w", file, err)
+	}
+
+	var keys []key
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in %s: %w", k.Kid, file, err)
+		}
+		keys = append(keys, key{kid: k.Kid, alg: k.Alg, pub: pub})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys found in %s", file)
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("unsupported RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		if _, err := pub.ECDH(); err != nil {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return pub, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JWT accepts requests with a bearer JWT signed by a key in JWKS. The token
+// must not be expired, and must carry Issuer and Audience when they are set.
+type JWT struct {
+	JWKS     *JWKS
+	Issuer   string
+	Audience string
+	// Leeway allows for clock skew when checking exp and nbf.
+	Leeway time.Duration
+
+	now func() time.Time
+}
+
+func (j JWT) Challenge() string { return `Bearer realm="webhook-relay"` }
+
+func (JWT) Strip(r *http.Request) { r.Header.Del("Authorization") }
+
+func (j JWT) Authenticate(r *http.Request) error {
+	token := bearerToken(r)
+	if token == "" {
+		return fmt.Errorf("%w: no credentials", ErrUnauthorized)
+	}
+	if err := j.verify(token); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	return nil
+}
+
+// claims are the registered claims checked by JWT.
+type claims struct {
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+}
+
+// audience is the aud claim, which may be a string or a list of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return errors.New("aud must be a string or a list of strings")
+	}
+	*a = list
+	return nil
+}
+
+func (j JWT) verify(token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return fmt.Errorf("invalid header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.New("invalid signature encoding")
+	}
+
+	keys, err := j.JWKS.Keys()
+	if err != nil {
+		return err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range keys {
+		if header.Kid != "" && k.kid != header.Kid {
+			continue
+		}
+		if k.alg != "" && k.alg != header.Alg {
+			continue
+		}
+		if verifySignature(header.Alg, k.pub, signed, sig) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return fmt.Errorf("no key verifies the %s signature", header.Alg)
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return fmt.Errorf("invalid claims: %w", err)
+	}
+	return j.checkClaims(c)
+}
+
+func (j JWT) checkClaims(c claims) error {
+	now := time.Now()
+	if j.now != nil {
+		now = j.now()
+	}
+
+	if c.ExpiresAt == nil {
+		return errors.New("token has no expiry")
+	}
+	if now.After(unixTime(*c.ExpiresAt).Add(j.Leeway)) {
+		return errors.New("token has expired")
+	}
+	if c.NotBefore != nil && now.Before(unixTime(*c.NotBefore).Add(-j.Leeway)) {
+		return errors.New("token is not valid yet")
+	}
+	if j.Issuer != "" && c.Issuer != j.Issuer {
+		return fmt.Errorf("unexpected issuer %q", c.Issuer)
+	}
+	if j.Audience != "" {
+		found := false
+		for _, aud := range c.Audience {
+			if aud == j.Audience {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("token is not for audience %q", j.Audience)
+		}
+	}
+	return nil
+}
+
+func unixTime(secs float64) time.Time {
+	return time.Unix(0, int64(secs*float64(time.Second)))
+}
+
+func decodeSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verifySignature checks sig over signed with pub using the JWS algorithm
+// alg. The key type must suit the algorithm, so an RSA key can't be used to
+// verify an HMAC or ECDSA token.
+func verifySignature(alg string, pub crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		k, ok := pub.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(k, signed, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		switch alg[0] {
+		case 'R':
+			return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		case 'P':
+			return rsa.VerifyPSS(k, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(sig) != 2*size || size != ecSize(alg) {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return errors.New("key does not match algorithm")
+}
+
+// ecSize returns the coordinate size in bytes of the curve an ECDSA
+// algorithm requires.
+func ecSize(alg string) int {
+	switch alg {
+	case "ES256":
+		return 32
+	case "ES384":
+		return 48
+	default:
+		return 66
+	}
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+// signer signs JWTs for a test key and describes it as a JWK.
+type signer struct {
+	alg  string
+	jwk  map[string]string
+	sign func(signed []byte) []byte
+}
+
+func rsaSigner(t *testing.T, kid string) signer {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer{
+		alg: "RS256",
+		jwk: map[string]string{"kty": "RSA", "kid": kid, "n": b64.EncodeToString(k.N.Bytes()), "e": "AQAB"},
+		sign: func(signed []byte) []byte {
+			h := sha256.Sum256(signed)
+			sig, _ := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, h[:])
+			return sig
+		},
+	}
+}
+
+func ecSigner(t *testing.T, kid string) signer {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer{
+		alg: "ES256",
+		jwk: map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64.EncodeToString(k.X.FillBytes(make([]byte, 32))), "y": b64.EncodeToString(k.Y.FillBytes(make([]byte, 32)))},
+		sign: func(signed []byte) []byte {
+			h := sha256.Sum256(signed)
+			r, s, _ := ecdsa.Sign(rand.Reader, k, h[:])
+			return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		},
+	}
+}
+
+func edSigner(t *testing.T, kid string) signer {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer{
+		alg:  "EdDSA",
+		jwk:  map[string]string{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": b64.EncodeToString(pub)},
+		sign: func(signed []byte) []byte { return ed25519.Sign(priv, signed) },
+	}
+}
+
+func (s signer) token(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": s.alg, "kid": s.jwk["kid"], "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	return signed + "." + b64.EncodeToString(s.sign([]byte(signed)))
+}
+
+func writeJWKS(t *testing.T, signers ...signer) string {
+	var keys []map[string]string
+	for _, s := range signers {
+		keys = append(keys, s.jwk)
+	}
+	b, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestJWT(t *testing.T) {
+	rs, es, ed := rsaSigner(t, "rs"), ecSigner(t, "es"), edSigner(t, "ed")
+	stranger := ecSigner(t, "es")
+
+	jwks, err := NewJWKS(writeJWKS(t, rs, es, ed))
+	if err != nil {
+		t.Fatalf("NewJWKS: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	auth := JWT{JWKS: jwks, Issuer: "https://issuer", Audience: "relay", Leeway: time.Minute, now: func() time.Time { return now }}
+
+	valid := map[string]interface{}{"iss": "https://issuer", "aud": []string{"other", "relay"}, "exp": now.Add(time.Hour).Unix()}
+	with := func(k string, v interface{}) map[string]interface{} {
+		c := map[string]interface{}{}
+		for key, val := range valid {
+			c[key] = val
+		}
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{name: "rs256", token: rs.token(t, valid), ok: true},
+		{name: "es256", token: es.token(t, valid), ok: true},
+		{name: "eddsa", token: ed.token(t, valid), ok: true},
+		{name: "aud-string", token: es.token(t, with("aud", "relay")), ok: true},
+		{name: "within-leeway", token: es.token(t, with("exp", now.Add(-30*time.Second).Unix())), ok: true},
+		{name: "expired", token: es.token(t, with("exp", now.Add(-time.Hour).Unix()))},
+		{name: "no-expiry", token: es.token(t, with("exp", nil))},
+		{name: "not-yet-valid", token: es.token(t, with("nbf", now.Add(time.Hour).Unix()))},
+		{name: "wrong-issuer", token: es.token(t, with("iss", "https://evil"))},
+		{name: "wrong-audience", token: es.token(t, with("aud", "other"))},
+		{name: "unknown-key", token: stranger.token(t, valid)},
+		{name: "alg-none", token: strings.Join([]string{b64.EncodeToString([]byte(`{"alg":"none"}`)), b64.EncodeToString([]byte(`{}`)), ""}, ".")},
+		{name: "malformed", token: "abc"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/hook", nil)
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			err := auth.Authenticate(req)
+			if tc.ok && err != nil {
+				t.Fatalf("expected success, got %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatalf("expected rejection")
+			}
+		})
+	}
+}
+
+func TestJWKSInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(file, []byte(`{"keys":[{"kty":"EC","crv":"P-256","x":"AA","y":"AA"}]}`), 0o600)
+	if _, err := NewJWKS(file); err == nil {
+		t.Fatalf("expected error for a point not on the curve")
+	}
+}
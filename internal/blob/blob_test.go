@@ -0,0 +1,86 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+
+	if err := s.Put(ctx, "abc", strings.NewReader("payload")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	rc, err := s.Get(ctx, "abc")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	b, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(b) != "payload" {
+		t.Fatalf("expected payload, got %q", b)
+	}
+
+	if err := s.Delete(ctx, "abc"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get(ctx, "abc"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound after delete, got %v", err)
+	}
+	if err := s.Delete(ctx, "abc"); err != nil {
+		t.Fatalf("expected deleting a missing blob to succeed, got %v", err)
+	}
+
+	if err := s.Put(ctx, "../escape", strings.NewReader("x")); err == nil {
+		t.Fatalf("expected invalid key to be rejected")
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) { return 0, errors.New("too large") }
+
+func TestFileStorePutReadError(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := NewFileStore(dir)
+
+	r := io.MultiReader(strings.NewReader("partial"), failingReader{})
+	if err := s.Put(context.Background(), "abc", r); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("expected read error to be returned, got %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Fatalf("expected no files after failed put, have %d", len(entries))
+	}
+}
+
+func TestFileStorePrune(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := NewFileStore(dir)
+	ctx := context.Background()
+	s.Put(ctx, "old", strings.NewReader("x"))
+	s.Put(ctx, "new", strings.NewReader("x"))
+
+	past := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "old"), past, past); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	n, err := s.Prune(time.Now().Add(-24 * time.Hour))
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 pruned, got n=%d err=%v", n, err)
+	}
+	if _, err := s.Get(ctx, "new"); err != nil {
+		t.Fatalf("expected new blob to remain: %v", err)
+	}
+}
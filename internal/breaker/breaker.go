@@ -0,0 +1,189 @@
+// Package breaker implements a circuit breaker that stops sending to a
+// destination once too many requests to it fail, and probes it again after a
+// cool-down.
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the state of a Breaker.
+type State int
+
+const (
+	// Closed lets requests through while counting failures.
+	Closed State = iota
+	// Open rejects requests until the cool-down has passed.
+	Open
+	// HalfOpen lets a single probe request through to decide whether to
+	// close or re-open.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// Config controls when a Breaker opens and how long it stays open.
+type Config struct {
+	// FailureRatio opens the breaker when this fraction of requests in the
+	// current window have failed.
+	FailureRatio float64
+	// MinRequests is the number of requests a window must see before the
+	// failure ratio is considered.
+	MinRequests int
+	// Window is the period over which requests are counted.
+	Window time.Duration
+	// Cooldown is how long the breaker stays open before probing.
+	Cooldown time.Duration
+}
+
+// Breaker is a circuit breaker for a single destination. It is safe for
+// concurrent use.
+type Breaker struct {
+	cfg Config
+	now func() time.Time
+
+	mu          sync.Mutex
+	state       State
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probing     bool
+}
+
+func New(cfg Config) *Breaker {
+	return &Breaker{cfg: cfg, now: time.Now}
+}
+
+// Allow reports whether a request may be sent now. When it may not, it
+// returns how long to wait before asking again.
+func (b *Breaker) Allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		wait := b.openedAt.Add(b.cfg.Cooldown).Sub(b.now())
+		if wait > 0 {
+			return wait, false
+		}
+		b.state = HalfOpen
+		b.probing = true
+		return 0, true
+	case HalfOpen:
+		if b.probing {
+			// Another caller's probe is in flight.
+			return time.Second, false
+		}
+		b.probing = true
+		return 0, true
+	default:
+		return 0, true
+	}
+}
+
+// Record reports the outcome of a request allowed by Allow.
+func (b *Breaker) Record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	switch b.state {
+	case HalfOpen:
+		b.probing = false
+		if success {
+			b.state = Closed
+			b.resetWindow(now)
+		} else {
+			b.state = Open
+			b.openedAt = now
+		}
+	case Closed:
+		if now.Sub(b.windowStart) > b.cfg.Window {
+			b.resetWindow(now)
+		}
+		b.requests++
+		if !success {
+			b.failures++
+		}
+		if b.requests >= b.cfg.MinRequests && float64(b.failures)/float64(b.requests) >= b.cfg.FailureRatio {
+			b.state = Open
+			b.openedAt = now
+		}
+	}
+}
+
+// Cancel reports that a request allowed by Allow was not sent after all, so
+// it has no outcome to Record. A half-open breaker's probe is released for
+// the next caller; otherwise the half-open breaker would wait on it forever.
+func (b *Breaker) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == HalfOpen {
+		b.probing = false
+	}
+}
+
+// State returns the current state. An open breaker whose cool-down has
+// passed reports HalfOpen.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Open && !b.now().Before(b.openedAt.Add(b.cfg.Cooldown)) {
+		return HalfOpen
+	}
+	return b.state
+}
+
+func (b *Breaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+}
+
+// Set holds one Breaker per destination, created on first use.
+type Set struct {
+	cfg Config
+
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+func NewSet(cfg Config) *Set {
+	return &Set{cfg: cfg, breakers: make(map[string]*Breaker)}
+}
+
+// Get returns the breaker for key, creating it if needed.
+func (s *Set) Get(key string) *Breaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.breakers[key]
+	if !ok {
+		b = New(s.cfg)
+		s.breakers[key] = b
+	}
+	return b
+}
+
+// States returns the state of every breaker, keyed by destination.
+func (s *Set) States() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states := make(map[string]string, len(s.breakers))
+	for key, b := range s.breakers {
+		states[key] = b.State().String()
+	}
+	return states
+}
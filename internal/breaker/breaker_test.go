@@ -0,0 +1,110 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerLifecycle(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := New(Config{FailureRatio: 0.5, MinRequests: 4, Window: time.Minute, Cooldown: 30 * time.Second})
+	b.now = func() time.Time { return now }
+
+	// Failures below the minimum request count keep the breaker closed.
+	for i := 0; i < 3; i++ {
+		if _, ok := b.Allow(); !ok {
+			t.Fatalf("expected closed breaker to allow requests")
+		}
+		b.Record(false)
+	}
+	if b.State() != Closed {
+		t.Fatalf("expected closed, got %s", b.State())
+	}
+
+	b.Allow()
+	b.Record(false)
+	if b.State() != Open {
+		t.Fatalf("expected open after 4/4 failures, got %s", b.State())
+	}
+	if wait, ok := b.Allow(); ok || wait != 30*time.Second {
+		t.Fatalf("expected open breaker to reject for 30s, got ok=%v wait=%s", ok, wait)
+	}
+
+	// After the cool-down a single probe is allowed.
+	now = now.Add(30 * time.Second)
+	if b.State() != HalfOpen {
+		t.Fatalf("expected half-open after cool-down, got %s", b.State())
+	}
+	if _, ok := b.Allow(); !ok {
+		t.Fatalf("expected probe to be allowed")
+	}
+	if _, ok := b.Allow(); ok {
+		t.Fatalf("expected second request to wait for the probe")
+	}
+
+	// A failed probe re-opens the breaker.
+	b.Record(false)
+	if b.State() != Open {
+		t.Fatalf("expected failed probe to re-open, got %s", b.State())
+	}
+
+	now = now.Add(30 * time.Second)
+	b.Allow()
+	b.Record(true)
+	if b.State() != Closed {
+		t.Fatalf("expected successful probe to close, got %s", b.State())
+	}
+}
+
+func TestBreakerAbandonedProbe(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := New(Config{FailureRatio: 0.5, MinRequests: 1, Window: time.Minute, Cooldown: 30 * time.Second})
+	b.now = func() time.Time { return now }
+
+	b.Allow()
+	b.Record(false)
+	now = now.Add(30 * time.Second)
+	if _, ok := b.Allow(); !ok {
+		t.Fatalf("expected probe to be allowed")
+	}
+
+	// A probe that is never sent releases the breaker for the next one.
+	b.Cancel()
+	if _, ok := b.Allow(); !ok {
+		t.Fatalf("expected another probe once the first was abandoned")
+	}
+	b.Record(true)
+	if b.State() != Closed {
+		t.Fatalf("expected successful probe to close, got %s", b.State())
+	}
+}
+
+func TestBreakerWindowResets(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := New(Config{FailureRatio: 0.5, MinRequests: 2, Window: time.Minute, Cooldown: time.Second})
+	b.now = func() time.Time { return now }
+
+	b.Allow()
+	b.Record(false)
+
+	// The earlier failure falls out of the window.
+	now = now.Add(2 * time.Minute)
+	b.Allow()
+	b.Record(true)
+	b.Allow()
+	b.Record(false)
+	if b.State() != Open {
+		t.Fatalf("expected 1/2 failures in the new window to open, got %s", b.State())
+	}
+}
+
+func TestSetStates(t *testing.T) {
+	s := NewSet(Config{FailureRatio: 1, MinRequests: 1, Window: time.Minute, Cooldown: time.Minute})
+	s.Get("a.example.com").Record(false)
+	s.Get("b.example.com").Record(true)
+
+	states := s.States()
+	if states["a.example.com"] != "open" || states["b.example.com"] != "closed" {
+		t.Fatalf("unexpected states %v", states)
+	}
+}
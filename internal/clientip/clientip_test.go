@@ -0,0 +1,71 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	r, err := NewResolver([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{name: "direct", remote: "203.0.113.5:1234", want: "203.0.113.5"},
+		{name: "untrusted-proxy-ignored", remote: "203.0.113.5:1234", xff: []string{"198.51.100.1"}, want: "203.0.113.5"},
+		{name: "trusted-proxy", remote: "10.1.2.3:1234", xff: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "spoofed-left-entry", remote: "10.1.2.3:1234", xff: []string{"1.1.1.1, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "proxy-chain", remote: "10.1.2.3:1234", xff: []string{"198.51.100.1, 192.168.1.1", "10.9.9.9"}, want: "198.51.100.1"},
+		{name: "all-trusted", remote: "10.1.2.3:1234", xff: []string{"10.4.4.4"}, want: "10.4.4.4"},
+		{name: "malformed", remote: "10.1.2.3:1234", xff: []string{"198.51.100.1, junk"}, want: "10.1.2.3"},
+		{name: "ipv4-mapped", remote: "[::ffff:10.1.2.3]:1234", xff: []string{"2001:db8::1"}, want: "2001:db8::1"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", nil)
+			req.RemoteAddr = tc.remote
+			for _, v := range tc.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if got := r.ClientIP(req); got != tc.want {
+				t.Fatalf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestNilResolver(t *testing.T) {
+	var r *Resolver
+	req := httptest.NewRequest("POST", "/", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := r.ClientIP(req); got != "10.1.2.3" {
+		t.Fatalf("expected remote address, got %s", got)
+	}
+}
+
+func TestNewResolverInvalid(t *testing.T) {
+	if _, err := NewResolver([]string{"not-a-cidr"}); err == nil {
+		t.Fatalf("expected error for invalid proxy")
+	}
+}
+
+func TestNewResolverSkipsBlanks(t *testing.T) {
+	r, err := NewResolver([]string{" 10.0.0.0/8 ", "", "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, 10.1.2.3")
+	if got := r.ClientIP(req); got != "198.51.100.1" {
+		t.Fatalf("expected the forwarded client, got %s", got)
+	}
+}
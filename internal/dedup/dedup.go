@@ -0,0 +1,268 @@
+// Package dedup implements a seen-set used to suppress duplicate messages. It
+// is an LRU of keys that expire after a TTL, optionally backed by an
+// append-only journal file so the set survives restarts.
+package dedup
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache is a bounded, expiring set of keys. It is safe for concurrent use.
+type Cache struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	ll      *list.List // front is most recently added
+	items   map[string]*list.Element
+	path    string
+	journal *os.File
+	// appended counts journal lines written since the last compaction.
+	appended int
+}
+
+type entry struct {
+	key     string
+	expires time.Time
+}
+
+// New returns an in-memory cache holding at most size keys for ttl each.
+func New(size int, ttl time.Duration) *Cache {
+	return &Cache{
+		size:  size,
+		ttl:   ttl,
+		now:   time.Now,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Open returns a cache backed by the journal at path. Unexpired keys are
+// loaded from the journal, which is then compacted and appended to as keys
+// are added. The journal is compacted again whenever it grows to twice the
+// cache size.
+func Open(path string, size int, ttl time.Duration) (*Cache, error) {
+	c := New(size, ttl)
+	c.path = path
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	if err := c.rotate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Contains reports whether key was added and has not yet expired.
+func (c *Cache) Contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	if c.now().After(el.Value.(*entry).expires) {
+		c.remove(el)
+		return false
+	}
+	return true
+}
+
+// Add records key as seen, evicting the oldest key if the cache is full.
+func (c *Cache) Add(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := c.now().Add(c.ttl)
+	c.insert(key, expires)
+	return c.append(key, expires)
+}
+
+// AddIfAbsent records key as seen unless it already is, reporting whether it
+// was added. Unlike Contains followed by Add, only one of several concurrent
+// callers with the same key gets true. The key is held even if writing the
+// journal fails.
+func (c *Cache) AddIfAbsent(key string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		if !c.now().After(el.Value.(*entry).expires) {
+			return false, nil
+		}
+		c.remove(el)
+	}
+	expires := c.now().Add(c.ttl)
+	c.insert(key, expires)
+	return true, c.append(key, expires)
+}
+
+// Remove forgets key, so it is no longer seen.
+func (c *Cache) Remove(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	c.remove(el)
+	// A zero expiry in the journal removes the key when it is loaded.
+	return c.append(key, time.Unix(0, 0))
+}
+
+// append writes key to the journal, if any, compacting it once it has grown
+// to twice the cache size.
+func (c *Cache) append(key string, expires time.Time) error {
+	if c.journal == nil {
+		return nil
+	}
+	if _, err := fmt.Fprintln(c.journal, journalLine(key, expires)); err != nil {
+		return fmt.Errorf("failed to write dedup journal: %w", err)
+	}
+	c.appended++
+	if c.appended > 2*c.size {
+		if err := c.rotate(); err != nil {
+			return fmt.Errorf("failed to compact dedup journal: %w", err)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of keys held, including any not yet found expired.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Close closes the journal, if any.
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.journal == nil {
+		return nil
+	}
+	err := c.journal.Close()
+	c.journal = nil
+	return err
+}
+
+func (c *Cache) insert(key string, expires time.Time) {
+	if el, ok := c.items[key]; ok {
+		el.Value.(*entry).expires = expires
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&entry{key: key, expires: expires})
+
+	now := c.now()
+	for c.ll.Len() > 0 {
+		oldest := c.ll.Back()
+		if c.ll.Len() <= c.size && now.Before(oldest.Value.(*entry).expires) {
+			break
+		}
+		c.remove(oldest)
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*entry).key)
+}
+
+// journalLine formats a journal entry. Keys are quoted so that spaces and
+// newlines in them can't corrupt the journal or inject other keys.
+func journalLine(key string, expires time.Time) string {
+	return strconv.FormatInt(expires.UnixNano(), 10) + " " + strconv.Quote(key)
+}
+
+// load reads unexpired keys from the journal, if it exists. Later lines for a
+// key replace earlier ones.
+func (c *Cache) load() error {
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := c.now()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		ts, quoted, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		nanos, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			continue
+		}
+		key, err := strconv.Unquote(quoted)
+		if err != nil {
+			continue
+		}
+		if expires := time.Unix(0, nanos); now.Before(expires) {
+			c.insert(key, expires)
+		} else if el, ok := c.items[key]; ok {
+			c.remove(el)
+		}
+	}
+	return scanner.Err()
+}
+
+// rotate compacts the journal and reopens it for appending.
+func (c *Cache) rotate() error {
+	if c.journal != nil {
+		_ = c.journal.Close()
+		c.journal = nil
+	}
+	if err := c.compact(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(c.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	c.journal = f
+	c.appended = 0
+	return nil
+}
+
+// compact rewrites the journal with only the keys currently held, oldest
+// first.
+func (c *Cache) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for el := c.ll.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*entry)
+		fmt.Fprintln(w, journalLine(e.key, e.expires))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
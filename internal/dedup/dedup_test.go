@@ -0,0 +1,151 @@
+package dedup
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheExpiryAndEviction(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := New(2, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.Add("a")
+	c.Add("b")
+	if !c.Contains("a") || !c.Contains("b") {
+		t.Fatalf("expected a and b to be seen")
+	}
+
+	// Adding a third key evicts the oldest.
+	c.Add("c")
+	if c.Contains("a") {
+		t.Fatalf("expected a to be evicted")
+	}
+	if !c.Contains("c") {
+		t.Fatalf("expected c to be seen")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if c.Contains("b") || c.Contains("c") {
+		t.Fatalf("expected keys to expire after the TTL")
+	}
+}
+
+func TestCacheJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seen.journal")
+
+	c, err := Open(path, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for _, key := range []string{"one", "two", "three"} {
+		if err := c.Add(key); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	c, err = Open(path, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer c.Close()
+	for _, key := range []string{"one", "two", "three"} {
+		if !c.Contains(key) {
+			t.Fatalf("expected %q to survive a restart", key)
+		}
+	}
+	if c.Contains("four") {
+		t.Fatalf("did not expect an unseen key")
+	}
+
+	// The journal is compacted once it grows past twice the cache size.
+	for i := 0; i < 25; i++ {
+		if err := c.Add(string(rune('a' + i))); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if c.appended > 20 {
+		t.Fatalf("expected journal to be compacted, %d lines appended", c.appended)
+	}
+}
+
+func TestCacheAddIfAbsent(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := New(10, time.Minute)
+	c.now = func() time.Time { return now }
+
+	if added, _ := c.AddIfAbsent("a"); !added {
+		t.Fatalf("expected a to be added")
+	}
+	if added, _ := c.AddIfAbsent("a"); added {
+		t.Fatalf("expected a second add of a to be refused")
+	}
+	if err := c.Remove("a"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if added, _ := c.AddIfAbsent("a"); !added {
+		t.Fatalf("expected a to be added again once removed")
+	}
+	now = now.Add(2 * time.Minute)
+	if added, _ := c.AddIfAbsent("a"); !added {
+		t.Fatalf("expected an expired key to be added again")
+	}
+
+	// Only one of many concurrent callers adds a key.
+	var wg sync.WaitGroup
+	var added atomic.Int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := c.AddIfAbsent("b"); ok {
+				added.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if added.Load() != 1 {
+		t.Fatalf("expected exactly one caller to add b, got %d", added.Load())
+	}
+}
+
+// TestCacheJournalHostileKeys verifies that keys with spaces and newlines
+// survive a restart intact and can't inject other keys.
+func TestCacheJournalHostileKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seen.journal")
+	hostile := "a b\n9999999999999999999 injected"
+
+	c, err := Open(path, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for _, key := range []string{hostile, "removed"} {
+		if err := c.Add(key); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if err := c.Remove("removed"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	c, err = Open(path, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer c.Close()
+	if !c.Contains(hostile) {
+		t.Fatalf("expected the hostile key to survive a restart")
+	}
+	if c.Contains("injected") || c.Contains("removed") || c.Len() != 1 {
+		t.Fatalf("expected only the hostile key to be loaded, got %d keys", c.Len())
+	}
+}
@@ -0,0 +1,294 @@
+// Package envelope encrypts messages with per-message data keys, which are
+// wrapped either with a shared AES-256 key or sealed to an X25519 public key
+// so that only holders of the private key can decrypt.
+package envelope
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Schemes used to wrap data keys.
+const (
+	SchemeAES    = "aes256gcm"
+	SchemeX25519 = "x25519"
+)
+
+// Key types in key files.
+const (
+	TypeAES           = "aes256"
+	TypeX25519Public  = "x25519-public"
+	TypeX25519Private = "x25519-private"
+)
+
+// hkdfInfo separates the key derived for wrapping from other uses of the
+// shared secret.
+const hkdfInfo = "webhook-relay envelope v1"
+
+// ErrUnknownKey is returned when opening an envelope whose key isn't in the
+// keyring, or is only a public key.
+var ErrUnknownKey = errors.New("envelope key not available")
+
+// Envelope is an encrypted message.
+type Envelope struct {
+	// Scheme is how the data key is wrapped: SchemeAES or SchemeX25519.
+	Scheme string
+	// KeyID names the key that wrapped the data key.
+	KeyID string
+	// WrappedKey is the encrypted data key.
+	WrappedKey []byte
+	// Ciphertext is the message encrypted with the data key.
+	Ciphertext []byte
+}
+
+// key is one entry of a keyring.
+type key struct {
+	id   string
+	aes  []byte
+	priv *ecdh.PrivateKey
+	pub  *ecdh.PublicKey
+}
+
+// Keyring holds the keys used to seal and open envelopes. The first key
+// seals; all of them open, so old keys can be kept while rotating.
+type Keyring struct {
+	keys []key
+}
+
+// Load reads a keyring from a key file. Each line holds "<id> <type>
+// <base64 key>", where type is aes256, x25519-public or x25519-private.
+// Blank lines and lines starting with '#' are ignored.
+func Load(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Parse reads a keyring in the key file format.
+func Parse(r io.Reader) (*Keyring, error) {
+	kr := &Keyring{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: want <id> <type> <base64 key>", n)
+		}
+		k, err := parseKey(fields[0], fields[1], fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if seen[k.id] {
+			return nil, fmt.Errorf("line %d: duplicate key id %q", n, k.id)
+		}
+		seen[k.id] = true
+		kr.keys = append(kr.keys, k)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(kr.keys) == 0 {
+		return nil, errors.New("no keys")
+	}
+	return kr, nil
+}
+
+func parseKey(id, typ, encoded string) (key, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return key{}, errors.New("key is not base64")
+	}
+	k := key{id: id}
+	switch typ {
+	case TypeAES:
+		if len(raw) != 32 {
+			return key{}, errors.New("aes256 key must be 32 bytes")
+		}
+		k.aes = raw
+	case TypeX25519Public:
+		if k.pub, err = ecdh.X25519().NewPublicKey(raw); err != nil {
+			return key{}, err
+		}
+	case TypeX25519Private:
+		if k.priv, err = ecdh.X25519().NewPrivateKey(raw); err != nil {
+			return key{}, err
+		}
+		k.pub = k.priv.PublicKey()
+	default:
+		return key{}, fmt.Errorf("unsupported key type %q (want %s, %s or %s)", typ, TypeAES, TypeX25519Public, TypeX25519Private)
+	}
+	return k, nil
+}
+
+// Generate returns a new key file line of the given type. For X25519 it
+// returns the private key line and the matching public key line.
+func Generate(id, typ string) (priv, pub string, err error) {
+	switch typ {
+	case TypeAES:
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return "", "", err
+		}
+		return id + " " + TypeAES + " " + base64.StdEncoding.EncodeToString(raw), "", nil
+	case "x25519":
+		k, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return "", "", err
+		}
+		return id + " " + TypeX25519Private + " " + base64.StdEncoding.EncodeToString(k.Bytes()),
+			id + " " + TypeX25519Public + " " + base64.StdEncoding.EncodeToString(k.PublicKey().Bytes()), nil
+	default:
+		return "", "", fmt.Errorf("unsupported key type %q (want %s or x25519)", typ, TypeAES)
+	}
+}
+
+// Seal encrypts plaintext with a new data key wrapped by the first key.
+func (kr *Keyring) Seal(plaintext []byte) (Envelope, error) {
+	k := kr.keys[0]
+	env := Envelope{Scheme: SchemeAES, KeyID: k.id}
+	if k.aes == nil {
+		env.Scheme = SchemeX25519
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return Envelope{}, err
+	}
+	aad := env.aad()
+	var err error
+	if env.Ciphertext, err = seal(dataKey, plaintext, aad); err != nil {
+		return Envelope{}, err
+	}
+
+	if env.Scheme == SchemeAES {
+		env.WrappedKey, err = seal(k.aes, dataKey, aad)
+		return env, err
+	}
+
+	// Seal the data key to the recipient with a key agreed from a fresh
+	// ephemeral key, which is sent ahead of the wrapped key.
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return Envelope{}, err
+	}
+	kek, err := agree(eph, k.pub, eph.PublicKey())
+	if err != nil {
+		return Envelope{}, err
+	}
+	wrapped, err := seal(kek, dataKey, aad)
+	if err != nil {
+		return Envelope{}, err
+	}
+	env.WrappedKey = append(eph.PublicKey().Bytes(), wrapped...)
+	return env, nil
+}
+
+// Open decrypts env with the key it names.
+func (kr *Keyring) Open(env Envelope) ([]byte, error) {
+	var k *key
+	for i := range kr.keys {
+		if kr.keys[i].id == env.KeyID {
+			k = &kr.keys[i]
+			break
+		}
+	}
+	if k == nil {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, env.KeyID)
+	}
+
+	dataKey, err := k.unwrap(env)
+	if err != nil {
+		return nil, err
+	}
+	return open(dataKey, env.Ciphertext, env.aad())
+}
+
+// unwrap decrypts the envelope's data key.
+func (k *key) unwrap(env Envelope) ([]byte, error) {
+	switch {
+	case env.Scheme == SchemeAES && k.aes != nil:
+		return open(k.aes, env.WrappedKey, env.aad())
+	case env.Scheme == SchemeX25519 && k.priv != nil:
+		if len(env.WrappedKey) < 32 {
+			return nil, errors.New("wrapped key too short")
+		}
+		ephemeral, err := ecdh.X25519().NewPublicKey(env.WrappedKey[:32])
+		if err != nil {
+			return nil, err
+		}
+		kek, err := agree(k.priv, ephemeral, ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		return open(kek, env.WrappedKey[32:], env.aad())
+	default:
+		return nil, fmt.Errorf("%w: %q can't open %s envelopes", ErrUnknownKey, k.id, env.Scheme)
+	}
+}
+
+// aad binds the ciphertexts to the scheme and key they were sealed for.
+func (env Envelope) aad() []byte {
+	return []byte(env.Scheme + " " + env.KeyID)
+}
+
+// agree derives a wrapping key from the X25519 exchange between priv and
+// peer. The ephemeral public key is mixed in as the salt.
+func agree(priv *ecdh.PrivateKey, peer, ephemeral *ecdh.PublicKey) ([]byte, error) {
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Key(sha256.New, shared, ephemeral.Bytes(), hkdfInfo, 32)
+}
+
+// seal encrypts plaintext with AES-256-GCM, prefixing the random nonce.
+func seal(k, plaintext, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(k)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// open reverses seal.
+func open(k, ciphertext, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(k)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ct := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ct, aad)
+}
+
+func newGCM(k []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,102 @@
+package envelope
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func mustParse(t *testing.T, lines ...string) *Keyring {
+	t.Helper()
+	kr, err := Parse(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return kr
+}
+
+func TestSealOpenAES(t *testing.T) {
+	current, _, _ := Generate("k2", TypeAES)
+	previous, _, _ := Generate("k1", TypeAES)
+	kr := mustParse(t, "# keys", current, "", previous)
+
+	plaintext := []byte(`{"body":"secret"}`)
+	env, err := kr.Seal(plaintext)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if env.Scheme != SchemeAES || env.KeyID != "k2" || bytes.Contains(env.Ciphertext, []byte("secret")) {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+	got, err := kr.Open(env)
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("Open: %q, %v", got, err)
+	}
+
+	// Envelopes sealed with the previous key still open after rotation.
+	old, _ := mustParse(t, previous).Seal(plaintext)
+	if got, err := kr.Open(old); err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("Open with previous key: %q, %v", got, err)
+	}
+
+	tampered := env
+	tampered.Ciphertext = append([]byte(nil), env.Ciphertext...)
+	tampered.Ciphertext[len(tampered.Ciphertext)-1] ^= 1
+	if _, err := kr.Open(tampered); err == nil {
+		t.Fatalf("expected tampered ciphertext to fail")
+	}
+	relabelled := env
+	relabelled.KeyID = "k1"
+	if _, err := kr.Open(relabelled); err == nil {
+		t.Fatalf("expected an envelope claiming another key to fail")
+	}
+	if _, err := mustParse(t, previous).Open(env); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestSealOpenX25519(t *testing.T) {
+	priv, pub, err := Generate("r1", "x25519")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	sender := mustParse(t, pub)
+	recipient := mustParse(t, priv)
+
+	plaintext := []byte(`{"body":"secret"}`)
+	env, err := sender.Seal(plaintext)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if env.Scheme != SchemeX25519 || env.KeyID != "r1" {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+	if _, err := sender.Open(env); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected the public key not to open, got %v", err)
+	}
+	got, err := recipient.Open(env)
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("Open: %q, %v", got, err)
+	}
+
+	other, _, _ := Generate("r1", "x25519")
+	if _, err := mustParse(t, other).Open(env); err == nil {
+		t.Fatalf("expected another private key to fail")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"k1 aes256",
+		"k1 aes256 c2hvcnQ=",
+		"k1 rsa AAAA",
+		"k1 x25519-public !!",
+		"k1 aes256 " + strings.Repeat("A", 43) + "=\nk1 aes256 " + strings.Repeat("A", 43) + "=",
+	} {
+		if _, err := Parse(strings.NewReader(input)); err == nil {
+			t.Fatalf("Parse(%q): expected error", input)
+		}
+	}
+}
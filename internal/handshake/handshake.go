@@ -0,0 +1,229 @@
+// Package handshake answers the verification requests webhook providers send
+// before, or alongside, delivering events. These need a synchronous response
+// that can't come back through the relay, so the receiver answers them
+// itself.
+package handshake
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Providers lists the supported provider names.
+var Providers = []string{"slack", "meta", "msgraph", "zoom", "twitch", "websub"}
+
+// Responder answers a provider's verification requests.
+type Responder interface {
+	// Respond answers r if it is a verification request and returns true.
+	// It returns false, having written nothing, for any other request.
+	// body is the request body, which has already been read.
+	Respond(w http.ResponseWriter, r *http.Request, body []byte) bool
+}
+
+// Config holds the provider settings a Responder may need.
+type Config struct {
+	// Secret is the Zoom secret token or Twitch EventSub secret.
+	Secret string
+	// VerifyToken is the token Meta sends in hub.verify_token.
+	VerifyToken string
+	// Topics, if set, restricts the WebSub topics subscriptions are
+	// confirmed for.
+	Topics []string
+}
+
+// New returns the Responder for provider.
+func New(provider string, cfg Config) (Responder, error) {
+	switch provider {
+	case "slack":
+		return slack{}, nil
+	case "meta":
+		if cfg.VerifyToken == "" {
+			return nil, fmt.Errorf("handshake provider meta requires verify-token")
+		}
+		return meta{verifyToken: cfg.VerifyToken}, nil
+	case "msgraph":
+		return msgraph{}, nil
+	case "zoom":
+		if cfg.Secret == "" {
+			return nil, fmt.Errorf("handshake provider zoom requires secret")
+		}
+		return zoom{secret: cfg.Secret}, nil
+	case "twitch":
+		return twitch{secret: cfg.Secret}, nil
+	case "websub":
+		return websub{topics: cfg.Topics}, nil
+	default:
+		return nil, fmt.Errorf("unsupported handshake provider %q (want %s)", provider, strings.Join(Providers, ", "))
+	}
+}
+
+func writeText(w http.ResponseWriter, s string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(s))
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// slack answers Events API url_verification requests by echoing the
+// challenge.
+type slack struct{}
+
+func (slack) Respond(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	var ev struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+	}
+	if r.Method != http.MethodPost || json.Unmarshal(body, &ev) != nil || ev.Type != "url_verification" {
+		return false
+	}
+	writeText(w, ev.Challenge)
+	return true
+}
+
+// meta answers the Meta (Facebook, Instagram, WhatsApp) webhook verification
+// GET, echoing hub.challenge if hub.verify_token matches.
+type meta struct {
+	verifyToken string
+}
+
+func (m meta) Respond(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	q := r.URL.Query()
+	if r.Method != http.MethodGet || q.Get("hub.mode") != "subscribe" {
+		return false
+	}
+	if !equal(q.Get("hub.verify_token"), m.verifyToken) {
+		w.WriteHeader(http.StatusForbidden)
+		return true
+	}
+	writeText(w, q.Get("hub.challenge"))
+	return true
+}
+
+// msgraph answers Microsoft Graph subscription validation by echoing the
+// validationToken query parameter.
+type msgraph struct{}
+
+func (msgraph) Respond(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	q := r.URL.Query()
+	if !q.Has("validationToken") {
+		return false
+	}
+	writeText(w, q.Get("validationToken"))
+	return true
+}
+
+// zoom answers endpoint.url_validation events with the plain token and its
+// HMAC-SHA256 under the app's secret token. That HMAC would be a valid
+// x-zm-signature for a forged event if the plain token were chosen by the
+// sender, so the validation request's own signature is checked first.
+type zoom struct {
+	secret string
+}
+
+func (z zoom) Respond(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	var ev struct {
+		Event   string `json:"event"`
+		Payload struct {
+			PlainToken string `json:"plainToken"`
+		} `json:"payload"`
+	}
+	if r.Method != http.MethodPost || json.Unmarshal(body, &ev) != nil || ev.Event != "endpoint.url_validation" {
+		return false
+	}
+	// Zoom signs "v0:<timestamp>:<body>" like its events.
+	sig := hmac.New(sha256.New, []byte(z.secret))
+	sig.Write([]byte("v0:" + r.Header.Get("X-Zm-Request-Timestamp") + ":"))
+	sig.Write(body)
+	if r.Header.Get("X-Zm-Request-Timestamp") == "" || !equal(r.Header.Get("X-Zm-Signature"), "v0="+hex.EncodeToString(sig.Sum(nil))) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return true
+	}
+
+	mac := hmac.New(sha256.New, []byte(z.secret))
+	mac.Write([]byte(ev.Payload.PlainToken))
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"plainToken":     ev.Payload.PlainToken,
+		"encryptedToken": hex.EncodeToString(mac.Sum(nil)),
+	})
+	return true
+}
+
+// twitch answers EventSub webhook_callback_verification requests by echoing
+// the challenge. With a secret the request's signature is checked first.
+type twitch struct {
+	secret string
+}
+
+func (t twitch) Respond(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	if r.Header.Get("Twitch-Eventsub-Message-Type") != "webhook_callback_verification" {
+		return false
+	}
+	if t.secret != "" {
+		mac := hmac.New(sha256.New, []byte(t.secret))
+		mac.Write([]byte(r.Header.Get("Twitch-Eventsub-Message-Id")))
+		mac.Write([]byte(r.Header.Get("Twitch-Eventsub-Message-Timestamp")))
+		mac.Write(body)
+		want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if !equal(r.Header.Get("Twitch-Eventsub-Message-Signature"), want) {
+			w.WriteHeader(http.StatusForbidden)
+			return true
+		}
+	}
+	var ev struct {
+		Challenge string `json:"challenge"`
+	}
+	if json.Unmarshal(body, &ev) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return true
+	}
+	writeText(w, ev.Challenge)
+	return true
+}
+
+// websub answers WebSub (PubSubHubbub) intent verification GETs by echoing
+// hub.challenge, and acknowledges subscription denials.
+type websub struct {
+	topics []string
+}
+
+func (ws websub) Respond(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	q := r.URL.Query()
+	if r.Method != http.MethodGet || !q.Has("hub.mode") {
+		return false
+	}
+	switch q.Get("hub.mode") {
+	case "subscribe", "unsubscribe":
+		if !ws.allowed(q.Get("hub.topic")) {
+			w.WriteHeader(http.StatusNotFound)
+			return true
+		}
+		writeText(w, q.Get("hub.challenge"))
+	default:
+		// hub.mode=denied needs no more than an acknowledgement.
+		w.WriteHeader(http.StatusOK)
+	}
+	return true
+}
+
+func (ws websub) allowed(topic string) bool {
+	if len(ws.topics) == 0 {
+		return true
+	}
+	for _, t := range ws.topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package handshake
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sign(secret string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, p := range parts {
+		mac.Write([]byte(p))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestResponders(t *testing.T) {
+	twitchBody := `{"challenge":"pogchamp-kappa"}`
+	zoomBody := `{"event":"endpoint.url_validation","payload":{"plainToken":"qgg8vlvZRS6UYooatFL8Aw"}}`
+	tests := []struct {
+		name     string
+		provider string
+		cfg      Config
+		method   string
+		target   string
+		headers  map[string]string
+		body     string
+		handled  bool
+		wantCode int
+		wantBody string
+	}{
+		{name: "slack", provider: "slack", method: "POST", target: "/", body: `{"type":"url_verification","challenge":"3eZbrw1a"}`, handled: true, wantCode: 200, wantBody: "3eZbrw1a"},
+		{name: "slack-event", provider: "slack", method: "POST", target: "/", body: `{"type":"event_callback"}`},
+		{name: "meta", provider: "meta", cfg: Config{VerifyToken: "tok"}, method: "GET", target: "/?hub.mode=subscribe&hub.verify_token=tok&hub.challenge=1158201444", handled: true, wantCode: 200, wantBody: "1158201444"},
+		{name: "meta-wrong-token", provider: "meta", cfg: Config{VerifyToken: "tok"}, method: "GET", target: "/?hub.mode=subscribe&hub.verify_token=bad&hub.challenge=1", handled: true, wantCode: 403},
+		{name: "meta-event", provider: "meta", cfg: Config{VerifyToken: "tok"}, method: "POST", target: "/", body: `{}`},
+		{name: "msgraph", provider: "msgraph", method: "POST", target: "/?validationToken=Validation%3a+Testing", handled: true, wantCode: 200, wantBody: "Validation: Testing"},
+		{name: "msgraph-notification", provider: "msgraph", method: "POST", target: "/", body: `{"value":[]}`},
+		{name: "zoom", provider: "zoom", cfg: Config{Secret: "zsecret"}, method: "POST", target: "/", body: zoomBody, headers: map[string]string{
+			"X-Zm-Request-Timestamp": "1700000000",
+			"X-Zm-Signature":         "v0=" + sign("zsecret", "v0:1700000000:", zoomBody),
+		}, handled: true, wantCode: 200,
+			wantBody: `{"encryptedToken":"` + sign("zsecret", "qgg8vlvZRS6UYooatFL8Aw") + `","plainToken":"qgg8vlvZRS6UYooatFL8Aw"}`},
+		// Answering unsigned validations would sign any plain token.
+		{name: "zoom-unsigned", provider: "zoom", cfg: Config{Secret: "zsecret"}, method: "POST", target: "/", body: zoomBody, handled: true, wantCode: 401},
+		{name: "zoom-bad-signature", provider: "zoom", cfg: Config{Secret: "zsecret"}, method: "POST", target: "/", body: zoomBody, headers: map[string]string{
+			"X-Zm-Request-Timestamp": "1700000000",
+			"X-Zm-Signature":         "v0=" + sign("other", "v0:1700000000:", zoomBody),
+		}, handled: true, wantCode: 401},
+		{name: "twitch", provider: "twitch", cfg: Config{Secret: "tsecret"}, method: "POST", target: "/", body: twitchBody, headers: map[string]string{
+			"Twitch-Eventsub-Message-Type":      "webhook_callback_verification",
+			"Twitch-Eventsub-Message-Id":        "id-1",
+			"Twitch-Eventsub-Message-Timestamp": "2023-01-01T00:00:00Z",
+			"Twitch-Eventsub-Message-Signature": "sha256=" + sign("tsecret", "id-1", "2023-01-01T00:00:00Z", twitchBody),
+		}, handled: true, wantCode: 200, wantBody: "pogchamp-kappa"},
+		{name: "twitch-bad-signature", provider: "twitch", cfg: Config{Secret: "tsecret"}, method: "POST", target: "/", body: twitchBody, headers: map[string]string{
+			"Twitch-Eventsub-Message-Type":      "webhook_callback_verification",
+			"Twitch-Eventsub-Message-Signature": "sha256=00",
+		}, handled: true, wantCode: 403},
+		{name: "twitch-notification", provider: "twitch", method: "POST", target: "/", body: `{}`, headers: map[string]string{"Twitch-Eventsub-Message-Type": "notification"}},
+		{name: "websub", provider: "websub", cfg: Config{Topics: []string{"https://example.com/feed"}}, method: "GET", target: "/?hub.mode=subscribe&hub.topic=https://example.com/feed&hub.challenge=abc", handled: true, wantCode: 200, wantBody: "abc"},
+		{name: "websub-other-topic", provider: "websub", cfg: Config{Topics: []string{"https://example.com/feed"}}, method: "GET", target: "/?hub.mode=subscribe&hub.topic=https://evil&hub.challenge=abc", handled: true, wantCode: 404},
+		{name: "websub-denied", provider: "websub", method: "GET", target: "/?hub.mode=denied&hub.topic=x", handled: true, wantCode: 200},
+		{name: "websub-content", provider: "websub", method: "POST", target: "/", body: "<feed/>"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := New(tc.provider, tc.cfg)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			req := httptest.NewRequest(tc.method, "http://example.com"+tc.target, strings.NewReader(tc.body))
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+
+			handled := resp.Respond(rr, req, []byte(tc.body))
+			if handled != tc.handled {
+				t.Fatalf("expected handled=%v, got %v", tc.handled, handled)
+			}
+			if !handled {
+				return
+			}
+			if rr.Code != tc.wantCode {
+				t.Fatalf("expected status %d, got %d", tc.wantCode, rr.Code)
+			}
+			got := strings.TrimSpace(rr.Body.String())
+			if strings.HasPrefix(tc.wantBody, "{") {
+				var a, b map[string]string
+				json.Unmarshal([]byte(got), &a)
+				json.Unmarshal([]byte(tc.wantBody), &b)
+				if a["plainToken"] != b["plainToken"] || a["encryptedToken"] != b["encryptedToken"] {
+					t.Fatalf("expected body %s, got %s", tc.wantBody, got)
+				}
+			} else if tc.wantBody != "" && got != tc.wantBody {
+				t.Fatalf("expected body %q, got %q", tc.wantBody, got)
+			}
+		})
+	}
+}
+
+func TestNewRequiresSettings(t *testing.T) {
+	for _, provider := range []string{"meta", "zoom", "unknown"} {
+		if _, err := New(provider, Config{}); err == nil {
+			t.Fatalf("expected error for %s without settings", provider)
+		}
+	}
+}
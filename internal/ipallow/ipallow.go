@@ -0,0 +1,120 @@
+// Package ipallow holds CIDR allowlists, such as the published source ranges
+// of webhook providers, that can be reloaded from a file while in use.
+package ipallow
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+)
+
+// List is an allowlist made of static ranges and, optionally, ranges read
+// from a file. It is safe for concurrent use.
+type List struct {
+	static []netip.Prefix
+	file   string
+
+	mu       sync.RWMutex
+	prefixes []netip.Prefix
+}
+
+// New returns a list of the static ranges plus those in file, if file is not
+// empty. Single addresses are accepted as well as CIDR ranges.
+func New(static []string, file string) (*List, error) {
+	prefixes, err := ParsePrefixes(static)
+	if err != nil {
+		return nil, err
+	}
+	l := &List{static: prefixes, file: file, prefixes: prefixes}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload re-reads the file. If it can't be read or parsed, the previous
+// ranges stay in use and the error is returned.
+func (l *List) Reload() error {
+	if l.file == "" {
+		return nil
+	}
+	b, err := os.ReadFile(l.file)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	loaded, err := ParsePrefixes(lines)
+	if err != nil {
+		return fmt.Errorf("%s: %w", l.file, err)
+	}
+
+	prefixes := append(append([]netip.Prefix(nil), l.static...), loaded...)
+	l.mu.Lock()
+	l.prefixes = prefixes
+	l.mu.Unlock()
+	return nil
+}
+
+// Contains reports whether ip falls in any range of the list.
+func (l *List) Contains(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, prefix := range l.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of ranges in the list.
+func (l *List) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.prefixes)
+}
+
+// ParsePrefixes parses CIDR ranges and single addresses, skipping blank
+// entries.
+func ParsePrefixes(ss []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range ss {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", s, err)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %w", s, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,50 @@
+package ipallow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "github.txt")
+	if err := os.WriteFile(file, []byte("# GitHub hooks\n192.30.252.0/22\n\n2a0a:a440::/29 # v6\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := New([]string{"10.0.0.1"}, file)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for ip, want := range map[string]bool{
+		"10.0.0.1":            true,
+		"10.0.0.2":            false,
+		"192.30.253.10":       true,
+		"::ffff:192.30.252.1": true,
+		"2a0a:a440::1":        true,
+		"203.0.113.1":         false,
+		"not-an-ip":           false,
+	} {
+		if got := l.Contains(ip); got != want {
+			t.Fatalf("Contains(%s) = %v, want %v", ip, got, want)
+		}
+	}
+
+	// A broken file keeps the previous ranges.
+	os.WriteFile(file, []byte("garbage\n"), 0o600)
+	if err := l.Reload(); err == nil {
+		t.Fatalf("expected error for invalid file")
+	}
+	if !l.Contains("192.30.253.10") {
+		t.Fatalf("expected previous ranges to remain after a failed reload")
+	}
+
+	// A good file replaces the ranges but keeps the static ones.
+	os.WriteFile(file, []byte("203.0.113.0/24\n"), 0o600)
+	if err := l.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if l.Contains("192.30.253.10") || !l.Contains("203.0.113.1") || !l.Contains("10.0.0.1") {
+		t.Fatalf("unexpected ranges after reload")
+	}
+}
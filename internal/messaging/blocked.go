@@ -0,0 +1,100 @@
+package messaging
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrBlocked is returned by Publish while the broker has blocked the
+// publishing connection, typically because of a memory or disk alarm.
+var ErrBlocked = errors.New("broker connection is blocked")
+
+// pubBlocked tracks flow control on the publisher connection.
+var pubBlocked = &blockState{}
+
+func init() {
+	expvar.Publish("amqp_blocked", expvar.Func(func() interface{} {
+		if blocked, _ := pubBlocked.Blocked(); blocked {
+			return 1
+		}
+		return 0
+	}))
+	expvar.Publish("amqp_blocked_seconds_total", expvar.Func(func() interface{} {
+		return pubBlocked.total().Seconds()
+	}))
+}
+
+// blockState records whether a connection is blocked and for how long it has
+// been blocked in total.
+type blockState struct {
+	mu     sync.Mutex
+	active bool
+	reason string
+	since  time.Time
+	sum    time.Duration
+}
+
+// watch updates the state from conn's blocked notifications until the
+// connection closes.
+func (b *blockState) watch(conn *amqp.Connection) {
+	notify := conn.NotifyBlocked(make(chan amqp.Blocking, 1))
+	go func() {
+		for n := range notify {
+			b.set(n)
+		}
+		// A closed connection can no longer be unblocked.
+		b.set(amqp.Blocking{Active: false})
+	}()
+}
+
+func (b *blockState) set(n amqp.Blocking) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case n.Active && !b.active:
+		log.Printf("RabbitMQ blocked the publisher connection: %s", n.Reason)
+		b.active = true
+		b.reason = n.Reason
+		b.since = time.Now()
+	case !n.Active && b.active:
+		d := time.Since(b.since)
+		log.Printf("RabbitMQ unblocked the publisher connection after %s", d.Round(time.Millisecond))
+		b.active = false
+		b.reason = ""
+		b.sum += d
+	}
+}
+
+// Blocked reports whether the connection is currently blocked and the reason
+// the broker gave. It is safe to call on a nil blockState.
+func (b *blockState) Blocked() (bool, string) {
+	if b == nil {
+		return false, ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.active, b.reason
+}
+
+// total returns the time spent blocked, including any ongoing block.
+func (b *blockState) total() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.active {
+		return b.sum + time.Since(b.since)
+	}
+	return b.sum
+}
+
+// PublisherBlocked reports whether the broker is currently blocking the
+// publisher connection.
+func PublisherBlocked() bool {
+	blocked, _ := pubBlocked.Blocked()
+	return blocked
+}
@@ -1,52 +1,379 @@
 package messaging
 
 import (
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"fmt"
 	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
 	"sync"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/smarthall/webhook-relay/internal/tlsutil"
+)
+
+// ConnectionConfig describes how to connect to RabbitMQ.
+type ConnectionConfig struct {
+	// URIs lists broker nodes. They are tried in order until one accepts
+	// both connections.
+	URIs []string
+	// Shuffle randomises the order URIs are tried in, spreading relays
+	// across cluster nodes.
+	Shuffle bool
+	TLS     TLSConfig
+	// SASLExternal authenticates with the EXTERNAL mechanism, using the
+	// client certificate instead of the credentials in the URI.
+	SASLExternal bool
+	// Name is shown as the connection name in the management UI, suffixed
+	// with the connection's role. It also prefixes consumer tags.
+	Name string
+	// Properties are extra client properties advertised to the broker.
+	Properties map[string]string
+}
+
+// TLSConfig configures amqps:// connections. Certificate and CA files are
+// re-read when they change, so rotated certificates are used for new
+// connections without restarting.
+type TLSConfig struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	// MinVersion is "1.2" or "1.3"; empty uses Go's default.
+	MinVersion string
+}
+
+func (t TLSConfig) enabled() bool {
+	return t.CAFile != "" || t.CertFile != "" || t.KeyFile != "" || t.ServerName != "" || t.MinVersion != ""
+}
+
+// Validate checks that there is at least one URI and that every URI is
+// amqps:// when TLS options or SASL EXTERNAL are set, since they would
+// otherwise be ignored for plain connections.
+func (c ConnectionConfig) Validate() error {
+	if len(c.URIs) == 0 {
+		return errors.New("no AMQP URIs configured")
+	}
+	if _, err := tlsutil.ParseVersion(c.TLS.MinVersion); err != nil {
+		return err
+	}
+	for _, uri := range c.URIs {
+		u, err := amqp.ParseURI(uri)
+		if err != nil {
+			return fmt.Errorf("invalid AMQP URI %s: %w", redactURI(uri), err)
+		}
+		if u.Scheme == "amqps" {
+			continue
+		}
+		if c.TLS.enabled() {
+			return fmt.Errorf("TLS options are set but %s is not an amqps:// URI", redactURI(uri))
+		}
+		if c.SASLExternal {
+			return fmt.Errorf("SASL EXTERNAL needs a client certificate, but %s is not an amqps:// URI", redactURI(uri))
+		}
+	}
+	return nil
+}
+
+// amqpConfig builds the amqp.Config used to dial the broker for a connection
+// with the given role ("publisher" or "subscriber").
+func (c ConnectionConfig) amqpConfig(role string) (amqp.Config, error) {
+	cfg := amqp.Config{
+		Locale:     "en_US",
+		Properties: amqp.NewConnectionProperties(),
+	}
+	for k, v := range c.Properties {
+		cfg.Properties[k] = v
+	}
+	if c.Name != "" {
+		cfg.Properties.SetClientConnectionName(c.Name + " (" + role + ")")
+	}
+
+	if c.SASLExternal {
+		cfg.SASL = []amqp.Authentication{&amqp.ExternalAuth{}}
+	}
+
+	if !c.TLS.enabled() {
+		return cfg, nil
+	}
+
+	minVersion, err := tlsutil.ParseVersion(c.TLS.MinVersion)
+	if err != nil {
+		return cfg, err
+	}
+	tc := &tls.Config{
+		ServerName: c.TLS.ServerName,
+		MinVersion: minVersion,
+	}
+	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
+		kp, err := tlsutil.NewKeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return cfg, err
+		}
+		tc.GetClientCertificate = kp.GetClientCertificate
+	}
+	if c.TLS.CAFile != "" {
+		pool, err := tlsutil.NewCertPool(c.TLS.CAFile)
+		if err != nil {
+			return cfg, err
+		}
+		// Verification is done in VerifyConnection so the CA bundle can be
+		// reloaded; the default verifier would pin the pool at startup.
+		tc.InsecureSkipVerify = true
+		tc.VerifyConnection = pool.VerifyServer()
+	}
+	cfg.TLSClientConfig = tc
+
+	return cfg, nil
+}
+
+// nodes returns the broker URIs in the order they should be tried.
+func (c ConnectionConfig) nodes() []string {
+	nodes := append([]string(nil), c.URIs...)
+	if c.Shuffle {
+		rand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	}
+	return nodes
+}
+
+// dial opens a single connection to the broker at uri.
+func (c ConnectionConfig) dial(uri, role string) (*amqp.Connection, error) {
+	cfg, err := c.amqpConfig(role)
+	if err != nil {
+		return nil, err
+	}
+	return amqp.DialConfig(uri, cfg)
+}
+
+// dialPair opens the publisher and subscriber connections to a single node.
+func (c ConnectionConfig) dialPair(uri string) (*amqp.Connection, *amqp.Connection, error) {
+	c1, err := c.dial(uri, "publisher")
+	if err != nil {
+		return nil, nil, err
+	}
+	c2, err := c.dial(uri, "subscriber")
+	if err != nil {
+		// close first if second fails
+		_ = c1.Close()
+		return nil, nil, err
+	}
+	return c1, c2, nil
+}
+
+// redactURI returns the scheme, host, port and vhost of an AMQP URI without
+// its credentials, for logs and metrics.
+func redactURI(uri string) string {
+	u, err := amqp.ParseURI(uri)
+	if err != nil {
+		return "invalid-uri"
+	}
+	return fmt.Sprintf("%s://%s/%s", u.Scheme, net.JoinHostPort(u.Host, strconv.Itoa(u.Port)), url.PathEscape(u.Vhost))
+}
+
+var (
+	connectedNode   = expvar.NewString("amqp_connected_node")
+	connectFailures = expvar.NewMap("amqp_connect_failures")
+	reconnects      = expvar.NewInt("amqp_reconnects_total")
 )
 
 var (
 	initOnce sync.Once
 	initErr  error
 
+	connCfg ConnectionConfig
 	pubConn *amqp.Connection
 	subConn *amqp.Connection
 	mu      sync.Mutex
+
+	// reconnecting is set while lost connections are being replaced.
+	reconnecting bool
+	// reconnected is closed, and replaced, each time they have been.
+	reconnected = make(chan struct{})
+	// reconnectHooks run on the new connections before reconnected is closed.
+	reconnectHooks []func()
+	// closing is set by CloseConnections, after which nothing reconnects.
+	closing bool
 )
 
+// reconnectMin and reconnectMax bound the wait between rounds of trying every
+// node while reconnecting.
+var (
+	reconnectMin = time.Second
+	reconnectMax = 30 * time.Second
+)
+
+// ErrDisconnected is returned by Publish while the connections to RabbitMQ
+// are being re-established.
+var ErrDisconnected = errors.New("reconnecting to RabbitMQ")
+
 // InitConnections dials two separate AMQP connections (one for publishing,
-// one for subscribing). It is safe to call multiple times; initialization
-// happens only once.
-func InitConnections(amqpUri string) error {
+// one for subscribing) to the first reachable node in cfg.URIs. It is safe to
+// call multiple times; initialization happens only once. When either
+// connection is lost both are replaced in the background, trying every node
+// again with a backoff between rounds, and the publisher, subscriber and
+// health checker carry on over the new connections.
+func InitConnections(cfg ConnectionConfig) error {
 	initOnce.Do(func() {
-		// publisher connection
-		c1, err := amqp.Dial(amqpUri)
-		if err != nil {
+		if err := cfg.Validate(); err != nil {
 			initErr = err
 			return
 		}
-		log.Printf("Connected to RabbitMQ (publisher)")
 
-		// subscriber connection
-		c2, err := amqp.Dial(amqpUri)
+		c1, c2, err := connect(cfg)
 		if err != nil {
-			// close first if second fails
-			_ = c1.Close()
 			initErr = err
 			return
 		}
-		log.Printf("Connected to RabbitMQ (subscriber)")
 
 		mu.Lock()
+		connCfg = cfg
 		pubConn = c1
 		subConn = c2
 		mu.Unlock()
+		watch(c1, c2)
 	})
 	return initErr
 }
 
+// connect opens both connections to the first node in cfg that accepts them.
+func connect(cfg ConnectionConfig) (*amqp.Connection, *amqp.Connection, error) {
+	var errs []error
+	for _, uri := range cfg.nodes() {
+		node := redactURI(uri)
+		c1, c2, err := cfg.dialPair(uri)
+		if err != nil {
+			log.Printf("Failed to connect to RabbitMQ node %s: %s", node, err)
+			connectFailures.Add(node, 1)
+			errs = append(errs, fmt.Errorf("%s: %w", node, err))
+			continue
+		}
+		log.Printf("Connected to RabbitMQ node %s (publisher, subscriber)", node)
+		connectedNode.Set(node)
+		return c1, c2, nil
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+// watch follows flow control on the publisher connection and reconnects
+// when either connection is lost.
+func watch(pub, sub *amqp.Connection) {
+	pubBlocked.watch(pub)
+	watchClose(pub, "publisher")
+	watchClose(sub, "subscriber")
+}
+
+// watchClose starts reconnecting when conn is closed by the broker or the
+// network, rather than by CloseConnections or a reconnect.
+func watchClose(conn *amqp.Connection, role string) {
+	notify := conn.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		// A graceful close closes notify without sending an error.
+		if err := <-notify; err != nil {
+			log.Printf("Lost RabbitMQ %s connection: %v", role, err)
+			reconnect(conn)
+		}
+	}()
+}
+
+// reconnect replaces both connections after lost was lost, retrying every
+// node until one accepts them. The surviving connection is closed too, so the
+// publisher and subscriber always share a node.
+func reconnect(lost *amqp.Connection) {
+	mu.Lock()
+	if reconnecting || closing || (lost != pubConn && lost != subConn) {
+		// Already being replaced, or shutting down.
+		mu.Unlock()
+		return
+	}
+	reconnecting = true
+	cfg, old := connCfg, []*amqp.Connection{pubConn, subConn}
+	mu.Unlock()
+	for _, c := range old {
+		_ = c.Close()
+	}
+
+	wait := reconnectMin
+	var c1, c2 *amqp.Connection
+	for {
+		var err error
+		if c1, c2, err = connect(cfg); err == nil {
+			break
+		}
+		log.Printf("Failed to reconnect to RabbitMQ, retrying in %s: %v", wait, err)
+		time.Sleep(wait)
+		wait = min(2*wait, reconnectMax)
+		if isClosing() {
+			break
+		}
+	}
+
+	mu.Lock()
+	if closing {
+		if c1 != nil {
+			_ = c1.Close()
+			_ = c2.Close()
+		}
+		// Wake waiters so they see the connections are gone.
+		close(reconnected)
+		reconnected = make(chan struct{})
+		mu.Unlock()
+		return
+	}
+	pubConn, subConn = c1, c2
+	hooks := append([]func(){}, reconnectHooks...)
+	mu.Unlock()
+
+	watch(c1, c2)
+	for _, hook := range hooks {
+		hook()
+	}
+	reconnects.Add(1)
+
+	mu.Lock()
+	reconnecting = false
+	close(reconnected)
+	reconnected = make(chan struct{})
+	mu.Unlock()
+}
+
+// reconnectState reports whether the connections are being replaced, and
+// returns a channel that is closed once they next have been.
+func reconnectState() (bool, <-chan struct{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	return reconnecting, reconnected
+}
+
+// connectionsDown reports whether the connections are being replaced, or one
+// of them has closed and is about to be.
+func connectionsDown() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if reconnecting {
+		return true
+	}
+	return (pubConn != nil && pubConn.IsClosed()) || (subConn != nil && subConn.IsClosed())
+}
+
+// onReconnect registers f to run on the new connections after a reconnect,
+// before publishing resumes.
+func onReconnect(f func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	reconnectHooks = append(reconnectHooks, f)
+}
+
+func isClosing() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return closing
+}
+
 func GetPubConn() *amqp.Connection {
 	mu.Lock()
 	defer mu.Unlock()
@@ -64,6 +391,7 @@ func GetSubConn() *amqp.Connection {
 func CloseConnections() {
 	mu.Lock()
 	defer mu.Unlock()
+	closing = true
 	if pubConn != nil {
 		_ = pubConn.Close()
 		pubConn = nil
@@ -0,0 +1,67 @@
+package messaging
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/smarthall/webhook-relay/internal/envelope"
+)
+
+// AMQP headers describing an encrypted message body.
+const (
+	headerEncryption = "relay-encryption"
+	headerKeyID      = "relay-key-id"
+	headerWrappedKey = "relay-wrapped-key"
+)
+
+// ErrUnencrypted is returned by DeliveryBody for a message that isn't
+// encrypted although keys are configured.
+var ErrUnencrypted = errors.New("message is not encrypted")
+
+// seal encrypts the publishing's body with keys, recording how in its
+// headers.
+func seal(p *amqp.Publishing, keys *envelope.Keyring) error {
+	env, err := keys.Seal(p.Body)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt message: %w", err)
+	}
+	if p.Headers == nil {
+		p.Headers = amqp.Table{}
+	}
+	p.Headers[headerEncryption] = env.Scheme
+	p.Headers[headerKeyID] = env.KeyID
+	p.Headers[headerWrappedKey] = base64.StdEncoding.EncodeToString(env.WrappedKey)
+	p.ContentType = "application/octet-stream"
+	p.Body = env.Ciphertext
+	return nil
+}
+
+// DeliveryBody returns the delivery's message, decrypting it with keys. With
+// keys, unencrypted messages are refused with ErrUnencrypted, since anyone
+// able to publish could have sent them; without keys they are returned as is.
+func DeliveryBody(d amqp.Delivery, keys *envelope.Keyring) ([]byte, error) {
+	scheme, _ := d.Headers[headerEncryption].(string)
+	if scheme == "" {
+		if keys != nil {
+			return nil, ErrUnencrypted
+		}
+		return d.Body, nil
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("message is encrypted but no encryption keys are configured")
+	}
+
+	keyID, _ := d.Headers[headerKeyID].(string)
+	wrapped, _ := d.Headers[headerWrappedKey].(string)
+	wrappedKey, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header: %w", headerWrappedKey, err)
+	}
+	body, err := keys.Open(envelope.Envelope{Scheme: scheme, KeyID: keyID, WrappedKey: wrappedKey, Ciphertext: d.Body})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt message: %w", err)
+	}
+	return body, nil
+}
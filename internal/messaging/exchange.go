@@ -0,0 +1,155 @@
+package messaging
+
+import (
+	"fmt"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ExchangeConfig describes the exchange webhooks are published to and
+// consumed from.
+type ExchangeConfig struct {
+	// Name of the exchange. Defaults to "webhooks".
+	Name string
+	// Kind is the exchange type: topic, headers, direct or fanout.
+	// Defaults to "topic".
+	Kind string
+	// Passive verifies that the exchange (and any named queue) already exist
+	// instead of declaring them. Use this when the relay user lacks configure
+	// permissions on the vhost.
+	Passive bool
+	// Bindings are exchange-to-exchange bindings that route messages from
+	// another exchange into this one. They are skipped in passive mode.
+	Bindings []ExchangeBinding
+}
+
+// ExchangeBinding binds Source into the relay exchange with the given routing
+// key.
+type ExchangeBinding struct {
+	Source string
+	Key    string
+}
+
+const (
+	defaultExchangeName = "webhooks"
+	defaultExchangeKind = amqp.ExchangeTopic
+)
+
+// withDefaults returns a copy of the config with empty fields defaulted.
+func (e ExchangeConfig) withDefaults() ExchangeConfig {
+	if e.Name == "" {
+		e.Name = defaultExchangeName
+	}
+	if e.Kind == "" {
+		e.Kind = defaultExchangeKind
+	}
+	return e
+}
+
+// Validate checks that the exchange type is one the relay understands and
+// that exchange bindings have the routing key it needs.
+func (e ExchangeConfig) Validate() error {
+	kind := e.withDefaults().Kind
+	switch kind {
+	case amqp.ExchangeTopic, amqp.ExchangeHeaders, amqp.ExchangeDirect, amqp.ExchangeFanout:
+	default:
+		return fmt.Errorf("unsupported exchange type %q (want topic, headers, direct or fanout)", e.Kind)
+	}
+	for _, b := range e.Bindings {
+		if b.Key == "" && needsKey(kind) {
+			return fmt.Errorf("exchange binding from %q needs a routing key for a %s exchange", b.Source, kind)
+		}
+	}
+	return nil
+}
+
+// validateBinding checks that a queue binding with the routing key and
+// header matches suits the exchange type.
+func (e ExchangeConfig) validateBinding(key string, match map[string]string) error {
+	kind := e.withDefaults().Kind
+	if len(match) > 0 && kind != amqp.ExchangeHeaders {
+		return fmt.Errorf("header matches need a headers exchange, not %s", kind)
+	}
+	for name := range match {
+		// x-match itself is set from MatchAny, and the broker ignores
+		// other headers starting with a lowercase x- when matching.
+		if strings.HasPrefix(name, "x-") {
+			return fmt.Errorf("invalid header match %q: headers starting with x- can't be matched", name)
+		}
+	}
+	if key == "" && needsKey(kind) {
+		return fmt.Errorf("binding to a %s exchange needs a routing key", kind)
+	}
+	return nil
+}
+
+// needsKey reports whether bindings to an exchange of this type route by
+// key. An empty key would only match messages published without one, which
+// the relay never does.
+func needsKey(kind string) bool {
+	return kind == amqp.ExchangeTopic || kind == amqp.ExchangeDirect
+}
+
+// ParseExchangeBinding parses a binding in the form "source:key". The key may
+// be omitted, which is useful for fanout and headers exchanges.
+func ParseExchangeBinding(s string) (ExchangeBinding, error) {
+	source, key, _ := strings.Cut(s, ":")
+	if source == "" {
+		return ExchangeBinding{}, fmt.Errorf("invalid exchange binding %q: missing source exchange", s)
+	}
+	return ExchangeBinding{Source: source, Key: key}, nil
+}
+
+// exchangeDeclarer is the part of *amqp.Channel used to declare exchanges.
+type exchangeDeclarer interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error
+}
+
+// declareExchange declares (or, in passive mode, verifies) the exchange and
+// its bindings on ch.
+func declareExchange(ch exchangeDeclarer, e ExchangeConfig) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	e = e.withDefaults()
+
+	if e.Passive {
+		err := ch.ExchangeDeclarePassive(
+			e.Name, // name
+			e.Kind, // type
+			true,   // durable
+			false,  // auto-deleted
+			false,  // internal
+			false,  // no-wait
+			nil,    // arguments
+		)
+		if err != nil {
+			return fmt.Errorf("exchange %q not found: %w", e.Name, err)
+		}
+		return nil
+	}
+
+	err := ch.ExchangeDeclare(
+		e.Name, // name
+		e.Kind, // type
+		true,   // durable
+		false,  // auto-deleted
+		false,  // internal
+		false,  // no-wait
+		nil,    // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range e.Bindings {
+		if err := ch.ExchangeBind(e.Name, b.Key, b.Source, false, nil); err != nil {
+			return fmt.Errorf("failed to bind exchange %q to %q: %w", b.Source, e.Name, err)
+		}
+	}
+
+	return nil
+}
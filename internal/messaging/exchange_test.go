@@ -0,0 +1,160 @@
+package messaging
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestParseExchangeBinding(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ExchangeBinding
+		wantErr bool
+	}{
+		{in: "events:orders.#", want: ExchangeBinding{Source: "events", Key: "orders.#"}},
+		{in: "events", want: ExchangeBinding{Source: "events"}},
+		{in: "events:", want: ExchangeBinding{Source: "events"}},
+		{in: "events:a:b", want: ExchangeBinding{Source: "events", Key: "a:b"}},
+		{in: ":orders.#", wantErr: true},
+		{in: "", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := ParseExchangeBinding(tc.in)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error=%v, got %v", tc.wantErr, err)
+			}
+			if got != tc.want {
+				t.Fatalf("expected %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestExchangeConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ExchangeConfig
+		wantErr bool
+	}{
+		{name: "default", cfg: ExchangeConfig{}},
+		{name: "headers", cfg: ExchangeConfig{Kind: "headers"}},
+		{name: "bad-type", cfg: ExchangeConfig{Kind: "x-consistent-hash"}, wantErr: true},
+		{name: "topic-binding", cfg: ExchangeConfig{Bindings: []ExchangeBinding{{Source: "events", Key: "orders.#"}}}},
+		{name: "topic-binding-no-key", cfg: ExchangeConfig{Bindings: []ExchangeBinding{{Source: "events"}}}, wantErr: true},
+		{name: "direct-binding-no-key", cfg: ExchangeConfig{Kind: "direct", Bindings: []ExchangeBinding{{Source: "events"}}}, wantErr: true},
+		{name: "fanout-binding-no-key", cfg: ExchangeConfig{Kind: "fanout", Bindings: []ExchangeBinding{{Source: "events"}}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg.Validate()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error=%v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestExchangeConfigValidateBinding(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    string
+		key     string
+		match   map[string]string
+		wantErr bool
+	}{
+		{name: "topic", key: "#"},
+		{name: "topic-no-key", wantErr: true},
+		{name: "direct-no-key", kind: "direct", wantErr: true},
+		{name: "fanout-no-key", kind: "fanout"},
+		{name: "headers", kind: "headers", match: map[string]string{"X-Relay-Path": "/github"}},
+		{name: "headers-x-match", kind: "headers", match: map[string]string{"x-match": "any"}, wantErr: true},
+		{name: "headers-x-header", kind: "headers", match: map[string]string{"x-delivery-count": "1"}, wantErr: true},
+		{name: "match-on-topic", key: "#", match: map[string]string{"Source": "github"}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ExchangeConfig{Kind: tc.kind}.validateBinding(tc.key, tc.match)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error=%v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+// fakeDeclarer records the exchange calls made on it.
+type fakeDeclarer struct {
+	calls []string
+	err   error
+}
+
+func (f *fakeDeclarer) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	f.calls = append(f.calls, "declare "+name+" "+kind)
+	return f.err
+}
+
+func (f *fakeDeclarer) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	f.calls = append(f.calls, "passive "+name+" "+kind)
+	return f.err
+}
+
+func (f *fakeDeclarer) ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error {
+	f.calls = append(f.calls, "bind "+source+" "+destination+" "+key)
+	return f.err
+}
+
+func TestDeclareExchange(t *testing.T) {
+	bindings := []ExchangeBinding{{Source: "events", Key: "orders.#"}}
+	tests := []struct {
+		name      string
+		cfg       ExchangeConfig
+		err       error
+		wantCalls []string
+		wantErr   string
+	}{
+		{
+			name:      "declare",
+			cfg:       ExchangeConfig{Bindings: bindings},
+			wantCalls: []string{"declare webhooks topic", "bind events webhooks orders.#"},
+		},
+		{
+			name:      "passive",
+			cfg:       ExchangeConfig{Name: "relay", Kind: "headers", Passive: true, Bindings: bindings},
+			wantCalls: []string{"passive relay headers"},
+		},
+		{
+			name:      "passive-missing",
+			cfg:       ExchangeConfig{Name: "relay", Passive: true},
+			err:       errors.New("NOT_FOUND"),
+			wantCalls: []string{"passive relay topic"},
+			wantErr:   `exchange "relay" not found`,
+		},
+		{
+			name:    "invalid",
+			cfg:     ExchangeConfig{Kind: "bogus", Passive: true},
+			wantErr: "unsupported exchange type",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ch := &fakeDeclarer{err: tc.err}
+			err := declareExchange(ch, tc.cfg)
+			if tc.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+			if strings.Join(ch.calls, "; ") != strings.Join(tc.wantCalls, "; ") {
+				t.Fatalf("expected calls %v, got %v", tc.wantCalls, ch.calls)
+			}
+		})
+	}
+}
@@ -11,26 +11,32 @@ import (
 // HealthChecker publishes heartbeat messages to an instance-specific routing key
 // and subscribes to a temporary exclusive queue bound to that key. If a published
 // heartbeat is not observed within the configured timeout, a notification is sent
-// on the Failure channel.
+// on the Failure channel. Heartbeats can't get through while the broker blocks
+// the publisher connection during a memory or disk alarm, so none are sent and
+// no failure is reported then: the receiver rides out alarms by answering 503
+// and spooling instead. Likewise nothing is reported while lost connections are
+// being replaced, after which heartbeats resume over the new ones.
 type HealthChecker struct {
-	amqpUri  string
+	connCfg  ConnectionConfig
 	Interval time.Duration
 	Timeout  time.Duration
 
 	Failure chan struct{}
 	chPub   *amqp.Channel
 	chSub   *amqp.Channel
+	blocked *blockState
 
 	stop chan struct{}
 }
 
-func NewHealthChecker(amqpUri string, interval, timeout time.Duration) *HealthChecker {
+func NewHealthChecker(connCfg ConnectionConfig, interval, timeout time.Duration) *HealthChecker {
 	h := &HealthChecker{
-		amqpUri:  amqpUri,
+		connCfg:  connCfg,
 		Interval: interval,
 		Timeout:  timeout,
 		Failure:  make(chan struct{}, 1),
 		stop:     make(chan struct{}),
+		blocked:  pubBlocked,
 	}
 
 	// start the health checker asynchronously
@@ -48,59 +54,12 @@ func NewHealthChecker(amqpUri string, interval, timeout time.Duration) *HealthCh
 // This method is intentionally unexported because health checking starts automatically.
 func (h *HealthChecker) start() error {
 	// ensure pooled connections are initialized
-	if err := InitConnections(h.amqpUri); err != nil {
+	if err := InitConnections(h.connCfg); err != nil {
 		return err
 	}
 
-	// create separate channels for publishing and subscribing from pooled connections
-	pubConn := GetPubConn()
-	if pubConn == nil {
-		return amqp.ErrClosed
-	}
-	chPub, err := pubConn.Channel()
-	if err != nil {
-		return err
-	}
-	h.chPub = chPub
-
-	subConn := GetSubConn()
-	if subConn == nil {
-		_ = h.chPub.Close()
-		return amqp.ErrClosed
-	}
-	chSub, err := subConn.Channel()
-	if err != nil {
-		_ = h.chPub.Close()
-		return err
-	}
-	h.chSub = chSub
-
-	// declare a non-durable, auto-deleted, exclusive queue for this instance
-	q, err := h.chSub.QueueDeclare(
-		"",    // name
-		false, // durable (non-durable)
-		true,  // delete when unused (auto-delete)
-		true,  // exclusive
-		false, // no-wait
-		nil,   // args
-	)
-	if err != nil {
-		h.Stop()
-		return err
-	}
-
-	// We'll publish directly to this queue via the default exchange (empty name)
-	queueName := q.Name
-
-	msgs, err := h.chSub.Consume(
-		q.Name,
-		"",
-		true,
-		true,
-		false,
-		false,
-		nil,
-	)
+	_, next := reconnectState()
+	queueName, msgs, err := h.open()
 	if err != nil {
 		h.Stop()
 		return err
@@ -115,7 +74,20 @@ func (h *HealthChecker) start() error {
 			select {
 			case <-h.stop:
 				return
+			case <-next:
+				// The connections were replaced: heartbeat over the new ones.
+				_, next = reconnectState()
+				name, m, err := h.open()
+				if err != nil {
+					log.Printf("healthcheck: reopen error: %v", err)
+					h.fail()
+					continue
+				}
+				queueName, msgs = name, m
 			case <-ticker.C:
+				if blocked, _ := h.blocked.Blocked(); blocked || connectionsDown() {
+					continue
+				}
 				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 				// publish directly to the queue using the default exchange
 				err := h.chPub.PublishWithContext(ctx,
@@ -128,24 +100,18 @@ func (h *HealthChecker) start() error {
 				cancel()
 				if err != nil {
 					log.Printf("healthcheck: publish error: %v", err)
-					select {
-					case h.Failure <- struct{}{}:
-					default:
-					}
+					h.fail()
 				}
 
 				// wait for response or timeout
 				select {
-				case d, ok := <-msgs:
+				case _, ok := <-msgs:
 					if !ok {
-						return
+						log.Printf("healthcheck: heartbeat consumer closed")
+						h.fail()
 					}
-					_ = d
 				case <-time.After(h.Timeout):
-					select {
-					case h.Failure <- struct{}{}:
-					default:
-					}
+					h.fail()
 				case <-h.stop:
 					return
 				}
@@ -156,6 +122,84 @@ func (h *HealthChecker) start() error {
 	return nil
 }
 
+// open creates the heartbeat channels and queue on the current connections,
+// closing any previous channels, and starts consuming heartbeats.
+func (h *HealthChecker) open() (string, <-chan amqp.Delivery, error) {
+	h.closeChannels()
+
+	// create separate channels for publishing and subscribing from pooled connections
+	pubConn := GetPubConn()
+	if pubConn == nil {
+		return "", nil, amqp.ErrClosed
+	}
+	chPub, err := pubConn.Channel()
+	if err != nil {
+		return "", nil, err
+	}
+	h.chPub = chPub
+
+	subConn := GetSubConn()
+	if subConn == nil {
+		return "", nil, amqp.ErrClosed
+	}
+	chSub, err := subConn.Channel()
+	if err != nil {
+		return "", nil, err
+	}
+	h.chSub = chSub
+
+	// declare a non-durable, auto-deleted, exclusive queue for this instance
+	q, err := h.chSub.QueueDeclare(
+		"",    // name
+		false, // durable (non-durable)
+		true,  // delete when unused (auto-delete)
+		true,  // exclusive
+		false, // no-wait
+		nil,   // args
+	)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var consumerTag string
+	if h.connCfg.Name != "" {
+		consumerTag = h.connCfg.Name + "/healthcheck"
+	}
+
+	msgs, err := h.chSub.Consume(
+		q.Name,
+		consumerTag,
+		true,
+		true,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// We'll publish directly to this queue via the default exchange (empty name)
+	return q.Name, msgs, nil
+}
+
+// fail reports a failed heartbeat, unless the publisher connection became
+// blocked or a connection was lost meanwhile.
+func (h *HealthChecker) fail() {
+	if blocked, reason := h.blocked.Blocked(); blocked {
+		log.Printf("healthcheck: heartbeat lost while the broker blocks publishing (%s), ignoring", reason)
+		return
+	}
+	if connectionsDown() {
+		log.Printf("healthcheck: heartbeat lost while reconnecting to RabbitMQ, ignoring")
+		return
+	}
+	select {
+	case h.Failure <- struct{}{}:
+	default:
+	}
+}
+
 // Stop terminates the health checker and closes underlying connections.
 // It is safe to call multiple times.
 func (h *HealthChecker) Stop() {
@@ -163,6 +207,10 @@ func (h *HealthChecker) Stop() {
 	defer func() { recover() }()
 	close(h.stop)
 
+	h.closeChannels()
+}
+
+func (h *HealthChecker) closeChannels() {
 	if h.chSub != nil {
 		_ = h.chSub.Close()
 		h.chSub = nil
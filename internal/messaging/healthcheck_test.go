@@ -0,0 +1,53 @@
+package messaging
+
+import (
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// TestHealthCheckerIgnoresBlockedPublisher verifies that heartbeats lost
+// while the broker blocks the publisher connection aren't reported as a
+// failure.
+func TestHealthCheckerIgnoresBlockedPublisher(t *testing.T) {
+	blocked := &blockState{}
+	h := &HealthChecker{Failure: make(chan struct{}, 1), blocked: blocked}
+
+	blocked.set(amqp.Blocking{Active: true, Reason: "low on memory"})
+	h.fail()
+	select {
+	case <-h.Failure:
+		t.Fatalf("expected no failure while the publisher is blocked")
+	default:
+	}
+
+	blocked.set(amqp.Blocking{Active: false})
+	h.fail()
+	select {
+	case <-h.Failure:
+	default:
+		t.Fatalf("expected a failure once the publisher is unblocked")
+	}
+}
+
+// TestHealthCheckerIgnoresReconnect verifies that heartbeats lost while the
+// connections are being replaced aren't reported as a failure.
+func TestHealthCheckerIgnoresReconnect(t *testing.T) {
+	h := &HealthChecker{Failure: make(chan struct{}, 1), blocked: &blockState{}}
+
+	mu.Lock()
+	reconnecting = true
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		reconnecting = false
+		mu.Unlock()
+	})
+
+	h.fail()
+	select {
+	case <-h.Failure:
+		t.Fatalf("expected no failure while reconnecting")
+	default:
+	}
+}
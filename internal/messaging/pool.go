@@ -0,0 +1,147 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	// ErrPublisherBusy is returned when every publishing channel is in use
+	// for longer than the publish timeout.
+	ErrPublisherBusy = errors.New("all publishing channels are busy")
+	// ErrNacked is returned when the broker refuses a published message.
+	ErrNacked = errors.New("message was nacked by the broker")
+	// ErrUnroutable is returned when a mandatory message could not be routed
+	// to any queue.
+	ErrUnroutable = errors.New("message is unroutable")
+)
+
+// publishChannel is a channel in publisher-confirm mode. A channel is only
+// ever used by one publish at a time, so confirms can be tied to the message
+// that caused them.
+type publishChannel interface {
+	// publish sends msg and waits for the broker to confirm it. Mandatory
+	// messages the broker returns as unroutable fail with ErrUnroutable.
+	publish(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) error
+	isClosed() bool
+	close() error
+}
+
+// confirmChannel adapts an *amqp.Channel to publishChannel.
+type confirmChannel struct {
+	ch      *amqp.Channel
+	returns chan amqp.Return
+}
+
+// openConfirmChannel opens a channel on conn and puts it into confirm mode.
+func openConfirmChannel(conn *amqp.Connection) (publishChannel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+	// The broker sends basic.return before the matching basic.ack, and the
+	// client delivers it to this buffered channel before processing the ack,
+	// so a return is always visible once the confirm arrives.
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	return &confirmChannel{ch: ch, returns: returns}, nil
+}
+
+func (c *confirmChannel) publish(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) error {
+	dc, err := c.ch.PublishWithDeferredConfirmWithContext(ctx,
+		exchange,  // exchange
+		key,       // routing key
+		mandatory, // mandatory
+		false,     // immediate
+		msg,
+	)
+	if err != nil {
+		return err
+	}
+	acked, err := dc.WaitContext(ctx)
+	if err != nil {
+		// A late return for this message would fill the returns buffer and
+		// stall the connection, so retire the channel; the pool reopens it.
+		_ = c.ch.Close()
+		return err
+	}
+	if !acked {
+		return ErrNacked
+	}
+	select {
+	case <-c.returns:
+		return ErrUnroutable
+	default:
+		return nil
+	}
+}
+
+func (c *confirmChannel) isClosed() bool { return c.ch.IsClosed() }
+
+func (c *confirmChannel) close() error { return c.ch.Close() }
+
+// channelPool hands out publishing channels to concurrent callers. Callers
+// wait for a free channel, which applies backpressure when all of them are
+// busy. Channels closed by the broker are reopened when next acquired.
+type channelPool struct {
+	chans chan publishChannel
+	open  func() (publishChannel, error)
+}
+
+func newChannelPool(size int, open func() (publishChannel, error)) (*channelPool, error) {
+	p := &channelPool{
+		chans: make(chan publishChannel, size),
+		open:  open,
+	}
+	for i := 0; i < size; i++ {
+		ch, err := open()
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		p.chans <- ch
+	}
+	return p, nil
+}
+
+// acquire takes a channel from the pool, waiting until one is free or ctx is
+// done. The channel must be returned with release.
+func (p *channelPool) acquire(ctx context.Context) (publishChannel, error) {
+	var ch publishChannel
+	select {
+	case ch = <-p.chans:
+	case <-ctx.Done():
+		return nil, ErrPublisherBusy
+	}
+
+	if ch.isClosed() {
+		fresh, err := p.open()
+		if err != nil {
+			p.chans <- ch
+			return nil, err
+		}
+		ch = fresh
+	}
+	return ch, nil
+}
+
+func (p *channelPool) release(ch publishChannel) {
+	p.chans <- ch
+}
+
+// close closes every channel currently in the pool.
+func (p *channelPool) close() {
+	for {
+		select {
+		case ch := <-p.chans:
+			_ = ch.close()
+		default:
+			return
+		}
+	}
+}
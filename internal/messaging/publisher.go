@@ -3,56 +3,139 @@ package messaging
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"log"
 	"strings"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/smarthall/webhook-relay/internal/envelope"
 )
 
+// unroutable counts mandatory messages returned by the broker.
+var unroutable = expvar.NewInt("publish_unroutable_total")
+
+// defaultPublishChannels is the number of pooled publishing channels used
+// when PublisherConfig.Channels is zero.
+const defaultPublishChannels = 8
+
+// PublisherConfig controls where the Publisher sends webhooks.
+type PublisherConfig struct {
+	Exchange ExchangeConfig
+	Routing  HeaderRouting
+	// Channels is the number of AMQP channels publishes are spread over.
+	// When all are busy, Publish waits for one to free up.
+	Channels int
+	// Encryption, when set, encrypts message bodies with its first key.
+	// Routing headers are still sent in the clear.
+	Encryption *envelope.Keyring
+}
+
+// PublishOptions adjust how a single message is published.
+type PublishOptions struct {
+	// Mandatory asks the broker to return the message if no queue is bound
+	// for it, in which case Publish fails with ErrUnroutable.
+	Mandatory bool
+	// AlternateExchange receives mandatory messages the broker returned,
+	// with the same routing key. Publish then succeeds.
+	AlternateExchange string
+}
+
+// Publisher publishes webhooks to the exchange. It is safe for concurrent
+// use: each publish borrows a channel from a pool and waits for the broker to
+// confirm the message before returning it.
 type Publisher struct {
-	conn *amqp.Connection
-	ch   *amqp.Channel
+	pool     *channelPool
+	exchange string
+	routing  HeaderRouting
+	timeout  time.Duration
+	blocked  *blockState
+	keys     *envelope.Keyring
 }
 
-func NewPublisher(amqpUri string) *Publisher {
+func NewPublisher(connCfg ConnectionConfig, cfg PublisherConfig) *Publisher {
 	var err error
 	// ensure pooled connections are initialized
-	if err = InitConnections(amqpUri); err != nil {
+	if err = InitConnections(connCfg); err != nil {
 		log.Panicf("Failed to initialize RabbitMQ connections: %s", err)
 	}
 
-	conn := GetPubConn()
-	if conn == nil {
-		log.Panicf("publisher connection is nil")
+	if err = declareExchangeOn(GetPubConn(), cfg.Exchange); err != nil {
+		log.Panicf("Failed to declare exchange: %s", err)
 	}
+	// The exchange may not exist on the node a reconnect lands on.
+	onReconnect(func() {
+		if err := declareExchangeOn(GetPubConn(), cfg.Exchange); err != nil {
+			log.Printf("Failed to declare exchange after reconnecting: %s", err)
+		}
+	})
 
+	// Channels on a lost connection are closed, so the pool reopens them on
+	// whichever connection is current.
+	p, err := newPublisher(cfg, func() (publishChannel, error) {
+		conn := GetPubConn()
+		if conn == nil {
+			return nil, amqp.ErrClosed
+		}
+		return openConfirmChannel(conn)
+	})
+	if err != nil {
+		log.Panicf("Failed to open publishing channels: %s", err)
+	}
+	p.blocked = pubBlocked
+
+	return p
+}
+
+// declareExchangeOn declares the exchange on a short-lived channel of conn.
+func declareExchangeOn(conn *amqp.Connection, e ExchangeConfig) error {
+	if conn == nil {
+		return amqp.ErrClosed
+	}
 	ch, err := conn.Channel()
 	if err != nil {
-		log.Panicf("Failed to open a channel: %s", err)
+		return err
 	}
+	defer ch.Close()
+	return declareExchange(ch, e)
+}
 
-	err = ch.ExchangeDeclare(
-		"webhooks", // name
-		"topic",    // type
-		true,       // durable
-		false,      // auto-deleted
-		false,      // internal
-		false,      // no-wait
-		nil,        // arguments
-	)
+// newPublisher builds a Publisher whose channels are created by open.
+func newPublisher(cfg PublisherConfig, open func() (publishChannel, error)) (*Publisher, error) {
+	size := cfg.Channels
+	if size <= 0 {
+		size = defaultPublishChannels
+	}
+	pool, err := newChannelPool(size, open)
 	if err != nil {
-		log.Panicf("Failed to declare exchange: %s", err)
+		return nil, err
 	}
 
 	return &Publisher{
-		conn: conn,
-		ch:   ch,
-	}
+		pool:     pool,
+		exchange: cfg.Exchange.withDefaults().Name,
+		routing:  cfg.Routing,
+		timeout:  time.Second,
+		keys:     cfg.Encryption,
+	}, nil
 }
 
-func (p *Publisher) Publish(msg RequestMessage) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+// Publish sends msg to the exchange and waits for the broker to confirm it.
+// Time spent waiting for a free channel counts towards the publish timeout;
+// if none frees up in time ErrPublisherBusy is returned. While the broker is
+// blocking the connection Publish fails immediately with ErrBlocked, and
+// while reconnecting with ErrDisconnected.
+func (p *Publisher) Publish(msg RequestMessage, opts PublishOptions) error {
+	if blocked, reason := p.blocked.Blocked(); blocked {
+		return fmt.Errorf("%w: %s", ErrBlocked, reason)
+	}
+	if connectionsDown() {
+		return ErrDisconnected
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
 	defer cancel()
 
 	json, err := json.Marshal(msg)
@@ -60,17 +143,40 @@ func (p *Publisher) Publish(msg RequestMessage) error {
 		return err
 	}
 
+	ch, err := p.pool.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer p.pool.release(ch)
+
 	routingKey := strings.Trim(strings.Replace(msg.Path, "/", ".", -1), ".")
-	err = p.ch.PublishWithContext(ctx,
-		"webhooks", // exchange
-		routingKey, // routing key
-		false,      // mandatory
-		false,      // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        json,
-		})
+	publishing := amqp.Publishing{
+		ContentType: "application/json",
+		MessageId:   msg.ID,
+		Headers:     p.routing.routingHeaders(msg),
+		Body:        json,
+	}
+	if p.keys != nil {
+		if err := seal(&publishing, p.keys); err != nil {
+			return err
+		}
+	}
+	mandatory := opts.Mandatory || opts.AlternateExchange != ""
+	err = ch.publish(ctx, p.exchange, routingKey, mandatory, publishing)
+	if errors.Is(err, ErrUnroutable) {
+		unroutable.Add(1)
+		if opts.AlternateExchange != "" {
+			err = ch.publish(ctx, opts.AlternateExchange, routingKey, false, publishing)
+			if err == nil {
+				log.Printf("Published unroutable message for %s to alternate exchange %s", routingKey, opts.AlternateExchange)
+			}
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
 	log.Printf("Published message to %s", routingKey)
 
-	return err
+	return nil
 }
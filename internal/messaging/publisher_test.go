@@ -0,0 +1,259 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/smarthall/webhook-relay/internal/envelope"
+)
+
+// fakeChannel simulates a broker that confirms each publish after latency.
+// It records concurrent use so tests can check channels aren't shared.
+// Mandatory publishes to an exchange listed in unbound are returned.
+type fakeChannel struct {
+	latency time.Duration
+	unbound map[string]bool
+
+	mu        sync.Mutex
+	inUse     bool
+	shared    bool
+	exchanges []string
+	published []amqp.Publishing
+	closed    bool
+}
+
+func (f *fakeChannel) publish(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) error {
+	f.mu.Lock()
+	if f.inUse {
+		f.shared = true
+	}
+	if mandatory && f.unbound[exchange] {
+		f.mu.Unlock()
+		return ErrUnroutable
+	}
+	f.inUse = true
+	f.exchanges = append(f.exchanges, exchange)
+	f.published = append(f.published, msg)
+	f.mu.Unlock()
+
+	if f.latency > 0 {
+		time.Sleep(f.latency)
+	}
+
+	f.mu.Lock()
+	f.inUse = false
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakeChannel) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *fakeChannel) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// fakeChannels returns an open function handing out fakeChannels and the
+// slice they are recorded in.
+func fakeChannels(latency time.Duration) (func() (publishChannel, error), *[]*fakeChannel) {
+	var chans []*fakeChannel
+	var mu sync.Mutex
+	return func() (publishChannel, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		ch := &fakeChannel{latency: latency}
+		chans = append(chans, ch)
+		return ch, nil
+	}, &chans
+}
+
+func TestPublisherConcurrentChannelsNotShared(t *testing.T) {
+	open, chans := fakeChannels(time.Millisecond)
+	p, err := newPublisher(PublisherConfig{Channels: 4}, open)
+	if err != nil {
+		t.Fatalf("newPublisher: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := p.Publish(RequestMessage{Path: fmt.Sprintf("/hook/%d", i)}, PublishOptions{}); err != nil {
+				t.Errorf("Publish: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, ch := range *chans {
+		if ch.shared {
+			t.Fatalf("channel used by two publishes at once")
+		}
+		total += len(ch.published)
+	}
+	if total != 32 {
+		t.Fatalf("expected 32 publishes, got %d", total)
+	}
+}
+
+func TestPublisherBusy(t *testing.T) {
+	open, _ := fakeChannels(50 * time.Millisecond)
+	p, err := newPublisher(PublisherConfig{Channels: 1}, open)
+	if err != nil {
+		t.Fatalf("newPublisher: %v", err)
+	}
+	p.timeout = 10 * time.Millisecond
+
+	// Hold the only channel so the next publish can't get one.
+	ch, err := p.pool.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	defer p.pool.release(ch)
+
+	if err := p.Publish(RequestMessage{Path: "/busy"}, PublishOptions{}); !errors.Is(err, ErrPublisherBusy) {
+		t.Fatalf("expected ErrPublisherBusy, got %v", err)
+	}
+}
+
+func TestPublisherReopensClosedChannel(t *testing.T) {
+	open, chans := fakeChannels(0)
+	p, err := newPublisher(PublisherConfig{Channels: 1}, open)
+	if err != nil {
+		t.Fatalf("newPublisher: %v", err)
+	}
+	_ = (*chans)[0].close()
+
+	if err := p.Publish(RequestMessage{Path: "/reopen"}, PublishOptions{}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if len(*chans) != 2 || len((*chans)[1].published) != 1 {
+		t.Fatalf("expected publish on a reopened channel")
+	}
+}
+
+func TestPublisherUnroutable(t *testing.T) {
+	var ch *fakeChannel
+	p, err := newPublisher(PublisherConfig{Channels: 1}, func() (publishChannel, error) {
+		ch = &fakeChannel{unbound: map[string]bool{"webhooks": true}}
+		return ch, nil
+	})
+	if err != nil {
+		t.Fatalf("newPublisher: %v", err)
+	}
+	msg := RequestMessage{Path: "/nobody/listens"}
+
+	// Without mandatory the broker silently drops the message.
+	if err := p.Publish(msg, PublishOptions{}); err != nil {
+		t.Fatalf("expected non-mandatory publish to succeed, got %v", err)
+	}
+
+	if err := p.Publish(msg, PublishOptions{Mandatory: true}); !errors.Is(err, ErrUnroutable) {
+		t.Fatalf("expected ErrUnroutable, got %v", err)
+	}
+
+	if err := p.Publish(msg, PublishOptions{AlternateExchange: "unroutable"}); err != nil {
+		t.Fatalf("expected publish to alternate exchange to succeed, got %v", err)
+	}
+	if last := ch.exchanges[len(ch.exchanges)-1]; last != "unroutable" {
+		t.Fatalf("expected message on alternate exchange, got %q", last)
+	}
+}
+
+func TestPublisherEncryption(t *testing.T) {
+	line, _, err := envelope.Generate("k1", envelope.TypeAES)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	keys, err := envelope.Parse(strings.NewReader(line))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	var ch *fakeChannel
+	p, err := newPublisher(PublisherConfig{Channels: 1, Encryption: keys}, func() (publishChannel, error) {
+		ch = &fakeChannel{}
+		return ch, nil
+	})
+	if err != nil {
+		t.Fatalf("newPublisher: %v", err)
+	}
+
+	if err := p.Publish(RequestMessage{Path: "/secret", Body: "customer data"}, PublishOptions{}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	pub := ch.published[0]
+	if strings.Contains(string(pub.Body), "customer data") || pub.Headers[headerKeyID] != "k1" {
+		t.Fatalf("expected an encrypted body with its key ID, got %+v", pub)
+	}
+
+	d := amqp.Delivery{Headers: pub.Headers, Body: pub.Body}
+	if _, err := DeliveryBody(d, nil); err == nil {
+		t.Fatalf("expected an error without keys")
+	}
+	body, err := DeliveryBody(d, keys)
+	if err != nil {
+		t.Fatalf("DeliveryBody: %v", err)
+	}
+	var msg RequestMessage
+	if err := json.Unmarshal(body, &msg); err != nil || msg.Body != "customer data" {
+		t.Fatalf("expected the original message, got %q (%v)", body, err)
+	}
+
+	// Unencrypted messages are refused when keys are configured, and pass
+	// through otherwise.
+	plain := amqp.Delivery{Body: []byte("{}")}
+	if _, err := DeliveryBody(plain, keys); !errors.Is(err, ErrUnencrypted) {
+		t.Fatalf("expected ErrUnencrypted, got %v", err)
+	}
+	if body, err := DeliveryBody(plain, nil); err != nil || string(body) != "{}" {
+		t.Fatalf("expected plain message unchanged, got %q (%v)", body, err)
+	}
+}
+
+// BenchmarkPublisher measures publish throughput under high request
+// concurrency against a simulated broker with a 200µs confirm round trip.
+// A single channel serialises every publish; a pool lets confirms overlap.
+func BenchmarkPublisher(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, channels := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("channels=%d", channels), func(b *testing.B) {
+			open, _ := fakeChannels(200 * time.Microsecond)
+			p, err := newPublisher(PublisherConfig{Channels: channels}, open)
+			if err != nil {
+				b.Fatalf("newPublisher: %v", err)
+			}
+			p.timeout = time.Minute
+			msg := RequestMessage{Method: "POST", Path: "/bench", Body: `{"hello":"world"}`}
+
+			b.SetParallelism(64)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := p.Publish(msg, PublishOptions{}); err != nil {
+						b.Errorf("Publish: %v", err)
+					}
+				}
+			})
+		})
+	}
+}
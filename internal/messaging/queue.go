@@ -0,0 +1,138 @@
+package messaging
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// QueueArguments are the optional x-arguments used when declaring the
+// subscriber queue. Zero values are omitted so the broker (or a policy) decides.
+type QueueArguments struct {
+	// Type is the x-queue-type: classic, quorum or stream.
+	Type string
+	// MessageTTL discards messages older than this (x-message-ttl).
+	MessageTTL time.Duration
+	// MaxLength caps the number of ready messages (x-max-length).
+	MaxLength int
+	// MaxLengthBytes caps the total size of ready messages (x-max-length-bytes).
+	MaxLengthBytes int
+	// Overflow is the behaviour when a limit is hit (x-overflow): drop-head,
+	// reject-publish or reject-publish-dlx.
+	Overflow string
+	// SingleActiveConsumer lets only one consumer receive messages at a time
+	// (x-single-active-consumer).
+	SingleActiveConsumer bool
+}
+
+// Validate checks the arguments for values the broker would reject.
+func (a QueueArguments) Validate() error {
+	switch a.Type {
+	case "", amqp.QueueTypeClassic, amqp.QueueTypeQuorum, amqp.QueueTypeStream:
+	default:
+		return fmt.Errorf("unsupported queue type %q (want classic, quorum or stream)", a.Type)
+	}
+
+	switch a.Overflow {
+	case "", amqp.QueueOverflowDropHead, amqp.QueueOverflowRejectPublish:
+	case amqp.QueueOverflowRejectPublishDLX:
+		if a.Type == amqp.QueueTypeQuorum {
+			return errors.New("quorum queues do not support overflow reject-publish-dlx")
+		}
+	default:
+		return fmt.Errorf("unsupported overflow %q (want drop-head, reject-publish or reject-publish-dlx)", a.Overflow)
+	}
+
+	if a.MessageTTL < 0 || a.MaxLength < 0 || a.MaxLengthBytes < 0 {
+		return errors.New("queue limits must not be negative")
+	}
+
+	if a.Type == amqp.QueueTypeStream && (a.MessageTTL != 0 || a.MaxLength != 0 || a.Overflow != "") {
+		return errors.New("stream queues only support a max length in bytes")
+	}
+
+	return nil
+}
+
+// durable reports whether the arguments require a durable, non-exclusive
+// queue.
+func (a QueueArguments) durable() bool {
+	return a.Type == amqp.QueueTypeQuorum || a.Type == amqp.QueueTypeStream
+}
+
+// table converts the arguments to an AMQP table, or nil when none are set.
+func (a QueueArguments) table() amqp.Table {
+	t := amqp.Table{}
+	if a.Type != "" {
+		t[amqp.QueueTypeArg] = a.Type
+	}
+	if a.MessageTTL > 0 {
+		t[amqp.QueueMessageTTLArg] = a.MessageTTL.Milliseconds()
+	}
+	if a.MaxLength > 0 {
+		t[amqp.QueueMaxLenArg] = int64(a.MaxLength)
+	}
+	if a.MaxLengthBytes > 0 {
+		t[amqp.QueueMaxLenBytesArg] = int64(a.MaxLengthBytes)
+	}
+	if a.Overflow != "" {
+		t[amqp.QueueOverflowArg] = a.Overflow
+	}
+	if a.SingleActiveConsumer {
+		t[amqp.SingleActiveConsumerArg] = true
+	}
+	if len(t) == 0 {
+		return nil
+	}
+	return t
+}
+
+// declareQueue declares (or, in passive mode, verifies) the queue described
+// by cfg. A named queue is durable and non-exclusive; otherwise a
+// server-named exclusive queue is declared.
+func declareQueue(ch *amqp.Channel, cfg SubscriberConfig) (amqp.Queue, error) {
+	if err := cfg.Queue.Validate(); err != nil {
+		return amqp.Queue{}, err
+	}
+
+	if cfg.QueueName == "" {
+		if cfg.Queue.durable() {
+			return amqp.Queue{}, fmt.Errorf("%s queues must be named", cfg.Queue.Type)
+		}
+		return ch.QueueDeclare(
+			"",                // name
+			false,             // durable
+			false,             // delete when unused
+			true,              // exclusive
+			false,             // no-wait
+			cfg.Queue.table(), // arguments
+		)
+	}
+
+	if cfg.Exchange.Passive {
+		return ch.QueueDeclarePassive(
+			cfg.QueueName, // name
+			true,          // durable
+			false,         // delete when unused
+			false,         // exclusive
+			false,         // no-wait
+			nil,           // arguments
+		)
+	}
+
+	q, err := ch.QueueDeclare(
+		cfg.QueueName,     // name
+		true,              // durable
+		false,             // delete when unused
+		false,             // exclusive
+		false,             // no-wait
+		cfg.Queue.table(), // arguments
+	)
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+		return q, fmt.Errorf("queue %q already exists with different arguments (%s); delete it or change the queue settings to match", cfg.QueueName, amqpErr.Reason)
+	}
+	return q, err
+}
@@ -0,0 +1,66 @@
+package messaging
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestQueueArgumentsTable(t *testing.T) {
+	if got := (QueueArguments{}).table(); got != nil {
+		t.Fatalf("expected nil table for empty arguments, got %v", got)
+	}
+
+	args := QueueArguments{
+		Type:                 amqp.QueueTypeQuorum,
+		MessageTTL:           90 * time.Second,
+		MaxLength:            1000,
+		MaxLengthBytes:       1 << 20,
+		Overflow:             amqp.QueueOverflowRejectPublish,
+		SingleActiveConsumer: true,
+	}
+	got := args.table()
+	want := amqp.Table{
+		"x-queue-type":             "quorum",
+		"x-message-ttl":            int64(90000),
+		"x-max-length":             int64(1000),
+		"x-max-length-bytes":       int64(1 << 20),
+		"x-overflow":               "reject-publish",
+		"x-single-active-consumer": true,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("expected %s=%v, got %v", k, v, got[k])
+		}
+	}
+}
+
+func TestQueueArgumentsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    QueueArguments
+		wantErr bool
+	}{
+		{name: "empty", args: QueueArguments{}},
+		{name: "classic-limits", args: QueueArguments{Type: "classic", MaxLength: 10, Overflow: "reject-publish-dlx"}},
+		{name: "unknown-type", args: QueueArguments{Type: "lazy"}, wantErr: true},
+		{name: "unknown-overflow", args: QueueArguments{Overflow: "block"}, wantErr: true},
+		{name: "quorum-dlx", args: QueueArguments{Type: "quorum", Overflow: "reject-publish-dlx"}, wantErr: true},
+		{name: "stream-ttl", args: QueueArguments{Type: "stream", MessageTTL: time.Minute}, wantErr: true},
+		{name: "stream-bytes", args: QueueArguments{Type: "stream", MaxLengthBytes: 1 << 30}},
+		{name: "negative", args: QueueArguments{MaxLength: -1}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.args.Validate()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error=%v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
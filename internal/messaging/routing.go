@@ -0,0 +1,106 @@
+package messaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// HeaderRouting selects request headers and JSON body fields that are copied
+// into AMQP message headers so that headers exchanges can route on them.
+type HeaderRouting struct {
+	// Headers lists request header names. Each is copied to an AMQP header of
+	// the same name, exactly as written here.
+	Headers []string
+	// BodyFields lists dot-separated paths into a JSON request body, e.g.
+	// "repository.full_name". Each is copied to an AMQP header named after
+	// the path. Objects and arrays are skipped.
+	BodyFields []string
+}
+
+// routingHeaders builds the AMQP header table for msg. It returns nil when
+// nothing is configured or nothing matched.
+func (hr HeaderRouting) routingHeaders(msg RequestMessage) amqp.Table {
+	if len(hr.Headers) == 0 && len(hr.BodyFields) == 0 {
+		return nil
+	}
+
+	table := amqp.Table{}
+	headers := http.Header(msg.Headers)
+	for _, name := range hr.Headers {
+		if v := headers.Get(name); v != "" {
+			table[name] = v
+		}
+	}
+
+	if len(hr.BodyFields) > 0 {
+		if body, err := decodeJSON(msg.Body); err == nil {
+			for _, path := range hr.BodyFields {
+				if v, ok := lookupField(body, path); ok {
+					table[path] = v
+				}
+			}
+		}
+	}
+
+	if len(table) == 0 {
+		return nil
+	}
+	return table
+}
+
+// BodyField returns the scalar at a dot-separated path in a JSON body,
+// formatted as a string. It returns false if the body isn't JSON or the path
+// doesn't lead to a string, number or boolean.
+func BodyField(body string, path string) (string, bool) {
+	v, err := decodeJSON(body)
+	if err != nil {
+		return "", false
+	}
+	return lookupField(v, path)
+}
+
+func decodeJSON(body string) (interface{}, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewBufferString(body))
+	dec.UseNumber()
+	err := dec.Decode(&v)
+	return v, err
+}
+
+// lookupField walks a decoded JSON value along a dot-separated path and
+// returns the scalar found there formatted as a string.
+func lookupField(v interface{}, path string) (string, bool) {
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = obj[part]; !ok {
+			return "", false
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number, bool:
+		return fmt.Sprint(v), true
+	default:
+		return "", false
+	}
+}
+
+// ParseHeaderMatch parses "name=value" into its parts, as used for headers
+// exchange bindings.
+func ParseHeaderMatch(s string) (string, string, error) {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("invalid header match %q: want name=value", s)
+	}
+	return name, value, nil
+}
@@ -0,0 +1,40 @@
+package messaging
+
+import (
+	"testing"
+)
+
+func TestRoutingHeaders(t *testing.T) {
+	msg := RequestMessage{
+		Headers: map[string][]string{"X-Github-Event": {"push"}},
+		Body:    `{"repository":{"full_name":"smarthall/webhook-relay","id":42,"private":false,"owner":{}}}`,
+	}
+
+	hr := HeaderRouting{
+		Headers:    []string{"X-GitHub-Event", "X-Missing"},
+		BodyFields: []string{"repository.full_name", "repository.id", "repository.private", "repository.owner", "nope.nope"},
+	}
+	got := hr.routingHeaders(msg)
+
+	want := map[string]string{
+		"X-GitHub-Event":       "push",
+		"repository.full_name": "smarthall/webhook-relay",
+		"repository.id":        "42",
+		"repository.private":   "false",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d headers, got %d: %v", len(want), len(got), got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("expected %s=%q, got %v", k, v, got[k])
+		}
+	}
+}
+
+func TestRoutingHeadersNonJSONBody(t *testing.T) {
+	hr := HeaderRouting{BodyFields: []string{"a"}}
+	if got := hr.routingHeaders(RequestMessage{Body: "a=b"}); got != nil {
+		t.Fatalf("expected no headers for non-JSON body, got %v", got)
+	}
+}
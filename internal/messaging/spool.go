@@ -0,0 +1,150 @@
+package messaging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Spool stores messages as JSON files in a directory, one file per message,
+// named so that listing them returns them in the order they were written.
+type Spool struct {
+	dir string
+}
+
+// NewSpool creates dir if needed and returns a Spool writing to it.
+func NewSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &Spool{dir: dir}, nil
+}
+
+// Write atomically stores msg in the spool.
+func (s *Spool) Write(msg RequestMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	name := fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), hex.EncodeToString(suffix))
+
+	// Write under a dot-prefixed name first so a partial file is never
+	// listed.
+	tmp := filepath.Join(s.dir, "."+name)
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, name))
+}
+
+// list returns the names of spooled messages, oldest first.
+func (s *Spool) list() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Drain republishes spooled messages in order using publish, removing each
+// once it has been published. It stops at the first error and returns the
+// number of messages published.
+func (s *Spool) Drain(publish func(RequestMessage) error) (int, error) {
+	names, err := s.list()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, name := range names {
+		path := filepath.Join(s.dir, name)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return i, err
+		}
+		var msg RequestMessage
+		if err := json.Unmarshal(b, &msg); err != nil {
+			return i, fmt.Errorf("corrupt spool file %s: %w", path, err)
+		}
+		if err := publish(msg); err != nil {
+			return i, err
+		}
+		if err := os.Remove(path); err != nil {
+			return i + 1, err
+		}
+	}
+	return len(names), nil
+}
+
+// SpoolingPublisher wraps a Publisher and writes messages to a spool instead
+// of failing while the broker is blocking the connection. Spooled messages
+// are republished by Run once the block clears, without their
+// PublishOptions: the sender has already been told they were accepted.
+type SpoolingPublisher struct {
+	pub interface {
+		Publish(RequestMessage, PublishOptions) error
+	}
+	spool *Spool
+}
+
+func NewSpoolingPublisher(pub interface {
+	Publish(RequestMessage, PublishOptions) error
+}, spool *Spool) *SpoolingPublisher {
+	return &SpoolingPublisher{pub: pub, spool: spool}
+}
+
+// Publish publishes msg, spooling it to disk if the broker is blocked.
+func (s *SpoolingPublisher) Publish(msg RequestMessage, opts PublishOptions) error {
+	err := s.pub.Publish(msg, opts)
+	if !errors.Is(err, ErrBlocked) {
+		return err
+	}
+	if err := s.spool.Write(msg); err != nil {
+		return fmt.Errorf("failed to spool message: %w", err)
+	}
+	log.Printf("Spooled message for %s while broker is blocked", msg.Path)
+	return nil
+}
+
+// Run drains the spool every interval until ctx is done.
+func (s *SpoolingPublisher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.spool.Drain(func(msg RequestMessage) error {
+				return s.pub.Publish(msg, PublishOptions{})
+			})
+			if n > 0 {
+				log.Printf("Republished %d spooled messages", n)
+			}
+			if err != nil && !errors.Is(err, ErrBlocked) {
+				log.Printf("Failed to drain spool: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package messaging
+
+import (
+	"errors"
+	"testing"
+)
+
+// switchPub fails with ErrBlocked while blocked is set and records published
+// messages otherwise.
+type switchPub struct {
+	blocked   bool
+	published []RequestMessage
+}
+
+func (p *switchPub) Publish(msg RequestMessage, opts PublishOptions) error {
+	if p.blocked {
+		return ErrBlocked
+	}
+	p.published = append(p.published, msg)
+	return nil
+}
+
+func TestSpoolingPublisher(t *testing.T) {
+	spool, err := NewSpool(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewSpool: %v", err)
+	}
+	pub := &switchPub{blocked: true}
+	sp := NewSpoolingPublisher(pub, spool)
+
+	for _, path := range []string{"/one", "/two", "/three"} {
+		if err := sp.Publish(RequestMessage{Path: path}, PublishOptions{}); err != nil {
+			t.Fatalf("expected blocked publish to be spooled, got %v", err)
+		}
+	}
+	if len(pub.published) != 0 {
+		t.Fatalf("expected nothing published while blocked")
+	}
+
+	publish := func(msg RequestMessage) error { return pub.Publish(msg, PublishOptions{}) }
+
+	// Draining while still blocked leaves the spool intact.
+	if n, err := spool.Drain(publish); n != 0 || !errors.Is(err, ErrBlocked) {
+		t.Fatalf("expected blocked drain to stop, got n=%d err=%v", n, err)
+	}
+
+	pub.blocked = false
+	if n, err := spool.Drain(publish); n != 3 || err != nil {
+		t.Fatalf("expected 3 messages drained, got n=%d err=%v", n, err)
+	}
+	for i, want := range []string{"/one", "/two", "/three"} {
+		if pub.published[i].Path != want {
+			t.Fatalf("expected message %d to be %s, got %s", i, want, pub.published[i].Path)
+		}
+	}
+
+	if names, _ := spool.list(); len(names) != 0 {
+		t.Fatalf("expected empty spool after drain, got %v", names)
+	}
+}
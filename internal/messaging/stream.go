@@ -0,0 +1,100 @@
+package messaging
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const streamOffsetArg = "x-stream-offset"
+
+// defaultStreamPrefetch is the consumer prefetch used for streams when none is
+// configured. RabbitMQ requires a prefetch for stream consumers.
+const defaultStreamPrefetch = 100
+
+// ParseStreamOffset converts a user supplied stream offset into the value
+// sent as the x-stream-offset consumer argument. It accepts "first", "last",
+// "next", a numeric offset, an RFC 3339 timestamp, or a duration such as
+// "24h" meaning that long before now. An empty string returns nil, which
+// leaves the broker default ("next").
+func ParseStreamOffset(s string, now time.Time) (interface{}, error) {
+	switch s {
+	case "":
+		return nil, nil
+	case "first", "last", "next":
+		return s, nil
+	}
+
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n < 0 {
+			return nil, fmt.Errorf("invalid stream offset %q: must not be negative", s)
+		}
+		return n, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return now.Add(-d), nil
+	}
+
+	return nil, fmt.Errorf("invalid stream offset %q: want first, last, next, a number, an RFC 3339 timestamp or a duration", s)
+}
+
+// StreamOffsetOf returns the stream offset of a delivery consumed from a
+// stream queue.
+func StreamOffsetOf(d amqp.Delivery) (int64, bool) {
+	offset, ok := d.Headers[streamOffsetArg].(int64)
+	return offset, ok
+}
+
+// OffsetFile persists the last processed stream offset to a local file so a
+// restarted transmitter can resume where it left off.
+type OffsetFile struct {
+	path string
+}
+
+func NewOffsetFile(path string) *OffsetFile {
+	return &OffsetFile{path: path}
+}
+
+// Load returns the committed offset. The boolean is false when nothing has
+// been committed yet.
+func (f *OffsetFile) Load() (int64, bool, error) {
+	b, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("corrupt offset file %s: %w", f.path, err)
+	}
+	return offset, true, nil
+}
+
+// Commit atomically records offset as processed.
+func (f *OffsetFile) Commit(offset int64) error {
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(strconv.FormatInt(offset, 10) + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
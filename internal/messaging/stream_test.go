@@ -0,0 +1,63 @@
+package messaging
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseStreamOffset(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		in      string
+		want    interface{}
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "first", want: "first"},
+		{in: "last", want: "last"},
+		{in: "next", want: "next"},
+		{in: "1234", want: int64(1234)},
+		{in: "2025-05-31T12:00:00Z", want: time.Date(2025, 5, 31, 12, 0, 0, 0, time.UTC)},
+		{in: "24h", want: now.Add(-24 * time.Hour)},
+		{in: "-5", wantErr: true},
+		{in: "yesterday", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := ParseStreamOffset(tc.in, now)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error=%v, got %v", tc.wantErr, err)
+			}
+			if tm, ok := tc.want.(time.Time); ok {
+				if gt, ok := got.(time.Time); !ok || !gt.Equal(tm) {
+					t.Fatalf("expected %v, got %v", tm, got)
+				}
+				return
+			}
+			if got != tc.want {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestOffsetFile(t *testing.T) {
+	f := NewOffsetFile(filepath.Join(t.TempDir(), "offset"))
+
+	if _, ok, err := f.Load(); err != nil || ok {
+		t.Fatalf("expected no committed offset, got ok=%v err=%v", ok, err)
+	}
+
+	for _, offset := range []int64{7, 42} {
+		if err := f.Commit(offset); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+		got, ok, err := f.Load()
+		if err != nil || !ok || got != offset {
+			t.Fatalf("expected offset %d, got %d ok=%v err=%v", offset, got, ok, err)
+		}
+	}
+}
@@ -1,95 +1,256 @@
 package messaging
 
 import (
+	"fmt"
 	"log"
+	"sync"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// SubscriberConfig describes the queue a Subscriber consumes from and how it
+// is bound to the exchange.
+type SubscriberConfig struct {
+	Exchange ExchangeConfig
+	// Key is the routing key used to bind the queue to the exchange.
+	Key string
+	// QueueName names a durable, non-exclusive queue. When empty a
+	// server-named exclusive queue is used.
+	QueueName string
+	// Match binds the queue with these header arguments, for use with a
+	// headers exchange.
+	Match map[string]string
+	// MatchAny sets x-match to "any" instead of "all".
+	MatchAny bool
+	// Queue holds the x-arguments used when declaring the queue.
+	Queue QueueArguments
+	// Prefetch limits the number of unacknowledged deliveries. When set,
+	// deliveries must be acknowledged by the caller.
+	Prefetch int
+	// StreamOffset is the x-stream-offset to start consuming a stream from,
+	// as returned by ParseStreamOffset.
+	StreamOffset interface{}
+	// ConsumerTag identifies the consumer in the management UI. When empty
+	// the broker generates one.
+	ConsumerTag string
+}
+
+// Validate checks the exchange and queue arguments, and that the binding
+// suits the exchange type.
+func (c SubscriberConfig) Validate() error {
+	if err := c.Exchange.Validate(); err != nil {
+		return err
+	}
+	if err := c.Queue.Validate(); err != nil {
+		return err
+	}
+	return c.Exchange.validateBinding(c.Key, c.Match)
+}
+
+// bindArgs returns the queue binding arguments for a headers exchange match,
+// or nil when no match is configured.
+func (c SubscriberConfig) bindArgs() amqp.Table {
+	if len(c.Match) == 0 {
+		return nil
+	}
+	args := amqp.Table{"x-match": "all"}
+	if c.MatchAny {
+		args["x-match"] = "any"
+	}
+	for k, v := range c.Match {
+		args[k] = v
+	}
+	return args
+}
+
+// Subscriber consumes a queue bound to the exchange. It survives reconnects:
+// the queue is declared and bound again on the new connection and consuming
+// resumes, from just after the last settled offset for streams.
 type Subscriber struct {
-	conn *amqp.Connection
-	ch   *amqp.Channel
-	q    amqp.Queue
+	cfg SubscriberConfig
+
+	mu sync.Mutex
+	ch *amqp.Channel
+	q  amqp.Queue
+	// resume is the stream offset to consume from after a reconnect, once a
+	// delivery has been settled.
+	resume interface{}
 }
 
-func NewSubscriber(amqpUri string, key string, queueName string) *Subscriber {
-	if err := InitConnections(amqpUri); err != nil {
+func NewSubscriber(connCfg ConnectionConfig, cfg SubscriberConfig) *Subscriber {
+	if err := InitConnections(connCfg); err != nil {
 		log.Panicf("Failed to initialize RabbitMQ connections: %s", err)
 	}
 
-	conn := GetSubConn()
-	if conn == nil {
-		log.Panicf("subscriber connection is nil")
+	s := &Subscriber{cfg: cfg}
+	if err := s.declare(GetSubConn()); err != nil {
+		log.Panicf("Failed to %s", err)
 	}
+	return s
+}
 
+// declare opens a channel on conn and declares and binds the queue on it.
+func (s *Subscriber) declare(conn *amqp.Connection) error {
+	if conn == nil {
+		return fmt.Errorf("open a channel: %w", amqp.ErrClosed)
+	}
 	ch, err := conn.Channel()
 	if err != nil {
-		log.Panicf("Failed to open a channel: %s", err)
+		return fmt.Errorf("open a channel: %w", err)
 	}
 
-	err = ch.ExchangeDeclare(
-		"webhooks", // name
-		"topic",    // type
-		true,       // durable
-		false,      // auto-deleted
-		false,      // internal
-		false,      // no-wait
-		nil,        // arguments
-	)
-	if err != nil {
-		log.Panicf("Failed to declare exchange: %s", err)
-	}
-
-	var q amqp.Queue
-	if queueName != "" {
-		q, err = ch.QueueDeclare(
-			queueName, // name
-			true,      // durable
-			false,     // delete when unused
-			false,     // exclusive
-			false,     // no-wait
-			nil,       // arguments
-		)
-	} else {
-		q, err = ch.QueueDeclare(
-			"",    // name
-			false, // durable
-			false, // delete when unused
-			true,  // exclusive
-			false, // no-wait
-			nil,   // arguments
-		)
+	if err = declareExchange(ch, s.cfg.Exchange); err != nil {
+		_ = ch.Close()
+		return fmt.Errorf("declare exchange: %w", err)
 	}
+	exchange := s.cfg.Exchange.withDefaults().Name
+
+	q, err := declareQueue(ch, s.cfg)
 	if err != nil {
-		log.Panicf("Failed to declare queue: %s", err)
+		_ = ch.Close()
+		return fmt.Errorf("declare queue: %w", err)
 	}
 	log.Printf("Declared queue %s", q.Name)
 
-	err = ch.QueueBind(q.Name, key, "webhooks", false, nil)
+	err = ch.QueueBind(q.Name, s.cfg.Key, exchange, false, s.cfg.bindArgs())
 	if err != nil {
-		log.Panicf("Failed to bind queue: %s", err)
+		_ = ch.Close()
+		return fmt.Errorf("bind queue: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ch, s.q = ch, q
+	return nil
+}
+
+// ManualAck reports whether deliveries from Subscribe must be acknowledged by
+// the caller. This is the case for streams and whenever a prefetch is set.
+func (s *Subscriber) ManualAck() bool {
+	return s.cfg.Prefetch > 0 || s.isStream()
+}
+
+// Settle acknowledges a delivery once it has been processed. Failed
+// deliveries are rejected without requeueing so a dead letter exchange can
+// pick them up; streams do not support rejection so they are always
+// acknowledged. It does nothing when the subscriber uses automatic
+// acknowledgement.
+func (s *Subscriber) Settle(d amqp.Delivery, processErr error) error {
+	if !s.ManualAck() {
+		return nil
+	}
+	if processErr != nil && !s.isStream() {
+		return d.Nack(false, false)
+	}
+	if offset, ok := StreamOffsetOf(d); ok && s.isStream() {
+		s.mu.Lock()
+		s.resume = offset + 1
+		s.mu.Unlock()
 	}
+	return d.Ack(false)
+}
 
-	return &Subscriber{
-		conn: conn,
-		ch:   ch,
-		q:    q,
+// Release hands an unprocessed delivery back to the broker so it is
+// redelivered, for example when shutting down mid-delivery. Streams keep
+// their position through the committed offset instead, so nothing is sent.
+func (s *Subscriber) Release(d amqp.Delivery) error {
+	if !s.ManualAck() || s.isStream() {
+		return nil
 	}
+	return d.Nack(false, true)
+}
+
+func (s *Subscriber) isStream() bool {
+	return s.cfg.Queue.Type == amqp.QueueTypeStream
 }
 
+// Subscribe starts consuming the queue. The returned channel carries on
+// across reconnects. Deliveries received before a connection was lost can no
+// longer be settled, and the broker delivers them again. The channel is closed
+// if consuming can't be resumed, or once the connections are closed.
 func (s *Subscriber) Subscribe() (<-chan amqp.Delivery, error) {
-	msgs, err := s.ch.Consume(
-		s.q.Name, // queue
-		"",       // consumer
-		true,     // auto ack
-		false,    // exclusive
-		false,    // no local
-		false,    // no wait
-		nil,      // args
-	)
+	_, next := reconnectState()
+	msgs, err := s.consume()
 	if err != nil {
 		return nil, err
 	}
 
-	return msgs, nil
+	out := make(chan amqp.Delivery)
+	go s.forward(msgs, next, out)
+	return out, nil
+}
+
+// forward copies deliveries to out, consuming again whenever msgs closes.
+// next is closed once the connections have been replaced.
+func (s *Subscriber) forward(msgs <-chan amqp.Delivery, next <-chan struct{}, out chan<- amqp.Delivery) {
+	defer close(out)
+	for {
+		for d := range msgs {
+			out <- d
+		}
+
+		// If only the channel was closed, consume again on the same
+		// connection; otherwise wait for it to be replaced.
+		conn := GetSubConn()
+		if conn != nil && conn.IsClosed() {
+			<-next
+			conn = GetSubConn()
+		}
+		if conn == nil {
+			return
+		}
+
+		_, next = reconnectState()
+		if err := s.declare(conn); err != nil {
+			log.Printf("Failed to %s", err)
+			return
+		}
+		var err error
+		if msgs, err = s.consume(); err != nil {
+			log.Printf("Failed to consume messages: %s", err)
+			return
+		}
+		log.Printf("Resumed consuming queue %s", s.queueName())
+	}
+}
+
+func (s *Subscriber) queueName() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.q.Name
+}
+
+// consume starts a consumer on the current channel.
+func (s *Subscriber) consume() (<-chan amqp.Delivery, error) {
+	s.mu.Lock()
+	ch, q, offset := s.ch, s.q, s.cfg.StreamOffset
+	if s.resume != nil {
+		offset = s.resume
+	}
+	s.mu.Unlock()
+
+	prefetch := s.cfg.Prefetch
+	if prefetch == 0 && s.isStream() {
+		prefetch = defaultStreamPrefetch
+	}
+	if prefetch > 0 {
+		if err := ch.Qos(prefetch, 0, false); err != nil {
+			return nil, err
+		}
+	}
+
+	var args amqp.Table
+	if s.isStream() && offset != nil {
+		args = amqp.Table{streamOffsetArg: offset}
+	}
+
+	return ch.Consume(
+		q.Name,            // queue
+		s.cfg.ConsumerTag, // consumer
+		!s.ManualAck(),    // auto ack
+		false,             // exclusive
+		false,             // no local
+		false,             // no wait
+		args,              // args
+	)
 }
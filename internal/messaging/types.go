@@ -2,40 +2,164 @@ package messaging
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"net/http"
+	"strings"
+
+	"github.com/smarthall/webhook-relay/internal/blob"
 )
 
 type RequestMessage struct {
+	// ID uniquely identifies the webhook as received. It stays the same
+	// across redeliveries, so destinations can use it as an idempotency key.
+	ID      string              `json:"id,omitempty"`
 	Method  string              `json:"method"`
 	Host    string              `json:"host"`
 	Path    string              `json:"path"`
 	Headers map[string][]string `json:"headers"`
 	Body    string              `json:"body"`
+	// BodyRef is the blob store key of a body too large to carry inline, in
+	// which case Body is empty. BodySize is its length in bytes.
+	BodyRef  string `json:"body_ref,omitempty"`
+	BodySize int64  `json:"body_size,omitempty"`
+	// Client is the verified TLS client certificate the webhook was sent
+	// with, if any.
+	Client *ClientIdentity `json:"client,omitempty"`
+}
+
+// ClientIdentity describes a TLS client certificate.
+type ClientIdentity struct {
+	// Subject is the certificate subject as a distinguished name.
+	Subject    string `json:"subject"`
+	CommonName string `json:"common_name,omitempty"`
+	// SANs lists the DNS, email, URI and IP subject alternative names.
+	SANs []string `json:"sans,omitempty"`
+	// Fingerprint is the hex SHA-256 of the certificate.
+	Fingerprint string `json:"fingerprint"`
+}
+
+// ClientIdentityOf returns the identity of the client certificate on a TLS
+// connection, or nil if the client presented none. The server must only
+// accept client certificates it has verified.
+func ClientIdentityOf(cs *tls.ConnectionState) *ClientIdentity {
+	if cs == nil || len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := cs.PeerCertificates[0]
+	sum := sha256.Sum256(cert.Raw)
+	id := &ClientIdentity{
+		Subject:     cert.Subject.String(),
+		CommonName:  cert.Subject.CommonName,
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}
+	id.SANs = append(id.SANs, cert.DNSNames...)
+	id.SANs = append(id.SANs, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		id.SANs = append(id.SANs, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		id.SANs = append(id.SANs, ip.String())
+	}
+	return id
+}
+
+// BodyOffload moves large request bodies out of the message into a blob
+// store.
+type BodyOffload struct {
+	Store blob.Store
+	// Threshold is the largest body carried inline.
+	Threshold int64
+}
+
+// NewMessageID returns a random (version 4) UUID.
+func NewMessageID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
 
 // FromHTTPRequest populates the RequestMessage from an http.Request.
 // It reads the request body (consuming it) and copies method, host, path and headers.
 func (rm *RequestMessage) FromHTTPRequest(r *http.Request) error {
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		return err
-	}
+	return rm.ReadHTTPRequest(r, nil)
+}
+
+// ReadHTTPRequest is like FromHTTPRequest, but when offload is not nil a body
+// larger than its threshold is streamed to the blob store and referenced by
+// BodyRef rather than held in memory.
+func (rm *RequestMessage) ReadHTTPRequest(r *http.Request, offload *BodyOffload) error {
 	// It's safe to close here; caller may not expect Body to be usable after.
-	if rc, ok := interface{}(r.Body).(io.ReadCloser); ok {
-		rc.Close()
-	}
+	defer r.Body.Close()
 
+	rm.ID = NewMessageID()
 	rm.Method = r.Method
 	rm.Host = r.Host
 	if r.URL != nil {
 		rm.Path = r.URL.Path
 	}
 	rm.Headers = r.Header
-	rm.Body = string(body)
+	rm.Client = ClientIdentityOf(r.TLS)
+
+	if offload == nil {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		rm.Body = string(body)
+		return nil
+	}
+
+	// Read one byte past the threshold to tell whether the body fits.
+	head, err := io.ReadAll(io.LimitReader(r.Body, offload.Threshold+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(head)) <= offload.Threshold {
+		rm.Body = string(head)
+		return nil
+	}
+
+	counter := &countingReader{r: io.MultiReader(bytes.NewReader(head), r.Body)}
+	if err := offload.Store.Put(r.Context(), rm.ID, counter); err != nil {
+		return err
+	}
+	rm.BodyRef = rm.ID
+	rm.BodySize = counter.n
 	return nil
 }
 
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// OpenBody returns a reader for the message body, fetching it from store if
+// it was offloaded.
+func (rm *RequestMessage) OpenBody(ctx context.Context, store blob.Store) (io.ReadCloser, error) {
+	if rm.BodyRef == "" {
+		return io.NopCloser(strings.NewReader(rm.Body)), nil
+	}
+	if store == nil {
+		return nil, fmt.Errorf("body %s is in a blob store but none is configured", rm.BodyRef)
+	}
+	return store.Get(ctx, rm.BodyRef)
+}
+
 // ToHTTPRequest builds an *http.Request from the RequestMessage targeting destURL.
 // The returned request will have headers and body set. Caller should handle
 // additional relay headers or Host preservation as desired.
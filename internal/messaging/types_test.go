@@ -0,0 +1,53 @@
+package messaging
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/smarthall/webhook-relay/internal/blob"
+)
+
+func TestReadHTTPRequestOffload(t *testing.T) {
+	store, err := blob.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	offload := &BodyOffload{Store: store, Threshold: 5}
+
+	// Bodies up to the threshold stay inline.
+	var small RequestMessage
+	if err := small.ReadHTTPRequest(httptest.NewRequest("POST", "/p", strings.NewReader("12345")), offload); err != nil {
+		t.Fatalf("ReadHTTPRequest: %v", err)
+	}
+	if small.Body != "12345" || small.BodyRef != "" {
+		t.Fatalf("expected inline body, got body=%q ref=%q", small.Body, small.BodyRef)
+	}
+
+	// Larger bodies are moved to the store.
+	var large RequestMessage
+	if err := large.ReadHTTPRequest(httptest.NewRequest("POST", "/p", strings.NewReader("123456789")), offload); err != nil {
+		t.Fatalf("ReadHTTPRequest: %v", err)
+	}
+	if large.Body != "" || large.BodyRef == "" || large.BodySize != 9 {
+		t.Fatalf("expected offloaded body, got body=%q ref=%q size=%d", large.Body, large.BodyRef, large.BodySize)
+	}
+
+	for _, msg := range []RequestMessage{small, large} {
+		rc, err := msg.OpenBody(context.Background(), store)
+		if err != nil {
+			t.Fatalf("OpenBody: %v", err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		if len(b) != 5 && len(b) != 9 {
+			t.Fatalf("unexpected body %q", b)
+		}
+	}
+
+	if _, err := large.OpenBody(context.Background(), nil); err == nil {
+		t.Fatalf("expected error opening an offloaded body without a store")
+	}
+}
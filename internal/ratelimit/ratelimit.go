@@ -0,0 +1,228 @@
+// Package ratelimit limits how fast and how many requests at once are sent to
+// a destination, using a token bucket for the rate and a semaphore for the
+// number in flight.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket refilled at a fixed rate up to its burst size. It
+// is safe for concurrent use.
+type Bucket struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket allowing rate requests per second with
+// bursts of up to burst requests. A burst below one is treated as one.
+func NewBucket(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{rate: rate, burst: float64(burst), tokens: float64(burst), now: time.Now}
+}
+
+// refill adds the tokens accrued since the last call. b.mu must be held.
+func (b *Bucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// Reserve takes a token and returns how long the caller must wait before
+// using it. Waiting callers queue behind each other, so each reservation is
+// honoured in turn.
+func (b *Bucket) Reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(b.now())
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Take takes a token if one is available. Otherwise it leaves the bucket
+// unchanged and returns how long until a token will be available.
+func (b *Bucket) Take() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(b.now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second)), false
+}
+
+// full reports whether the bucket has refilled completely, in which case it
+// behaves exactly like a new one.
+func (b *Bucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// cancel returns a reserved token that was not used.
+func (b *Bucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens++
+}
+
+// Wait blocks until a token is available or ctx is done.
+func (b *Bucket) Wait(ctx context.Context) error {
+	wait := b.Reserve()
+	if wait == 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		b.cancel()
+		return ctx.Err()
+	}
+}
+
+// Config limits requests to a single destination. Zero values disable the
+// corresponding limit.
+type Config struct {
+	// Rate is the sustained number of requests per second.
+	Rate float64
+	// Burst is the number of requests that may be sent at once before Rate
+	// applies.
+	Burst int
+	// MaxInFlight is the maximum number of concurrent requests.
+	MaxInFlight int
+}
+
+// Limiter applies a Config to one destination.
+type Limiter struct {
+	bucket *Bucket
+	slots  chan struct{}
+}
+
+func New(cfg Config) *Limiter {
+	l := &Limiter{}
+	if cfg.Rate > 0 {
+		l.bucket = NewBucket(cfg.Rate, cfg.Burst)
+	}
+	if cfg.MaxInFlight > 0 {
+		l.slots = make(chan struct{}, cfg.MaxInFlight)
+	}
+	return l
+}
+
+// Acquire waits until a request may be sent. The returned release function
+// must be called once the request has completed.
+func (l *Limiter) Acquire(ctx context.Context) (release func(), err error) {
+	release = func() {}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+			release = func() { <-l.slots }
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if l.bucket != nil {
+		if err := l.bucket.Wait(ctx); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
+
+// Set holds one Limiter per destination, created on first use.
+type Set struct {
+	mu       sync.Mutex
+	limiters map[string]*Limiter
+}
+
+func NewSet() *Set {
+	return &Set{limiters: make(map[string]*Limiter)}
+}
+
+// Get returns the limiter for key, creating it from cfg if needed. Later
+// calls for the same key share the first limiter regardless of cfg, so
+// callers must use one cfg per key.
+func (s *Set) Get(key string, cfg Config) *Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.limiters[key]
+	if !ok {
+		l = New(cfg)
+		s.limiters[key] = l
+	}
+	return l
+}
+
+// sweepInterval is how often Buckets discards idle buckets.
+const sweepInterval = time.Minute
+
+// Buckets holds a Bucket per key, such as per client IP. Buckets that have
+// refilled completely are discarded, so keys seen once don't accumulate. It
+// is safe for concurrent use.
+type Buckets struct {
+	rate  float64
+	burst int
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+}
+
+func NewBuckets(rate float64, burst int) *Buckets {
+	return &Buckets{rate: rate, burst: burst, now: time.Now, buckets: make(map[string]*Bucket)}
+}
+
+// Take takes a token from key's bucket, as Bucket.Take.
+func (b *Buckets) Take(key string) (time.Duration, bool) {
+	b.mu.Lock()
+	now := b.now()
+	if now.Sub(b.lastSweep) >= sweepInterval {
+		for k, bucket := range b.buckets {
+			if bucket.full(now) {
+				delete(b.buckets, k)
+			}
+		}
+		b.lastSweep = now
+	}
+	bucket, ok := b.buckets[key]
+	if !ok {
+		bucket = NewBucket(b.rate, b.burst)
+		bucket.now = b.now
+		b.buckets[key] = bucket
+	}
+	b.mu.Unlock()
+
+	return bucket.Take()
+}
+
+// Len returns the number of buckets currently held.
+func (b *Buckets) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.buckets)
+}
@@ -0,0 +1,116 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBucketReserve(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := NewBucket(2, 2)
+	b.now = func() time.Time { return now }
+
+	// The burst is available immediately.
+	for i := 0; i < 2; i++ {
+		if wait := b.Reserve(); wait != 0 {
+			t.Fatalf("expected burst request %d to go at once, waited %s", i, wait)
+		}
+	}
+
+	// Further requests queue at the refill rate.
+	if wait := b.Reserve(); wait != 500*time.Millisecond {
+		t.Fatalf("expected 500ms wait, got %s", wait)
+	}
+	if wait := b.Reserve(); wait != time.Second {
+		t.Fatalf("expected 1s wait, got %s", wait)
+	}
+
+	// Tokens refill but never beyond the burst.
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if wait := b.Reserve(); wait != 0 {
+			t.Fatalf("expected refilled request %d to go at once, waited %s", i, wait)
+		}
+	}
+	if wait := b.Reserve(); wait == 0 {
+		t.Fatalf("expected refill to be capped at the burst")
+	}
+}
+
+func TestLimiterMaxInFlight(t *testing.T) {
+	l := New(Config{MaxInFlight: 1})
+
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(ctx); err == nil {
+		t.Fatalf("expected second request to wait for the first")
+	}
+
+	release()
+	release, err = l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("expected slot after release: %v", err)
+	}
+	release()
+}
+
+func TestLimiterCancelReturnsToken(t *testing.T) {
+	l := New(Config{Rate: 0.001, Burst: 1})
+	if _, err := l.Acquire(context.Background()); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Acquire(ctx); err == nil {
+		t.Fatalf("expected cancelled wait to fail")
+	}
+	if tokens := l.bucket.tokens; tokens < -0.01 {
+		t.Fatalf("expected cancelled reservation to be returned, tokens=%f", tokens)
+	}
+}
+
+func TestSetSharesLimiter(t *testing.T) {
+	s := NewSet()
+	a := s.Get("a", Config{Rate: 1})
+	if s.Get("a", Config{Rate: 5}) != a {
+		t.Fatalf("expected the same limiter for the same key")
+	}
+	if s.Get("b", Config{Rate: 1}) == a {
+		t.Fatalf("expected a separate limiter per key")
+	}
+}
+
+func TestBucketsTakeAndSweep(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := NewBuckets(1, 2)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if _, ok := b.Take("10.0.0.1"); !ok {
+			t.Fatalf("expected burst request %d to be allowed", i)
+		}
+	}
+	wait, ok := b.Take("10.0.0.1")
+	if ok || wait != time.Second {
+		t.Fatalf("expected rejection with 1s wait, got ok=%v wait=%s", ok, wait)
+	}
+
+	// Keys are limited independently.
+	if _, ok := b.Take("10.0.0.2"); !ok {
+		t.Fatalf("expected another key to be allowed")
+	}
+
+	// Once refilled, idle buckets are discarded on the next sweep.
+	now = now.Add(sweepInterval)
+	b.Take("10.0.0.3")
+	if b.Len() != 1 {
+		t.Fatalf("expected idle buckets to be swept, have %d", b.Len())
+	}
+}
@@ -0,0 +1,124 @@
+package signature
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ResignProviders lists the signature formats a Resigner can produce.
+var ResignProviders = []string{"github", "slack", "stripe", "hmac"}
+
+// HMACFormat describes a generic HMAC-SHA256 signature header, such as
+// "X-Signature: sha256=<hex>".
+type HMACFormat struct {
+	Header string
+	// Prefix is written before the encoded signature, e.g. "sha256=".
+	Prefix string
+	// Encoding is hex (the default) or base64.
+	Encoding string
+}
+
+// Resigner replaces a request's signature with one in a provider's format
+// made with another secret, so the request verifies at a destination that
+// has its own secret.
+type Resigner interface {
+	// Resign removes the signature headers of every provider it knows, so
+	// none is left to fail verification at the destination, and signs body
+	// anew. Providers that sign a timestamp are given now, as a Unix time.
+	Resign(h http.Header, now int64, body []byte)
+}
+
+// NewResigner returns the resigner for provider. format is only used by the
+// hmac provider.
+func NewResigner(provider, secret string, format HMACFormat) (Resigner, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("resign provider %s requires a secret", provider)
+	}
+	switch provider {
+	case "github":
+		return githubResigner{secret: []byte(secret)}, nil
+	case "slack":
+		return slackResigner{secret: []byte(secret)}, nil
+	case "stripe":
+		return stripeResigner{secret: []byte(secret)}, nil
+	case "hmac":
+		if format.Header == "" {
+			return nil, errors.New("resign provider hmac requires a header")
+		}
+		switch format.Encoding {
+		case "":
+			format.Encoding = "hex"
+		case "hex", "base64":
+		default:
+			return nil, fmt.Errorf("unsupported hmac encoding %q (want hex or base64)", format.Encoding)
+		}
+		return hmacResigner{secret: []byte(secret), format: format}, nil
+	default:
+		return nil, fmt.Errorf("unsupported resign provider %q (want %s)", provider, strings.Join(ResignProviders, ", "))
+	}
+}
+
+// signatureHeaders are the headers the providers' signatures are carried in.
+var signatureHeaders = []string{
+	"Stripe-Signature",
+	"X-Slack-Signature", "X-Slack-Request-Timestamp",
+	"X-Hub-Signature", "X-Hub-Signature-256",
+	"Webhook-Id", "Webhook-Timestamp", "Webhook-Signature",
+	"Svix-Id", "Svix-Timestamp", "Svix-Signature",
+}
+
+func stripSignatures(h http.Header) {
+	for _, name := range signatureHeaders {
+		h.Del(name)
+	}
+}
+
+type githubResigner struct {
+	secret []byte
+}
+
+func (g githubResigner) Resign(h http.Header, now int64, body []byte) {
+	stripSignatures(h)
+	h.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(hmacSHA256(g.secret, string(body))))
+}
+
+type slackResigner struct {
+	secret []byte
+}
+
+func (s slackResigner) Resign(h http.Header, now int64, body []byte) {
+	stripSignatures(h)
+	ts := strconv.FormatInt(now, 10)
+	h.Set("X-Slack-Request-Timestamp", ts)
+	h.Set("X-Slack-Signature", "v0="+hex.EncodeToString(hmacSHA256(s.secret, "v0:", ts, ":", string(body))))
+}
+
+type stripeResigner struct {
+	secret []byte
+}
+
+func (s stripeResigner) Resign(h http.Header, now int64, body []byte) {
+	stripSignatures(h)
+	ts := strconv.FormatInt(now, 10)
+	h.Set("Stripe-Signature", "t="+ts+",v1="+hex.EncodeToString(hmacSHA256(s.secret, ts, ".", string(body))))
+}
+
+type hmacResigner struct {
+	secret []byte
+	format HMACFormat
+}
+
+func (r hmacResigner) Resign(h http.Header, now int64, body []byte) {
+	stripSignatures(h)
+	mac := hmacSHA256(r.secret, string(body))
+	sig := hex.EncodeToString(mac)
+	if r.format.Encoding == "base64" {
+		sig = base64.StdEncoding.EncodeToString(mac)
+	}
+	h.Set(r.format.Header, r.format.Prefix+sig)
+}
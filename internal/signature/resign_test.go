@@ -0,0 +1,83 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResignVerifies(t *testing.T) {
+	body := []byte(`{"action":"opened"}`)
+	now := time.Unix(1700000000, 0)
+	for _, provider := range []string{"github", "slack", "stripe"} {
+		t.Run(provider, func(t *testing.T) {
+			// Start from a request signed with the provider's secret.
+			h := http.Header{}
+			orig, _ := NewResigner(provider, "provider-secret", HMACFormat{})
+			orig.Resign(h, now.Unix(), body)
+			// Other providers' signatures, and GitHub's SHA-1 one, would
+			// fail verification at the destination.
+			stale := []string{"X-Hub-Signature", "Stripe-Signature", "X-Slack-Signature", "Webhook-Signature", "Svix-Signature"}
+			for _, name := range stale {
+				if h.Get(name) == "" {
+					h.Set(name, "stale")
+				}
+			}
+
+			r, err := NewResigner(provider, "internal-secret", HMACFormat{})
+			if err != nil {
+				t.Fatalf("NewResigner: %v", err)
+			}
+			r.Resign(h, now.Unix(), body)
+
+			v, _ := New(provider, []string{"internal-secret"})
+			res, err := v.Verify(h, bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if err := CheckTimestamp(res, time.Minute, now); err != nil {
+				t.Fatalf("CheckTimestamp: %v", err)
+			}
+			old, _ := New(provider, []string{"provider-secret"})
+			if _, err := old.Verify(h, bytes.NewReader(body)); err == nil {
+				t.Fatalf("expected the original signature to be replaced")
+			}
+			for _, name := range stale {
+				if h.Get(name) == "stale" {
+					t.Fatalf("expected %s to be removed", name)
+				}
+			}
+		})
+	}
+}
+
+func TestResignHMAC(t *testing.T) {
+	r, err := NewResigner("hmac", "s3cret", HMACFormat{Header: "X-Signature", Prefix: "sha256=", Encoding: "base64"})
+	if err != nil {
+		t.Fatalf("NewResigner: %v", err)
+	}
+	h := http.Header{"X-Signature": {"sha256=old"}, "X-Hub-Signature-256": {"sha256=old"}}
+	r.Resign(h, 0, []byte("body"))
+	if h.Get("X-Hub-Signature-256") != "" {
+		t.Fatalf("expected the provider's signature to be removed")
+	}
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte("body"))
+	if want := "sha256=" + base64.StdEncoding.EncodeToString(mac.Sum(nil)); h.Get("X-Signature") != want || len(h["X-Signature"]) != 1 {
+		t.Fatalf("expected %q, got %v", want, h["X-Signature"])
+	}
+
+	for _, format := range []HMACFormat{{}, {Header: "X-Signature", Encoding: "base32"}} {
+		if _, err := NewResigner("hmac", "s3cret", format); err == nil {
+			t.Fatalf("expected error for %+v", format)
+		}
+	}
+	if _, err := NewResigner("gitlab", "s3cret", HMACFormat{}); err == nil {
+		t.Fatalf("expected error for an unsupported provider")
+	}
+}
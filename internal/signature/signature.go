@@ -0,0 +1,322 @@
+// Package signature verifies the signatures webhook providers put on their
+// requests, and the timestamps they sign, so that forged and replayed
+// webhooks can be rejected. It also signs requests per Standard Webhooks.
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Providers lists the supported signature schemes.
+var Providers = []string{"stripe", "slack", "standard", "github"}
+
+var (
+	// ErrMissing is returned when the request carries no signature.
+	ErrMissing = errors.New("missing signature")
+	// ErrMismatch is returned when no secret produces the signature.
+	ErrMismatch = errors.New("signature mismatch")
+	// ErrStale is returned when the signed timestamp is outside the
+	// tolerance.
+	ErrStale = errors.New("signature timestamp outside tolerance")
+)
+
+// Result describes a verified signature.
+type Result struct {
+	// Timestamp is when the sender signed the request, or zero if the scheme
+	// signs none.
+	Timestamp time.Time
+	// Nonce identifies the signed message, so replays of it can be
+	// rejected. It doesn't depend on which signature matched, as a replay
+	// may keep any one of a request's rotated signatures: Standard Webhooks
+	// use the webhook-id, and the other schemes the timestamp and a hash of
+	// the body.
+	Nonce string
+}
+
+// Verifier checks a provider's signature on a request. The body is streamed
+// through the MAC, so large bodies needn't be held in memory.
+type Verifier interface {
+	Verify(h http.Header, body io.Reader) (Result, error)
+}
+
+// New returns the verifier for provider. Several secrets may be given so
+// they can be rotated; a signature made with any of them is accepted.
+func New(provider string, secrets []string) (Verifier, error) {
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("signature provider %s requires secrets", provider)
+	}
+	keys := make([][]byte, len(secrets))
+	for i, secret := range secrets {
+		keys[i] = []byte(secret)
+	}
+	switch provider {
+	case "stripe":
+		return stripe{secrets: keys}, nil
+	case "slack":
+		return slack{secrets: keys}, nil
+	case "standard":
+		return newStandard(secrets)
+	case "github":
+		return github{secrets: keys}, nil
+	default:
+		return nil, fmt.Errorf("unsupported signature provider %q (want %s)", provider, strings.Join(Providers, ", "))
+	}
+}
+
+// CheckTimestamp returns ErrStale if res carries a timestamp further than
+// tolerance from now in either direction. Signatures without a timestamp
+// and a zero tolerance always pass.
+func CheckTimestamp(res Result, tolerance time.Duration, now time.Time) error {
+	if res.Timestamp.IsZero() || tolerance <= 0 {
+		return nil
+	}
+	skew := now.Sub(res.Timestamp)
+	if skew > tolerance || skew < -tolerance {
+		return fmt.Errorf("%w: signed %s ago", ErrStale, skew.Round(time.Second))
+	}
+	return nil
+}
+
+func hmacSHA256(secret []byte, parts ...string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	for _, p := range parts {
+		mac.Write([]byte(p))
+	}
+	return mac.Sum(nil)
+}
+
+// macs returns the HMAC-SHA256 of prefix followed by body for each key, and
+// the hex SHA-256 of body alone, reading body once.
+func macs(keys [][]byte, prefix string, body io.Reader) ([][]byte, string, error) {
+	digest := sha256.New()
+	hashes := make([]hash.Hash, len(keys))
+	writers := []io.Writer{digest}
+	for i, key := range keys {
+		hashes[i] = hmac.New(sha256.New, key)
+		hashes[i].Write([]byte(prefix))
+		writers = append(writers, hashes[i])
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), body); err != nil {
+		return nil, "", fmt.Errorf("failed to read body: %w", err)
+	}
+	sums := make([][]byte, len(hashes))
+	for i, h := range hashes {
+		sums[i] = h.Sum(nil)
+	}
+	return sums, hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// matchHex reports whether a hex encoded candidate equals one of the MACs.
+func matchHex(macs [][]byte, candidates []string) bool {
+	for _, c := range candidates {
+		sig, err := hex.DecodeString(c)
+		if err != nil {
+			continue
+		}
+		for _, mac := range macs {
+			if hmac.Equal(sig, mac) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseUnix(s string) (time.Time, error) {
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: invalid timestamp %q", ErrMismatch, s)
+	}
+	return time.Unix(secs, 0), nil
+}
+
+// stripe verifies Stripe-Signature: "t=<unix>,v1=<hex hmac of t.body>,...".
+type stripe struct {
+	secrets [][]byte
+}
+
+func (s stripe) Verify(h http.Header, body io.Reader) (Result, error) {
+	header := h.Get("Stripe-Signature")
+	if header == "" {
+		return Result{}, ErrMissing
+	}
+	var ts string
+	var sigs []string
+	for _, item := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(item), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sigs = append(sigs, v)
+		}
+	}
+	t, err := parseUnix(ts)
+	if err != nil {
+		return Result{}, err
+	}
+
+	sums, digest, err := macs(s.secrets, ts+".", body)
+	if err != nil {
+		return Result{}, err
+	}
+	if !matchHex(sums, sigs) {
+		return Result{}, ErrMismatch
+	}
+	return Result{Timestamp: t, Nonce: ts + " " + digest}, nil
+}
+
+// slack verifies X-Slack-Signature: "v0=<hex hmac of v0:timestamp:body>".
+type slack struct {
+	secrets [][]byte
+}
+
+func (s slack) Verify(h http.Header, body io.Reader) (Result, error) {
+	header, ts := h.Get("X-Slack-Signature"), h.Get("X-Slack-Request-Timestamp")
+	if header == "" || ts == "" {
+		return Result{}, ErrMissing
+	}
+	t, err := parseUnix(ts)
+	if err != nil {
+		return Result{}, err
+	}
+
+	sums, digest, err := macs(s.secrets, "v0:"+ts+":", body)
+	if err != nil {
+		return Result{}, err
+	}
+	if !matchHex(sums, []string{strings.TrimPrefix(header, "v0=")}) {
+		return Result{}, ErrMismatch
+	}
+	return Result{Timestamp: t, Nonce: ts + " " + digest}, nil
+}
+
+// github verifies X-Hub-Signature-256: "sha256=<hex hmac of body>". GitHub
+// signs no timestamp, so the nonce is the body hash alone.
+type github struct {
+	secrets [][]byte
+}
+
+func (g github) Verify(h http.Header, body io.Reader) (Result, error) {
+	header := h.Get("X-Hub-Signature-256")
+	if header == "" {
+		return Result{}, ErrMissing
+	}
+
+	sums, digest, err := macs(g.secrets, "", body)
+	if err != nil {
+		return Result{}, err
+	}
+	if !matchHex(sums, []string{strings.TrimPrefix(header, "sha256=")}) {
+		return Result{}, ErrMismatch
+	}
+	return Result{Nonce: digest}, nil
+}
+
+// standard verifies Standard Webhooks (as used by Svix): webhook-signature
+// holds space-separated "v1,<base64 hmac>" or "v1a,<base64 ed25519>"
+// signatures of "<id>.<timestamp>.<body>", and the id is the nonce. The
+// svix- header prefix is accepted as well. HMAC secrets are "whsec_<base64>" and Ed25519 public
+// keys "whpk_<base64>".
+type standard struct {
+	hmacKeys [][]byte
+	pubKeys  []ed25519.PublicKey
+}
+
+func newStandard(secrets []string) (standard, error) {
+	var s standard
+	for _, secret := range secrets {
+		if pk, ok := strings.CutPrefix(secret, "whpk_"); ok {
+			key, err := base64.StdEncoding.DecodeString(pk)
+			if err != nil || len(key) != ed25519.PublicKeySize {
+				return s, errors.New("invalid whpk_ public key")
+			}
+			s.pubKeys = append(s.pubKeys, ed25519.PublicKey(key))
+			continue
+		}
+		key, err := standardSecret(secret)
+		if err != nil {
+			return s, err
+		}
+		s.hmacKeys = append(s.hmacKeys, key)
+	}
+	return s, nil
+}
+
+// standardSecret decodes a "whsec_<base64>" HMAC secret. The prefix is
+// optional.
+func standardSecret(secret string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, "whsec_"))
+	if err != nil {
+		return nil, errors.New("invalid whsec_ secret: not base64")
+	}
+	return key, nil
+}
+
+// standardHeader returns the webhook- header, or its svix- equivalent.
+func standardHeader(h http.Header, name string) string {
+	if v := h.Get("Webhook-" + name); v != "" {
+		return v
+	}
+	return h.Get("Svix-" + name)
+}
+
+func (s standard) Verify(h http.Header, body io.Reader) (Result, error) {
+	id, ts, header := standardHeader(h, "Id"), standardHeader(h, "Timestamp"), standardHeader(h, "Signature")
+	if id == "" || ts == "" || header == "" {
+		return Result{}, ErrMissing
+	}
+	t, err := parseUnix(ts)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// Ed25519 signs the whole message, so it can't be streamed: keep a
+	// copy of the body only when public keys are configured.
+	prefix := id + "." + ts + "."
+	var copied bytes.Buffer
+	if len(s.pubKeys) > 0 {
+		body = io.TeeReader(body, &copied)
+	}
+	sums, _, err := macs(s.hmacKeys, prefix, body)
+	if err != nil {
+		return Result{}, err
+	}
+
+	for _, candidate := range strings.Fields(header) {
+		version, encoded, _ := strings.Cut(candidate, ",")
+		sig, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		switch version {
+		case "v1":
+			for _, sum := range sums {
+				if hmac.Equal(sig, sum) {
+					return Result{Timestamp: t, Nonce: id}, nil
+				}
+			}
+		case "v1a":
+			signed := append([]byte(prefix), copied.Bytes()...)
+			for _, key := range s.pubKeys {
+				if ed25519.Verify(key, signed, sig) {
+					return Result{Timestamp: t, Nonce: id}, nil
+				}
+			}
+		}
+	}
+	return Result{}, ErrMismatch
+}
@@ -0,0 +1,155 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func hexMAC(secret, data string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestProviders(t *testing.T) {
+	body := []byte(`{"id":"evt_1"}`)
+	ts := "1700000000"
+	whsecKey := []byte("standard-webhooks-key")
+	whsec := "whsec_" + base64.StdEncoding.EncodeToString(whsecKey)
+	mac := hmac.New(sha256.New, whsecKey)
+	mac.Write([]byte("msg_1." + ts + "." + string(body)))
+	standardSig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	digest := sha256.Sum256(body)
+	bodyHash := hex.EncodeToString(digest[:])
+
+	tests := []struct {
+		provider string
+		header   http.Header
+		secret   string
+		nonce    string
+	}{
+		{"stripe", http.Header{"Stripe-Signature": {"t=" + ts + ",v1=" + hexMAC("sk", ts+"."+string(body)) + ",v0=abc"}}, "sk", ts + " " + bodyHash},
+		{"slack", http.Header{
+			"X-Slack-Request-Timestamp": {ts},
+			"X-Slack-Signature":         {"v0=" + hexMAC("sk", "v0:"+ts+":"+string(body))},
+		}, "sk", ts + " " + bodyHash},
+		{"github", http.Header{"X-Hub-Signature-256": {"sha256=" + hexMAC("sk", string(body))}}, "sk", bodyHash},
+		{"standard", http.Header{
+			"Webhook-Id":        {"msg_1"},
+			"Webhook-Timestamp": {ts},
+			"Webhook-Signature": {"v1,bm90LWl0 v1," + standardSig},
+		}, whsec, "msg_1"},
+		{"standard", http.Header{
+			"Svix-Id":        {"msg_1"},
+			"Svix-Timestamp": {ts},
+			"Svix-Signature": {"v1," + standardSig},
+		}, whsec, "msg_1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			// The matching secret may be any of those configured.
+			other := "other"
+			if tt.provider == "standard" {
+				other = "whsec_" + base64.StdEncoding.EncodeToString([]byte(other))
+			}
+			v, err := New(tt.provider, []string{other, tt.secret})
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			res, err := v.Verify(tt.header, bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			// The nonce is the same whichever signature matched, so a
+			// replay can't evade it by keeping another rotated one.
+			if res.Nonce != tt.nonce {
+				t.Fatalf("expected nonce %q, got %q", tt.nonce, res.Nonce)
+			}
+			if tt.provider != "github" && res.Timestamp.Unix() != 1700000000 {
+				t.Fatalf("unexpected timestamp %v", res.Timestamp)
+			}
+
+			if _, err := v.Verify(tt.header, strings.NewReader(`{"id":"evt_2"}`)); !errors.Is(err, ErrMismatch) {
+				t.Fatalf("expected ErrMismatch for a tampered body, got %v", err)
+			}
+			if _, err := v.Verify(http.Header{}, bytes.NewReader(body)); !errors.Is(err, ErrMissing) {
+				t.Fatalf("expected ErrMissing without headers, got %v", err)
+			}
+
+			wrong, _ := New(tt.provider, []string{other})
+			if _, err := wrong.Verify(tt.header, bytes.NewReader(body)); !errors.Is(err, ErrMismatch) {
+				t.Fatalf("expected ErrMismatch for the wrong secret, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStandardEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{}`)
+	sig := ed25519.Sign(priv, []byte("msg_1.1700000000."+string(body)))
+
+	v, err := New("standard", []string{"whpk_" + base64.StdEncoding.EncodeToString(pub)})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	h := http.Header{
+		"Webhook-Id":        {"msg_1"},
+		"Webhook-Timestamp": {"1700000000"},
+		"Webhook-Signature": {"v1a," + base64.StdEncoding.EncodeToString(sig)},
+	}
+	if _, err := v.Verify(h, bytes.NewReader(body)); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if _, err := v.Verify(h, strings.NewReader(`{"x":1}`)); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("expected ErrMismatch, got %v", err)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		provider string
+		secrets  []string
+	}{
+		{"stripe", nil},
+		{"paypal", []string{"x"}},
+		{"standard", []string{"whsec_!!"}},
+		{"standard", []string{"whpk_AAAA"}},
+	} {
+		if _, err := New(tt.provider, tt.secrets); err == nil {
+			t.Fatalf("New(%s, %v): expected error", tt.provider, tt.secrets)
+		}
+	}
+}
+
+func TestCheckTimestamp(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	for _, tt := range []struct {
+		signed    time.Time
+		tolerance time.Duration
+		stale     bool
+	}{
+		{now.Add(-4 * time.Minute), 5 * time.Minute, false},
+		{now.Add(-6 * time.Minute), 5 * time.Minute, true},
+		{now.Add(6 * time.Minute), 5 * time.Minute, true},
+		{now.Add(-time.Hour), 0, false},
+		{time.Time{}, 5 * time.Minute, false},
+	} {
+		err := CheckTimestamp(Result{Timestamp: tt.signed}, tt.tolerance, now)
+		if got := errors.Is(err, ErrStale); got != tt.stale {
+			t.Fatalf("signed %v, tolerance %v: stale %v, want %v", tt.signed, tt.tolerance, got, tt.stale)
+		}
+	}
+}
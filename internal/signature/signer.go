@@ -0,0 +1,71 @@
+package signature
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StandardSigner signs requests per the Standard Webhooks spec, setting the
+// webhook-id, webhook-timestamp and webhook-signature headers. It signs with
+// every configured key, so receivers can move to a new key while both are in
+// use.
+type StandardSigner struct {
+	hmacKeys    [][]byte
+	privateKeys []ed25519.PrivateKey
+}
+
+// NewStandardSigner returns a signer for the keys, which are HMAC secrets
+// ("whsec_<base64>") or Ed25519 private keys ("whsk_<base64>" of the 32 byte
+// seed or 64 byte private key).
+func NewStandardSigner(keys []string) (*StandardSigner, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("signing requires at least one key")
+	}
+	s := &StandardSigner{}
+	for _, k := range keys {
+		if sk, ok := strings.CutPrefix(k, "whsk_"); ok {
+			key, err := base64.StdEncoding.DecodeString(sk)
+			switch {
+			case err != nil:
+				return nil, errors.New("invalid whsk_ private key: not base64")
+			case len(key) == ed25519.SeedSize:
+				s.privateKeys = append(s.privateKeys, ed25519.NewKeyFromSeed(key))
+			case len(key) == ed25519.PrivateKeySize:
+				s.privateKeys = append(s.privateKeys, ed25519.PrivateKey(key))
+			default:
+				return nil, errors.New("invalid whsk_ private key: wrong length")
+			}
+			continue
+		}
+		key, err := standardSecret(k)
+		if err != nil {
+			return nil, err
+		}
+		s.hmacKeys = append(s.hmacKeys, key)
+	}
+	return s, nil
+}
+
+// Sign sets the Standard Webhooks headers on h for the message id, signed at
+// the given time over body. Any existing signature headers are replaced.
+func (s *StandardSigner) Sign(h http.Header, id string, at time.Time, body []byte) {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	signed := id + "." + ts + "." + string(body)
+
+	sigs := make([]string, 0, len(s.hmacKeys)+len(s.privateKeys))
+	for _, key := range s.hmacKeys {
+		sigs = append(sigs, "v1,"+base64.StdEncoding.EncodeToString(hmacSHA256(key, signed)))
+	}
+	for _, key := range s.privateKeys {
+		sigs = append(sigs, "v1a,"+base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(signed))))
+	}
+
+	h.Set("Webhook-Id", id)
+	h.Set("Webhook-Timestamp", ts)
+	h.Set("Webhook-Signature", strings.Join(sigs, " "))
+}
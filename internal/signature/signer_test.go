@@ -0,0 +1,55 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStandardSignerRoundTrip(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSecret := "whsec_" + base64.StdEncoding.EncodeToString([]byte("old-key"))
+	newSecret := "whsec_" + base64.StdEncoding.EncodeToString([]byte("new-key"))
+	seed := "whsk_" + base64.StdEncoding.EncodeToString(priv.Seed())
+
+	signer, err := NewStandardSigner([]string{newSecret, oldSecret, seed})
+	if err != nil {
+		t.Fatalf("NewStandardSigner: %v", err)
+	}
+	h := http.Header{}
+	body := []byte(`{"type":"push"}`)
+	signer.Sign(h, "msg_1", time.Unix(1700000000, 0), body)
+
+	if h.Get("Webhook-Id") != "msg_1" || h.Get("Webhook-Timestamp") != "1700000000" {
+		t.Fatalf("unexpected headers %v", h)
+	}
+	if n := len(strings.Fields(h.Get("Webhook-Signature"))); n != 3 {
+		t.Fatalf("expected a signature per key, got %d", n)
+	}
+
+	// Receivers holding any one of the keys accept the request.
+	for _, key := range []string{oldSecret, newSecret, "whpk_" + base64.StdEncoding.EncodeToString(pub)} {
+		v, err := New("standard", []string{key})
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		if _, err := v.Verify(h, bytes.NewReader(body)); err != nil {
+			t.Fatalf("Verify with %s: %v", key[:5], err)
+		}
+	}
+}
+
+func TestNewStandardSignerInvalid(t *testing.T) {
+	for _, keys := range [][]string{nil, {"whsec_!!"}, {"whsk_AAAA"}} {
+		if _, err := NewStandardSigner(keys); err == nil {
+			t.Fatalf("NewStandardSigner(%v): expected error", keys)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Package tlsutil loads TLS certificates and CA bundles from disk and reloads
+// them when the files change, so rotated certificates are picked up without
+// restarting the process.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// KeyPair serves a certificate and private key loaded from disk. The files
+// are checked for modification on every handshake and reloaded when they
+// change.
+type KeyPair struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// NewKeyPair loads the certificate and key, returning an error if they can't
+// be read or don't match.
+func NewKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	k := &KeyPair{certFile: certFile, keyFile: keyFile}
+	if _, err := k.Certificate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Certificate returns the current certificate, reloading it from disk if
+// either file has changed. If a reload fails the previous certificate keeps
+// being served.
+func (k *KeyPair) Certificate() (*tls.Certificate, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	certMod, err1 := modTime(k.certFile)
+	keyMod, err2 := modTime(k.keyFile)
+	if err := errors.Join(err1, err2); err != nil {
+		if k.cert != nil {
+			return k.cert, nil
+		}
+		return nil, err
+	}
+	if k.cert != nil && certMod.Equal(k.certMod) && keyMod.Equal(k.keyMod) {
+		return k.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		if k.cert != nil {
+			return k.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load key pair %s/%s: %w", k.certFile, k.keyFile, err)
+	}
+
+	k.cert = &cert
+	k.certMod = certMod
+	k.keyMod = keyMod
+	return k.cert, nil
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate.
+func (k *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return k.Certificate()
+}
+
+// GetClientCertificate can be used as tls.Config.GetClientCertificate.
+func (k *KeyPair) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return k.Certificate()
+}
+
+// CertPool is a PEM CA bundle loaded from disk and reloaded when it changes.
+type CertPool struct {
+	file string
+
+	mu   sync.Mutex
+	pool *x509.CertPool
+	mod  time.Time
+}
+
+// NewCertPool loads the CA bundle, returning an error if it contains no
+// certificates.
+func NewCertPool(file string) (*CertPool, error) {
+	p := &CertPool{file: file}
+	if _, err := p.Pool(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Pool returns the current pool, reloading it if the file has changed.
+func (p *CertPool) Pool() (*x509.CertPool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	mod, err := modTime(p.file)
+	if err != nil {
+		if p.pool != nil {
+			return p.pool, nil
+		}
+		return nil, err
+	}
+	if p.pool != nil && mod.Equal(p.mod) {
+		return p.pool, nil
+	}
+
+	pem, err := os.ReadFile(p.file)
+	if err != nil {
+		if p.pool != nil {
+			return p.pool, nil
+		}
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		if p.pool != nil {
+			return p.pool, nil
+		}
+		return nil, fmt.Errorf("no certificates found in %s", p.file)
+	}
+
+	p.pool = pool
+	p.mod = mod
+	return p.pool, nil
+}
+
+// VerifyServer returns a tls.Config.VerifyConnection callback that verifies
+// the server chain against the current pool. It is used together with
+// InsecureSkipVerify so that the pool can change between handshakes.
+func (p *CertPool) VerifyServer() func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("tls: server presented no certificates")
+		}
+		return p.verify(cs.PeerCertificates, x509.VerifyOptions{
+			DNSName:   cs.ServerName,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+	}
+}
+
+// VerifyClient returns a tls.Config.VerifyConnection callback that verifies
+// the client chain, if the client presented one, against the current pool.
+// It is used together with tls.RequestClientCert so that the pool can change
+// between handshakes; any peer certificates on a connection that completed
+// the handshake have then been verified.
+func (p *CertPool) VerifyClient() func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return nil
+		}
+		return p.verify(cs.PeerCertificates, x509.VerifyOptions{
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+	}
+}
+
+// verify checks that certs chains to the current pool.
+func (p *CertPool) verify(certs []*x509.Certificate, opts x509.VerifyOptions) error {
+	pool, err := p.Pool()
+	if err != nil {
+		return err
+	}
+	opts.Roots = pool
+	opts.Intermediates = x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err = certs[0].Verify(opts)
+	return err
+}
+
+// ParseVersion converts "1.0" to "1.3" into a tls.VersionTLS constant. An
+// empty string returns 0, leaving Go's default.
+func ParseVersion(s string) (uint16, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", s)
+	}
+}
+
+func modTime(file string) (time.Time, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
@@ -0,0 +1,152 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSigned writes a self-signed certificate and key for cn and sets
+// both files' modification time to mod.
+func writeSelfSigned(t *testing.T, certFile, keyFile, cn string, mod time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestKeyPairReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	start := time.Now().Add(-time.Minute)
+
+	writeSelfSigned(t, certFile, keyFile, "first", start)
+	kp, err := NewKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewKeyPair: %v", err)
+	}
+	first, _ := kp.Certificate()
+
+	writeSelfSigned(t, certFile, keyFile, "second", start.Add(time.Second))
+	second, err := kp.Certificate()
+	if err != nil {
+		t.Fatalf("Certificate: %v", err)
+	}
+	if first == second {
+		t.Fatalf("expected certificate to be reloaded after rotation")
+	}
+
+	// A broken rotation keeps serving the last good certificate.
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	third, err := kp.Certificate()
+	if err != nil || third != second {
+		t.Fatalf("expected previous certificate after failed reload, got err=%v", err)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	if v, err := ParseVersion("1.3"); err != nil || v != 0x0304 {
+		t.Fatalf("expected TLS 1.3, got %x err=%v", v, err)
+	}
+	if v, err := ParseVersion(""); err != nil || v != 0 {
+		t.Fatalf("expected default, got %x err=%v", v, err)
+	}
+	if _, err := ParseVersion("2.0"); err == nil {
+		t.Fatalf("expected error for unknown version")
+	}
+}
+
+func TestVerifyClient(t *testing.T) {
+	newCert := func(cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(time.Now().UnixNano()),
+			Subject:               pkix.Name{CommonName: cn},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  isCA,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		if parent == nil {
+			parent, parentKey = tmpl, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatalf("create certificate: %v", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("parse certificate: %v", err)
+		}
+		return cert, key
+	}
+
+	ca, caKey := newCert("ca", true, nil, nil)
+	client, _ := newCert("client", false, ca, caKey)
+	stranger, _ := newCert("stranger", false, nil, nil)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewCertPool(caFile)
+	if err != nil {
+		t.Fatalf("NewCertPool: %v", err)
+	}
+	verify := pool.VerifyClient()
+
+	if err := verify(tls.ConnectionState{}); err != nil {
+		t.Fatalf("expected connections without a client certificate to be allowed, got %v", err)
+	}
+	if err := verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{client}}); err != nil {
+		t.Fatalf("expected certificate issued by the CA to verify, got %v", err)
+	}
+	if err := verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{stranger}}); err == nil {
+		t.Fatalf("expected certificate from another issuer to be rejected")
+	}
+}